@@ -0,0 +1,205 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const contextKeyClient = contextKey("client")
+
+// clientInfo identifies the client that made a request, for RequestLogger.
+type clientInfo struct {
+	client string
+	user   string // "-" if the client didn't authenticate
+}
+
+// accessControl restricts which clients can use alpaca (and therefore the user's proxy
+// credentials): by IP address, and optionally by requiring clients to authenticate using Basic
+// auth. It also adds the client's address and username to the request's log line.
+type accessControl struct {
+	allow []*net.IPNet
+	users map[string][]byte // bcrypt password hashes, keyed by username
+	// verified caches the credentials that have been checked successfully, since checking a
+	// bcrypt hash on every request would be slow. It's keyed by a hash of the credentials.
+	verified map[[sha256.Size]byte]bool
+	mux      sync.Mutex
+}
+
+func newAccessControl(allow []*net.IPNet, users map[string][]byte) *accessControl {
+	return &accessControl{
+		allow:    allow,
+		users:    users,
+		verified: map[[sha256.Size]byte]bool{},
+	}
+}
+
+// parseAllowList parses a comma-separated list of IP addresses and CIDR blocks.
+func parseAllowList(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func loadUsers(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseUsers(f)
+}
+
+// parseUsers reads usernames and passwords in the format of an htpasswd file with bcrypt
+// hashes (e.g. as created by "htpasswd -B"), with one "username:hash" entry per line.
+func parseUsers(r io.Reader) (map[string][]byte, error) {
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected username:hash", n)
+		}
+		hash := []byte(line[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("line %d: password hash must use bcrypt: %w", n, err)
+		}
+		users[line[:i]] = hash
+	}
+	return users, scanner.Err()
+}
+
+func (ac *accessControl) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client := req.RemoteAddr
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		if !ac.allowed(client) {
+			logFor(req, "client", client).Warnf("Refusing request from %s: address not allowed", client)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		user := "-"
+		// Only proxy requests need to be authenticated. Clients can't send credentials when
+		// fetching alpaca.pac (for example), and origin-form requests don't use our
+		// credentials anyway.
+		if ac.users != nil && (req.Method == http.MethodConnect || req.URL.Scheme != "") {
+			var ok bool
+			user, ok = ac.authenticate(req)
+			if !ok {
+				logFor(req, "client", client).
+					Warnf("Refusing request from %s: authentication required", client)
+				w.Header().Set("Proxy-Authenticate", `Basic realm="alpaca"`)
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+			accessRecordFor(req).setUser(user)
+		}
+		ctx := context.WithValue(req.Context(), contextKeyClient, &clientInfo{client, user})
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func (ac *accessControl) allowed(client string) bool {
+	if len(ac.allow) == 0 {
+		return true
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		// The client connected using a unix socket, so it's on this machine (and it was
+		// allowed to connect by the socket's permissions).
+		return true
+	}
+	for _, ipnet := range ac.allow {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the Basic credentials in the request's Proxy-Authorization header, and
+// returns the username if they are valid. The header is removed later by deleteRequestHeaders,
+// so it isn't sent to the upstream proxy.
+func (ac *accessControl) authenticate(req *http.Request) (string, bool) {
+	const prefix = "Basic "
+	value := req.Header.Get("Proxy-Authorization")
+	if len(value) < len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	credentials := string(decoded)
+	i := strings.Index(credentials, ":")
+	if i < 0 {
+		return "", false
+	}
+	user, password := credentials[:i], credentials[i+1:]
+	hash, ok := ac.users[user]
+	if !ok {
+		return "", false
+	}
+	key := sha256.Sum256([]byte(string(hash) + "\x00" + credentials))
+	ac.mux.Lock()
+	verified := ac.verified[key]
+	ac.mux.Unlock()
+	if verified {
+		return user, true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+	ac.mux.Lock()
+	ac.verified[key] = true
+	ac.mux.Unlock()
+	return user, true
+}
@@ -0,0 +1,191 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseAllowList(t *testing.T) {
+	nets, err := parseAllowList("10.0.0.0/8, 192.0.2.1,2001:db8::/32,::1")
+	require.NoError(t, err)
+	require.Len(t, nets, 4)
+	assert.Equal(t, "10.0.0.0/8", nets[0].String())
+	assert.Equal(t, "192.0.2.1/32", nets[1].String())
+	assert.Equal(t, "2001:db8::/32", nets[2].String())
+	assert.Equal(t, "::1/128", nets[3].String())
+	_, err = parseAllowList("10.0.0.0/8,bogus")
+	assert.Error(t, err)
+}
+
+func TestParseUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	users, err := parseUsers(strings.NewReader("# comment\n\nalice:" + string(hash) + "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"alice": hash}, users)
+	_, err = parseUsers(strings.NewReader("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"))
+	assert.Error(t, err)
+	_, err = parseUsers(strings.NewReader("alice\n"))
+	assert.Error(t, err)
+}
+
+func newTestAccessControl(t *testing.T, allow string) *accessControl {
+	nets, err := parseAllowList(allow)
+	require.NoError(t, err)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	return newAccessControl(nets, map[string][]byte{"alice": hash})
+}
+
+func TestAccessControl(t *testing.T) {
+	ac := newTestAccessControl(t, "192.0.2.0/24")
+	var forwarded *http.Request
+	handler := ac.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded = req
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		remoteAddr string
+		user       string
+		password   string
+		status     int
+	}{
+		{"Allowed", http.MethodGet, "http://www.test/", "192.0.2.1:1234", "alice", "secret",
+			http.StatusTeapot},
+		{"Connect", http.MethodConnect, "www.test:443", "192.0.2.1:1234", "alice", "secret",
+			http.StatusTeapot},
+		{"NotAllowed", http.MethodGet, "http://www.test/", "198.51.100.1:1234", "alice",
+			"secret", http.StatusForbidden},
+		{"NoCredentials", http.MethodGet, "http://www.test/", "192.0.2.1:1234", "", "",
+			http.StatusProxyAuthRequired},
+		{"WrongPassword", http.MethodConnect, "www.test:443", "192.0.2.1:1234", "alice",
+			"guess", http.StatusProxyAuthRequired},
+		{"UnknownUser", http.MethodGet, "http://www.test/", "192.0.2.1:1234", "bob", "secret",
+			http.StatusProxyAuthRequired},
+		{"OriginForm", http.MethodGet, "/alpaca.pac", "192.0.2.1:1234", "", "",
+			http.StatusTeapot},
+		{"OriginFormNotAllowed", http.MethodGet, "/alpaca.pac", "198.51.100.1:1234", "", "",
+			http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forwarded = nil
+			req := httptest.NewRequest(test.method, test.target, nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.user != "" {
+				req.SetBasicAuth(test.user, test.password)
+				req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+				req.Header.Del("Authorization")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, test.status, w.Code)
+			if test.status == http.StatusProxyAuthRequired {
+				assert.Equal(t, `Basic realm="alpaca"`, w.Header().Get("Proxy-Authenticate"))
+			}
+			assert.Equal(t, test.status == http.StatusTeapot, forwarded != nil)
+		})
+	}
+}
+
+func TestAccessControlLog(t *testing.T) {
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+	ac := newTestAccessControl(t, "")
+	handler := ac.WrapHandler(RequestLogger(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})))
+	req := httptest.NewRequest(http.MethodGet, "http://www.test/index.html", nil)
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyID, 7))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0") // alice:secret
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Contains(t, b.String(), "[7] 192.0.2.1 alice 404 GET http://www.test/index.html")
+	// The client's details are added to the request's log line, rather than logged separately.
+	assert.Equal(t, 1, strings.Count(b.String(), "\n"))
+}
+
+func TestAccessControlLogFields(t *testing.T) {
+	b := useStructuredLog(t, "json")
+	ac := newTestAccessControl(t, "")
+	handler := ac.WrapHandler(RequestLogger(http.NotFoundHandler()))
+	req := httptest.NewRequest(http.MethodGet, "http://www.test/index.html", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0") // alice:secret
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &entry))
+	assert.Equal(t, "192.0.2.1", entry["client"])
+	assert.Equal(t, "alice", entry["user"])
+	assert.Equal(t, 404.0, entry["status"])
+}
+
+func TestAuthenticationCache(t *testing.T) {
+	ac := newTestAccessControl(t, "")
+	req := httptest.NewRequest(http.MethodConnect, "www.test:443", nil)
+	req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0") // alice:secret
+	user, ok := ac.authenticate(req)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user)
+	assert.Len(t, ac.verified, 1)
+	_, ok = ac.authenticate(req)
+	assert.True(t, ok)
+	// Changing the user's password invalidates the cached credentials.
+	hash, err := bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+	require.NoError(t, err)
+	ac.users["alice"] = hash
+	_, ok = ac.authenticate(req)
+	assert.False(t, ok)
+}
+
+func TestAccessControlAllowsTunnels(t *testing.T) {
+	// The wrapped ResponseWriter still has to support hijacking for CONNECT requests.
+	ac := newTestAccessControl(t, "127.0.0.1")
+	proxy := httptest.NewServer(ac.WrapHandler(newDirectProxy()))
+	defer proxy.Close()
+	server := httptest.NewTLSServer(testServer{make(chan string, 1)})
+	defer server.Close()
+	proxyURL := proxyServer(t, proxy)
+	tr := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			u, err := proxyURL(req)
+			if u != nil {
+				u.User = url.UserPassword("alice", "secret")
+			}
+			return u, err
+		},
+		TLSClientConfig: tlsConfig(server),
+	}
+	testGetRequest(t, tr, server.URL)
+}
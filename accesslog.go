@@ -0,0 +1,313 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const contextKeyAccess = contextKey("access")
+
+// accessLog writes a line for each request that alpaca handles, in one of these formats:
+//
+//	common    the Common Log Format
+//	combined  the Combined Log Format (the Common Log Format plus the referer and user agent)
+//	json      a JSON object per line
+//
+// In the common and combined formats, alpaca's own fields come after the standard ones, as
+// key=value pairs. CONNECT requests are logged when their tunnel closes (rather than when the
+// tunnel is established), so that the number of bytes sent each way is known.
+type accessLog struct {
+	format string
+	w      io.Writer
+	mux    sync.Mutex
+}
+
+func newAccessLog(format string, w io.Writer) (*accessLog, error) {
+	switch format {
+	case "common", "combined", "json":
+		return &accessLog{format: format, w: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown access log format %q (expected common, combined or "+
+			"json)", format)
+	}
+}
+
+// accessRecord collects the details of a request for the access log, as the request passes
+// through alpaca's handlers. Its methods are safe to call on a nil accessRecord (for requests
+// that aren't being logged), which does nothing.
+type accessRecord struct {
+	log          *accessLog
+	id           interface{}
+	start        time.Time
+	client       string
+	user         string
+	method       string
+	target       string
+	proto        string
+	referer      string
+	userAgent    string
+	status       int
+	route        string // "DIRECT", the upstream proxy, or BLOCK (if a rule blocked it)
+	upstream     int    // the status of the upstream proxy's (or server's) response
+	bytesUp      int64  // from the client (the request body, or sent through the tunnel)
+	bytesDown    int64  // to the client (the response body, or sent through the tunnel)
+	authAttempts int    // the number of times alpaca authenticated to the upstream proxy
+	tunnel       bool   // true if a tunnel was opened for the request
+	closed       bool   // true once the tunnel has closed
+	done         bool   // true once the handler has returned
+	end          time.Time
+	mux          sync.Mutex
+}
+
+func accessRecordFor(req *http.Request) *accessRecord {
+	rec, _ := req.Context().Value(contextKeyAccess).(*accessRecord)
+	return rec
+}
+
+func (rec *accessRecord) setUser(user string) {
+	if rec == nil {
+		return
+	}
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+	rec.user = user
+}
+
+func (rec *accessRecord) setRoute(route string) {
+	if rec == nil {
+		return
+	}
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+	rec.route = route
+}
+
+func (rec *accessRecord) setUpstreamStatus(status int) {
+	if rec == nil {
+		return
+	}
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+	rec.upstream = status
+}
+
+func (rec *accessRecord) addAuthAttempt() {
+	if rec == nil {
+		return
+	}
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+	rec.authAttempts++
+}
+
+// openTunnel is called once a CONNECT request's tunnel is established, so that the request is
+// logged when closeTunnel is called, rather than when the handler returns.
+func (rec *accessRecord) openTunnel() {
+	if rec == nil {
+		return
+	}
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+	rec.tunnel = true
+}
+
+// closeTunnel records the number of bytes that were sent through a CONNECT request's tunnel in
+// each direction, and logs the request (unless its handler is still running, in which case the
+// request is logged when it returns).
+func (rec *accessRecord) closeTunnel(up, down int64) {
+	if rec == nil {
+		return
+	}
+	rec.mux.Lock()
+	rec.bytesUp, rec.bytesDown, rec.end, rec.closed = up, down, time.Now(), true
+	done := rec.done
+	rec.mux.Unlock()
+	if done {
+		rec.log.write(rec)
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (al *accessLog) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &accessRecord{
+			log:       al,
+			id:        req.Context().Value(contextKeyID),
+			start:     time.Now(),
+			client:    req.RemoteAddr,
+			method:    req.Method,
+			target:    req.RequestURI,
+			proto:     req.Proto,
+			referer:   req.Referer(),
+			userAgent: req.UserAgent(),
+		}
+		if host, _, err := net.SplitHostPort(rec.client); err == nil {
+			rec.client = host
+		}
+		var body *countingReader
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &countingReader{ReadCloser: req.Body}
+			req.Body = body
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(req.Context(), contextKeyAccess, rec)
+		next.ServeHTTP(sw, req.WithContext(ctx))
+		rec.mux.Lock()
+		rec.status, rec.done = sw.status, true
+		if !rec.tunnel {
+			rec.bytesDown, rec.end = sw.bytes, time.Now()
+			if body != nil {
+				rec.bytesUp = body.n
+			}
+		}
+		ready := !rec.tunnel || rec.closed
+		rec.mux.Unlock()
+		if ready {
+			al.write(rec)
+		}
+	})
+}
+
+// accessEntry is a line of the access log, in the json format.
+type accessEntry struct {
+	Time         string      `json:"time"`
+	ID           interface{} `json:"id,omitempty"`
+	Client       string      `json:"client"`
+	User         string      `json:"user,omitempty"`
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	Proto        string      `json:"proto"`
+	Status       int         `json:"status"`
+	Route        string      `json:"route,omitempty"`
+	Upstream     int         `json:"upstream_status,omitempty"`
+	BytesUp      int64       `json:"bytes_up"`
+	BytesDown    int64       `json:"bytes_down"`
+	Duration     int64       `json:"duration_ms"`
+	AuthAttempts int         `json:"auth_attempts"`
+	Referer      string      `json:"referer,omitempty"`
+	UserAgent    string      `json:"user_agent,omitempty"`
+}
+
+func (al *accessLog) write(rec *accessRecord) {
+	rec.mux.Lock()
+	line := al.line(rec)
+	rec.mux.Unlock()
+	al.mux.Lock()
+	defer al.mux.Unlock()
+	if _, err := io.WriteString(al.w, line); err != nil {
+		warnf("Error writing to access log: %v", err)
+	}
+}
+
+// Close closes the file that the access log is written to. Anything logged afterwards (e.g. for
+// tunnels that were interrupted at shutdown) is discarded.
+func (al *accessLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	al.mux.Lock()
+	defer al.mux.Unlock()
+	c, ok := al.w.(io.Closer)
+	al.w = io.Discard
+	if !ok {
+		return nil
+	}
+	return c.Close()
+}
+
+// line formats a record as a line of the access log. The record must be locked.
+func (al *accessLog) line(rec *accessRecord) string {
+	duration := rec.end.Sub(rec.start).Milliseconds()
+	if al.format == "json" {
+		b, err := json.Marshal(accessEntry{
+			Time:         rec.start.Format(time.RFC3339Nano),
+			ID:           rec.id,
+			Client:       rec.client,
+			User:         rec.user,
+			Method:       rec.method,
+			URL:          rec.target,
+			Proto:        rec.proto,
+			Status:       rec.status,
+			Route:        rec.route,
+			Upstream:     rec.upstream,
+			BytesUp:      rec.bytesUp,
+			BytesDown:    rec.bytesDown,
+			Duration:     duration,
+			AuthAttempts: rec.authAttempts,
+			Referer:      rec.referer,
+			UserAgent:    rec.userAgent,
+		})
+		if err != nil {
+			// This can only happen if the request ID can't be marshalled.
+			return fmt.Sprintf("{\"error\":%q}\n", err)
+		}
+		return string(b) + "\n"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - %s [%s] %s %d %s", orDash(rec.client), orDash(rec.user),
+		rec.start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(rec.method+" "+rec.target+" "+rec.proto), rec.status,
+		formatCount(rec.bytesDown))
+	if al.format == "combined" {
+		fmt.Fprintf(&b, " %s %s", quoteOrDash(rec.referer), quoteOrDash(rec.userAgent))
+	}
+	fmt.Fprintf(&b, " id=%v route=%s upstream_status=%s bytes_up=%d bytes_down=%d "+
+		"duration_ms=%d auth_attempts=%d\n", rec.id, orDash(rec.route),
+		formatCount(int64(rec.upstream)), rec.bytesUp, rec.bytesDown, duration,
+		rec.authAttempts)
+	return b.String()
+}
+
+// formatCount formats a number for the common and combined formats, which use "-" for zero.
+func formatCount(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,241 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lineRecorder is an io.Writer that sends each write (which is a line of the access log) to
+// the channel.
+type lineRecorder chan string
+
+func (lr lineRecorder) Write(p []byte) (int, error) {
+	lr <- string(p)
+	return len(p), nil
+}
+
+func newAccessLogServer(t *testing.T, lc listenerConfig) (*url.URL, lineRecorder) {
+	lines := make(lineRecorder, 10)
+	al, err := newAccessLog("json", lines)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	s := createServer(lc, serverOptions{accessLog: al})
+	go serve(s, l) //nolint:errcheck
+	t.Cleanup(func() { closeServer(s) })
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}, lines
+}
+
+func nextAccessEntry(t *testing.T, lines lineRecorder) accessEntry {
+	var entry accessEntry
+	select {
+	case line := <-lines:
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "nothing was written to the access log")
+	}
+	return entry
+}
+
+func TestAccessLogLine(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec := &accessRecord{
+		id:           uint64(7),
+		start:        start,
+		end:          start.Add(1500 * time.Millisecond),
+		client:       "127.0.0.1",
+		user:         "alice",
+		method:       "GET",
+		target:       "http://example.com/",
+		proto:        "HTTP/1.1",
+		userAgent:    "curl/8.0",
+		status:       200,
+		route:        "proxy.test:8080",
+		upstream:     200,
+		bytesUp:      0,
+		bytesDown:    512,
+		authAttempts: 1,
+	}
+	extra := " id=7 route=proxy.test:8080 upstream_status=200 bytes_up=0 bytes_down=512 " +
+		"duration_ms=1500 auth_attempts=1\n"
+	common := `127.0.0.1 - alice [02/Jan/2026:03:04:05 +0000] "GET http://example.com/ ` +
+		`HTTP/1.1" 200 512`
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"common", common + extra},
+		{"combined", common + ` "-" "curl/8.0"` + extra},
+		{"json", `{"time":"2026-01-02T03:04:05Z","id":7,"client":"127.0.0.1","user":"alice",` +
+			`"method":"GET","url":"http://example.com/","proto":"HTTP/1.1","status":200,` +
+			`"route":"proxy.test:8080","upstream_status":200,"bytes_up":0,"bytes_down":512,` +
+			`"duration_ms":1500,"auth_attempts":1,"user_agent":"curl/8.0"}` + "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			al, err := newAccessLog(test.format, io.Discard)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, al.line(rec))
+		})
+	}
+}
+
+func TestAccessLogLineWithoutDetails(t *testing.T) {
+	// A request that alpaca refused, before it was routed anywhere.
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec := &accessRecord{
+		id: uint64(8), start: start, end: start, client: "192.0.2.1", method: "CONNECT",
+		target: "example.com:443", proto: "HTTP/1.1", status: 403,
+	}
+	al, err := newAccessLog("common", io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, `192.0.2.1 - - [02/Jan/2026:03:04:05 +0000] "CONNECT example.com:443 `+
+		`HTTP/1.1" 403 - id=8 route=- upstream_status=- bytes_up=0 bytes_down=0 duration_ms=0 `+
+		"auth_attempts=0\n", al.line(rec))
+}
+
+func TestNewAccessLogInvalidFormat(t *testing.T) {
+	_, err := newAccessLog("xml", io.Discard)
+	assert.Error(t, err)
+}
+
+func TestAccessLogClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 0, 0)
+	require.NoError(t, err)
+	al, err := newAccessLog("common", f)
+	require.NoError(t, err)
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec := &accessRecord{start: start, end: start, client: "192.0.2.1", method: "GET",
+		target: "http://www.test/", proto: "HTTP/1.1", status: 200}
+	al.write(rec)
+	require.NoError(t, al.Close())
+	assert.Error(t, f.f.Close(), "the file should already be closed")
+	// Records that finish after the access log has been closed are dropped.
+	al.write(rec)
+	assert.Equal(t, 1, strings.Count(readFile(t, path), "\n"))
+	var nilLog *accessLog
+	assert.NoError(t, nilLog.Close())
+}
+
+func TestAccessLogRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		fmt.Fprint(w, "Hello, client")
+	}))
+	defer server.Close()
+	lc := listenerConfig{host: "localhost", finder: ProxyFinderConfig{NoPAC: true}}
+	proxyURL, lines := newAccessLogServer(t, lc)
+	client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("Hello, server"))
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	entry := nextAccessEntry(t, lines)
+	assert.Equal(t, "127.0.0.1", entry.Client)
+	assert.Equal(t, "POST", entry.Method)
+	assert.Equal(t, server.URL+"/", entry.URL)
+	assert.Equal(t, http.StatusOK, entry.Status)
+	assert.Equal(t, "DIRECT", entry.Route)
+	assert.Equal(t, http.StatusOK, entry.Upstream)
+	assert.Equal(t, int64(13), entry.BytesUp)
+	assert.Equal(t, int64(13), entry.BytesDown)
+	assert.Equal(t, 0, entry.AuthAttempts)
+}
+
+func TestAccessLogAuthAttempts(t *testing.T) {
+	upstream := httptest.NewServer(ntlmServer{t})
+	defer upstream.Close()
+	base := listenerConfig{
+		host:   "localhost",
+		finder: ProxyFinderConfig{NoPAC: true},
+		auth:   &authenticator{"isis", "malory", getNtlmHash([]byte("guest"))},
+	}
+	lc, err := parseListenerFlag("0,proxy="+upstream.Listener.Addr().String(), base)
+	require.NoError(t, err)
+	proxyURL, lines := newAccessLogServer(t, lc)
+	client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://example.com/")
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	entry := nextAccessEntry(t, lines)
+	assert.Equal(t, upstream.Listener.Addr().String(), entry.Route)
+	assert.Equal(t, http.StatusOK, entry.Upstream)
+	assert.Equal(t, 1, entry.AuthAttempts)
+	assert.Equal(t, int64(len("Access granted")), entry.BytesDown)
+}
+
+func TestAccessLogTunnel(t *testing.T) {
+	// The server echoes whatever it receives.
+	server, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+	lc := listenerConfig{host: "localhost", finder: ProxyFinderConfig{NoPAC: true}}
+	proxyURL, lines := newAccessLogServer(t, lc)
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	req, err := http.NewRequest(http.MethodConnect, "//"+server.Addr().String(), nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(rd, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	// Nothing is logged until the tunnel closes.
+	select {
+	case line := <-lines:
+		assert.Fail(t, "logged before the tunnel closed", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Close()
+	entry := nextAccessEntry(t, lines)
+	assert.Equal(t, "CONNECT", entry.Method)
+	assert.Equal(t, server.Addr().String(), entry.URL)
+	assert.Equal(t, http.StatusOK, entry.Status)
+	assert.Equal(t, "DIRECT", entry.Route)
+	assert.Equal(t, int64(4), entry.BytesUp)
+	assert.Equal(t, int64(4), entry.BytesDown)
+}
@@ -1,4 +1,4 @@
-// Copyright 2019, 2021 The Alpaca Authors
+// Copyright 2019, 2021, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -20,7 +20,6 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -38,27 +37,27 @@ func (a authenticator) do(req *http.Request, rt http.RoundTripper) (*http.Respon
 	hostname, _ := os.Hostname() // in case of error, just use the zero value ("") as hostname
 	negotiate, err := ntlmssp.NewNegotiateMessage(a.domain, hostname)
 	if err != nil {
-		log.Printf("Error creating NTLM Type 1 (Negotiate) message: %v", err)
+		errorf("Error creating NTLM Type 1 (Negotiate) message: %v", err)
 		return nil, err
 	}
 	req.Header.Set("Proxy-Authorization", "NTLM "+base64.StdEncoding.EncodeToString(negotiate))
 	resp, err := rt.RoundTrip(req)
 	if err != nil {
-		log.Printf("Error sending NTLM Type 1 (Negotiate) request: %v", err)
+		warnf("Error sending NTLM Type 1 (Negotiate) request: %v", err)
 		return nil, err
 	} else if resp.StatusCode != http.StatusProxyAuthRequired {
-		log.Printf("Expected response with status 407, got %s", resp.Status)
+		warnf("Expected response with status 407, got %s", resp.Status)
 		return resp, nil
 	}
 	challenge, err := base64.StdEncoding.DecodeString(
 		strings.TrimPrefix(resp.Header.Get("Proxy-Authenticate"), "NTLM "))
 	if err != nil {
-		log.Printf("Error decoding NTLM Type 2 (Challenge) message: %v", err)
+		warnf("Error decoding NTLM Type 2 (Challenge) message: %v", err)
 		return nil, err
 	}
 	authenticate, err := ntlmssp.ProcessChallengeWithHash(challenge, a.username, a.hash)
 	if err != nil {
-		log.Printf("Error processing NTLM Type 2 (Challenge) message: %v", err)
+		warnf("Error processing NTLM Type 2 (Challenge) message: %v", err)
 		return nil, err
 	}
 	req.Header.Set("Proxy-Authorization",
@@ -1,4 +1,4 @@
-// Copyright 2021 The Alpaca Authors
+// Copyright 2021, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -15,8 +15,15 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sort"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -24,58 +31,279 @@ import (
 // https://crsrc.org/net/docs/proxy.md).
 const maxAge = 5 * time.Minute
 
+// failureKind classifies the reason that a proxy was blocked.
+type failureKind int
+
+const (
+	failureUnknown failureKind = iota
+	failureDNS
+	failureRefused
+	failureTLS
+	failureTimeout
+	failureProxyStatus
+	failureManual // blocked using alpaca ctl, rather than because it failed
+)
+
+func (k failureKind) String() string {
+	switch k {
+	case failureDNS:
+		return "dns"
+	case failureRefused:
+		return "refused"
+	case failureTLS:
+		return "tls"
+	case failureTimeout:
+		return "timeout"
+	case failureProxyStatus:
+		return "proxy-error"
+	case failureManual:
+		return "manual"
+	default:
+		return "unknown"
+	}
+}
+
+// blockPolicy determines how long a proxy is blocked for. The first failure blocks the proxy
+// for the base duration, and each consecutive failure after that doubles it (up to the maximum).
+type blockPolicy struct {
+	base, max time.Duration
+}
+
+var blockPolicies = map[failureKind]blockPolicy{
+	failureUnknown: {maxAge, 4 * maxAge},
+	// If the proxy's name doesn't resolve, we've probably left the network it's on, which
+	// isn't likely to change in a hurry (and if it does, the PAC file will be reloaded).
+	failureDNS: {maxAge, 6 * maxAge},
+	// A refused connection often means the proxy is restarting, so retry it fairly soon.
+	failureRefused: {30 * time.Second, maxAge},
+	// TLS failures are usually caused by misconfiguration, which won't fix itself quickly.
+	failureTLS:     {maxAge, 12 * maxAge},
+	failureTimeout: {time.Minute, 3 * maxAge},
+	// The proxy is up, but overloaded or broken.
+	failureProxyStatus: {30 * time.Second, maxAge},
+}
+
+func classifyFailure(err error) failureKind {
+	var dnsErr *net.DNSError
+	var pse *proxyStatusError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var opErr *net.OpError
+	var authorityErr x509.UnknownAuthorityError
+	var certErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	switch {
+	case err == nil:
+		return failureUnknown
+	case errors.As(err, &dnsErr):
+		return failureDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return failureRefused
+	case errors.As(err, &pse):
+		return failureProxyStatus
+	case errors.As(err, &recordErr), errors.As(err, &authorityErr),
+		errors.As(err, &certErr), errors.As(err, &hostnameErr):
+		return failureTLS
+	case errors.As(err, &opErr) && (opErr.Op == "remote error" || opErr.Op == "local error"):
+		// This is how crypto/tls reports TLS alerts.
+		return failureTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return failureTimeout
+	default:
+		return failureUnknown
+	}
+}
+
+type blockEntry struct {
+	kind     failureKind
+	reason   string
+	failures int       // the number of consecutive failures
+	expiry   time.Time // when the entry stops blocking the proxy
+	forget   time.Time // when the entry (and the failure count) is deleted
+}
+
+// manual reports whether the entry is currently blocked because of alpaca ctl.
+func (e *blockEntry) manual(now time.Time) bool {
+	return e.kind == failureManual && now.Before(e.expiry)
+}
+
 type blocklist struct {
-	entries []string             // Slice of entries, ordered by expiry time
-	expiry  map[string]time.Time // Map containing the expiry time for each entry
+	entries map[string]*blockEntry
 	now     func() time.Time
 	mux     sync.Mutex
 }
 
 func newBlocklist() *blocklist {
 	return &blocklist{
-		entries: []string{},
-		expiry:  map[string]time.Time{},
+		entries: map[string]*blockEntry{},
 		now:     time.Now,
 	}
 }
 
+// add blocks an entry for an unknown reason.
 func (b *blocklist) add(entry string) {
+	b.fail(entry, nil)
+}
+
+// fail records a failure, and blocks the entry for a time depending on the kind of failure and
+// the number of consecutive failures.
+func (b *blocklist) fail(entry string, err error) {
 	b.mux.Lock()
 	defer b.mux.Unlock()
 	b.sweep()
-	if _, ok := b.expiry[entry]; ok {
-		// Ignore duplicate entries. An entry can only have a single expiry time, so it
-		// shouldn't be added to the `entries` slice twice. Otherwise we'll have problems
-		// deleting it later.
+	b.failLocked(entry, err)
+}
+
+// hold records a failure that is known to be ongoing (e.g. from a health check), and makes sure
+// that the entry stays blocked for at least the given duration. Unlike fail, calling it again
+// while the entry is blocked extends its expiry, so the entry stays blocked for as long as it
+// keeps failing.
+func (b *blocklist) hold(entry string, err error, d time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.sweep()
+	if e, ok := b.entries[entry]; ok && e.manual(b.now()) {
 		return
 	}
-	b.expiry[entry] = b.now().Add(maxAge)
-	b.entries = append(b.entries, entry)
+	b.failLocked(entry, err)
+	e := b.entries[entry]
+	if expiry := b.now().Add(d); e.expiry.Before(expiry) {
+		e.expiry = expiry
+	}
+	if e.forget.Before(e.expiry) {
+		e.forget = e.expiry
+	}
+}
+
+// failLocked is the body of fail. The blocklist must be locked.
+func (b *blocklist) failLocked(entry string, err error) {
+	now := b.now()
+	e, ok := b.entries[entry]
+	if !ok {
+		e = &blockEntry{}
+		b.entries[entry] = e
+	} else if now.Before(e.expiry) {
+		// Ignore failures while the entry is blocked. These are most likely concurrent
+		// requests which were sent before it was blocked, and shouldn't increase the backoff.
+		return
+	}
+	e.kind = classifyFailure(err)
+	if err != nil {
+		e.reason = err.Error()
+	} else {
+		e.reason = ""
+	}
+	e.failures++
+	policy := blockPolicies[e.kind]
+	age := policy.base
+	for i := 1; i < e.failures && age < policy.max; i++ {
+		age *= 2
+	}
+	if age > policy.max {
+		age = policy.max
+	}
+	e.expiry = now.Add(age)
+	// Remember the failure count for a while after the entry expires, so that a proxy which is
+	// still failing gets blocked for longer next time.
+	e.forget = e.expiry.Add(policy.max)
+}
+
+// block blocks an entry for a fixed duration, regardless of how many times it has failed.
+func (b *blocklist) block(entry, reason string, d time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.sweep()
+	e, ok := b.entries[entry]
+	if !ok {
+		e = &blockEntry{}
+		b.entries[entry] = e
+	}
+	e.kind = failureManual
+	e.reason = reason
+	e.expiry = b.now().Add(d)
+	e.forget = e.expiry
+}
+
+// remove unblocks an entry and resets its failure count, even if it was blocked manually.
+func (b *blocklist) remove(entry string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.entries, entry)
+}
+
+// succeed records that an entry has just worked, which unblocks it and resets its failure count,
+// unless it was blocked manually (in which case it stays blocked until it's removed or expires).
+func (b *blocklist) succeed(entry string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if e, ok := b.entries[entry]; ok && e.manual(b.now()) {
+		return
+	}
+	delete(b.entries, entry)
+}
+
+// clear removes every entry, including those that were blocked manually.
+func (b *blocklist) clear() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.entries = map[string]*blockEntry{}
+}
+
+// clearFailures removes every entry apart from those that were blocked manually (e.g. because
+// the network has changed, so past failures no longer mean anything).
+func (b *blocklist) clearFailures() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	now := b.now()
+	for entry, e := range b.entries {
+		if !e.manual(now) {
+			delete(b.entries, entry)
+		}
+	}
 }
 
 func (b *blocklist) contains(entry string) bool {
 	b.mux.Lock()
 	defer b.mux.Unlock()
 	b.sweep()
-	_, ok := b.expiry[entry]
-	return ok
+	e, ok := b.entries[entry]
+	return ok && b.now().Before(e.expiry)
 }
 
-func (b *blocklist) sweep() {
-	// Delete any stale entries from both the slice and the map. This function is *not*
-	// reentrant; `mux` should be locked before calling this function!
-	count := 0
-	for _, entry := range b.entries {
-		expiry, ok := b.expiry[entry]
-		if !ok {
-			// This should never happen.
-			panic(fmt.Sprintf("blocklist contains entry %q without expiry time", entry))
+// blockInfo describes an entry in the blocklist.
+type blockInfo struct {
+	Proxy    string    `json:"proxy"`
+	Kind     string    `json:"kind"`
+	Reason   string    `json:"reason,omitempty"`
+	Failures int       `json:"failures"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// list returns the entries that are currently blocked, sorted by name.
+func (b *blocklist) list() []blockInfo {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.sweep()
+	infos := []blockInfo{}
+	now := b.now()
+	for entry, e := range b.entries {
+		if !now.Before(e.expiry) {
+			continue
 		}
-		if b.now().Before(expiry) {
-			break
+		infos = append(infos, blockInfo{entry, e.kind.String(), e.reason, e.failures, e.expiry})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Proxy < infos[j].Proxy })
+	return infos
+}
+
+func (b *blocklist) sweep() {
+	// Delete any entries that have been forgotten. This function is *not* reentrant; `mux`
+	// should be locked before calling this function!
+	now := b.now()
+	for entry, e := range b.entries {
+		if !now.Before(e.forget) {
+			delete(b.entries, entry)
 		}
-		delete(b.expiry, entry)
-		count++
 	}
-	b.entries = b.entries[count:]
 }
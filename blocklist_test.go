@@ -1,4 +1,4 @@
-// Copyright 2021 The Alpaca Authors
+// Copyright 2021, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -15,10 +15,16 @@
 package main
 
 import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBlocklistExpiry(t *testing.T) {
@@ -56,3 +62,161 @@ func TestBlocklistDuplicateEntry(t *testing.T) {
 	now = now.Add(3*time.Minute)
 	b.contains("foo")
 }
+
+func TestBlocklistRemove(t *testing.T) {
+	b := newBlocklist()
+	var now time.Time
+	b.now = func() time.Time { return now }
+	b.add("foo")
+	b.add("bar")
+	b.remove("foo")
+	b.remove("baz")
+	assert.False(t, b.contains("foo"))
+	assert.True(t, b.contains("bar"))
+	b.add("foo")
+	assert.True(t, b.contains("foo"))
+	now = now.Add(6 * time.Minute)
+	assert.False(t, b.contains("foo"))
+	assert.False(t, b.contains("bar"))
+}
+
+func TestBlocklistBackoff(t *testing.T) {
+	b := newBlocklist()
+	var now time.Time
+	b.now = func() time.Time { return now }
+	refused := &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	expected := []time.Duration{
+		30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute,
+		5 * time.Minute,
+	}
+	for _, age := range expected {
+		b.fail("foo", refused)
+		// Failures while blocked don't count.
+		b.fail("foo", refused)
+		now = now.Add(age - time.Second)
+		assert.True(t, b.contains("foo"))
+		now = now.Add(time.Second)
+		assert.False(t, b.contains("foo"))
+	}
+	// Success resets the backoff.
+	b.remove("foo")
+	b.fail("foo", refused)
+	now = now.Add(30 * time.Second)
+	assert.False(t, b.contains("foo"))
+	// So does waiting long enough after the entry expires.
+	b.fail("foo", refused)
+	now = now.Add(time.Minute + 5*time.Minute)
+	b.fail("foo", refused)
+	now = now.Add(30 * time.Second)
+	assert.False(t, b.contains("foo"))
+}
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected failureKind
+	}{
+		{"Nil", nil, failureUnknown},
+		{"DNS", &net.OpError{Op: "proxyconnect", Err: &net.DNSError{Err: "no such host"}},
+			failureDNS},
+		{"Refused", &net.OpError{Op: "proxyconnect",
+			Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, failureRefused},
+		{"Timeout", &net.OpError{Op: "proxyconnect", Err: os.ErrDeadlineExceeded},
+			failureTimeout},
+		{"TLS", &net.OpError{Op: "proxyconnect", Err: x509.UnknownAuthorityError{}},
+			failureTLS},
+		{"TLSAlert", &net.OpError{Op: "remote error", Err: errors.New("handshake failure")},
+			failureTLS},
+		{"ProxyStatus", &proxyStatusError{"503 Service Unavailable", 503}, failureProxyStatus},
+		{"Other", errors.New("something else"), failureUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, classifyFailure(test.err))
+		})
+	}
+}
+
+func TestBlocklistList(t *testing.T) {
+	b := newBlocklist()
+	var now time.Time
+	b.now = func() time.Time { return now }
+	b.fail("foo", &proxyStatusError{"503 Service Unavailable", 503})
+	b.add("bar")
+	infos := b.list()
+	require.Len(t, infos, 2)
+	assert.Equal(t, blockInfo{"bar", "unknown", "", 1, now.Add(maxAge)}, infos[0])
+	assert.Equal(t, "foo", infos[1].Proxy)
+	assert.Equal(t, "proxy-error", infos[1].Kind)
+	assert.Equal(t, "unexpected response status: 503 Service Unavailable", infos[1].Reason)
+	now = now.Add(time.Minute)
+	assert.Len(t, b.list(), 1)
+	b.clear()
+	assert.Empty(t, b.list())
+}
+
+func TestBlocklistBlock(t *testing.T) {
+	b := newBlocklist()
+	var now time.Time
+	b.now = func() time.Time { return now }
+	b.block("foo", "maintenance", time.Hour)
+	// Failures don't change how long a manually blocked entry is blocked for.
+	b.fail("foo", errors.New("failed"))
+	info := b.list()
+	require.Len(t, info, 1)
+	assert.Equal(t, blockInfo{"foo", "manual", "maintenance", 0, now.Add(time.Hour)}, info[0])
+	now = now.Add(time.Hour - time.Second)
+	assert.True(t, b.contains("foo"))
+	now = now.Add(time.Second)
+	assert.False(t, b.contains("foo"))
+}
+
+func TestBlocklistHold(t *testing.T) {
+	b := newBlocklist()
+	var now time.Time
+	b.now = func() time.Time { return now }
+	// Holding an entry that isn't blocked blocks it for at least the given duration, even if
+	// its failure would normally block it for less.
+	b.hold("foo", syscall.ECONNREFUSED, 2*time.Minute)
+	now = now.Add(time.Minute)
+	assert.True(t, b.contains("foo"))
+	// Holding it again extends the expiry, unlike fail.
+	b.hold("foo", syscall.ECONNREFUSED, 2*time.Minute)
+	now = now.Add(90 * time.Second)
+	assert.True(t, b.contains("foo"))
+	now = now.Add(time.Minute)
+	assert.False(t, b.contains("foo"))
+	// The hold never shortens the time that an entry is blocked for.
+	b.hold("bar", errors.New("oops"), time.Second)
+	now = now.Add(maxAge - time.Second)
+	assert.True(t, b.contains("bar"))
+}
+
+func TestBlocklistKeepsManualEntries(t *testing.T) {
+	b := newBlocklist()
+	var now time.Time
+	b.now = func() time.Time { return now }
+	b.block("foo", "maintenance", time.Hour)
+	b.add("bar")
+	// Successes and clearing failures (e.g. after a network change) don't unblock manual entries.
+	b.succeed("foo")
+	b.succeed("bar")
+	assert.True(t, b.contains("foo"))
+	assert.False(t, b.contains("bar"))
+	b.add("bar")
+	b.clearFailures()
+	assert.True(t, b.contains("foo"))
+	assert.False(t, b.contains("bar"))
+	// Health checks don't extend them either.
+	b.hold("foo", errors.New("failed"), 2*time.Hour)
+	now = now.Add(time.Hour)
+	assert.False(t, b.contains("foo"))
+	// Removing or clearing the blocklist does unblock them.
+	b.block("foo", "maintenance", time.Hour)
+	b.remove("foo")
+	assert.False(t, b.contains("foo"))
+	b.block("foo", "maintenance", time.Hour)
+	b.clear()
+	assert.False(t, b.contains("foo"))
+}
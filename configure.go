@@ -0,0 +1,407 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// A clientConfig describes how to configure a client (such as git) to use alpaca, by updating
+// its configuration file.
+type clientConfig struct {
+	name string
+	// system is true if the file is shared by all users (so root is needed to change it); these
+	// clients are only configured when they're named explicitly.
+	system bool
+	path   func(home string) string
+	update func(old []byte, s proxySettings) ([]byte, error)
+	note   string // printed after the file is updated
+}
+
+// The root directory for system-wide configuration files (which is changed by tests).
+var systemRoot = "/"
+
+var clientConfigs = []clientConfig{
+	{name: "git", path: homePath(".gitconfig"), update: updateGit},
+	{name: "npm", path: homePath(".npmrc"), update: updateNPM},
+	{name: "pip", path: pipConfigPath, update: updatePip},
+	{
+		name:   "docker",
+		path:   homePath(".docker", "config.json"),
+		update: updateDockerClient,
+		note: "containers can't reach alpaca on localhost; use -l to give an address " +
+			"that they can reach, if needed",
+	},
+	{name: "maven", path: homePath(".m2", "settings.xml"), update: updateMaven},
+	{
+		name:   "apt",
+		system: true,
+		path:   systemPath("etc", "apt", "apt.conf.d", "95alpaca"),
+		update: updateApt,
+	},
+	{
+		name:   "docker-daemon",
+		system: true,
+		path:   systemPath("etc", "systemd", "system", "docker.service.d", "http-proxy.conf"),
+		update: updateDockerDaemon,
+		note:   "run `systemctl daemon-reload && systemctl restart docker` to apply this",
+	},
+}
+
+func homePath(elem ...string) func(string) string {
+	return func(home string) string {
+		return filepath.Join(append([]string{home}, elem...)...)
+	}
+}
+
+func systemPath(elem ...string) func(string) string {
+	return func(string) string {
+		return filepath.Join(append([]string{systemRoot}, elem...)...)
+	}
+}
+
+func pipConfigPath(home string) string {
+	switch runtime.GOOS {
+	case "windows":
+		if appdata := os.Getenv("APPDATA"); appdata != "" {
+			return filepath.Join(appdata, "pip", "pip.ini")
+		}
+		return filepath.Join(home, "AppData", "Roaming", "pip", "pip.ini")
+	case "darwin":
+		return filepath.Join(home, "Library", "Application Support", "pip", "pip.conf")
+	default:
+		return filepath.Join(home, ".config", "pip", "pip.conf")
+	}
+}
+
+// configureCommand implements "alpaca configure", which updates the configuration files of
+// common tools so that they use alpaca.
+func configureCommand(args []string) int {
+	fs := flag.NewFlagSet("alpaca configure", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "show the changes that would be made, without "+
+		"making them")
+	settings := proxySettingsFlags(fs)
+	fs.Usage = func() {
+		var user, system []string
+		for _, c := range clientConfigs {
+			if c.system {
+				system = append(system, c.name)
+			} else {
+				user = append(user, c.name)
+			}
+		}
+		fmt.Fprintf(fs.Output(), "Usage: alpaca configure [flags] [client...]\n\n"+
+			"Configures clients to use alpaca. The clients are %s (which are configured by "+
+			"default)\nand %s (which change system-wide files, so must be named "+
+			"explicitly).\n\n", strings.Join(user, ", "), strings.Join(system, ", "))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args) //nolint:errcheck
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "alpaca configure: %v\n", err)
+		return 1
+	}
+	if err := runConfigure(os.Stdout, home, settings(), fs.Args(), *dryRun); err != nil {
+		fmt.Fprintf(os.Stderr, "alpaca configure: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runConfigure configures the named clients (or all of the non-system clients, if none are
+// named), writing a summary (or the diffs, for a dry run) to w.
+func runConfigure(w io.Writer, home string, s proxySettings, names []string,
+	dryRun bool) error {
+	var clients []clientConfig
+	for _, name := range names {
+		found := false
+		for _, c := range clientConfigs {
+			if c.name == name {
+				clients = append(clients, c)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown client %q", name)
+		}
+	}
+	if len(names) == 0 {
+		for _, c := range clientConfigs {
+			if !c.system {
+				clients = append(clients, c)
+			}
+		}
+	}
+	var failed []string
+	for _, c := range clients {
+		if err := configureClient(w, c, home, s, dryRun); err != nil {
+			fmt.Fprintf(w, "%s: %v\n", c.name, err)
+			failed = append(failed, c.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("couldn't configure %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func configureClient(w io.Writer, c clientConfig, home string, s proxySettings,
+	dryRun bool) error {
+	path := c.path(home)
+	mode := os.FileMode(0644)
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	updated, err := c.update(old, s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if bytes.Equal(old, updated) {
+		fmt.Fprintf(w, "%s: %s is already configured\n", c.name, path)
+		return nil
+	}
+	if dryRun {
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(old)),
+			B:        difflib.SplitLines(string(updated)),
+			FromFile: path,
+			ToFile:   path,
+			Context:  3,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(w, diff)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, updated, mode); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: updated %s\n", c.name, path)
+	if c.note != "" {
+		fmt.Fprintf(w, "%s: %s\n", c.name, c.note)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file by renaming a temporary file over it, so that the file is never
+// left partly written. If the file is a symlink (e.g. to a dotfiles repository), the file that it
+// points to is replaced instead.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // which fails harmlessly once the file has been renamed
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func updateGit(old []byte, s proxySettings) ([]byte, error) {
+	b := setINI(old, "http", [][2]string{{"proxy", s.url}}, "\t")
+	return setINI(b, "https", [][2]string{{"proxy", s.url}}, "\t"), nil
+}
+
+func updateNPM(old []byte, s proxySettings) ([]byte, error) {
+	return setINI(old, "", [][2]string{
+		{"proxy", s.url},
+		{"https-proxy", s.url},
+		{"noproxy", strings.Join(s.noProxy, ",")},
+	}, ""), nil
+}
+
+func updatePip(old []byte, s proxySettings) ([]byte, error) {
+	return setINI(old, "global", [][2]string{{"proxy", s.url}}, ""), nil
+}
+
+func updateApt(old []byte, s proxySettings) ([]byte, error) {
+	return []byte(fmt.Sprintf("// Written by alpaca configure\n"+
+		"Acquire::http::Proxy %q;\nAcquire::https::Proxy %q;\n", s.url, s.url)), nil
+}
+
+func updateDockerDaemon(old []byte, s proxySettings) ([]byte, error) {
+	return []byte(fmt.Sprintf("# Written by alpaca configure\n[Service]\n"+
+		"Environment=\"HTTP_PROXY=%s\"\nEnvironment=\"HTTPS_PROXY=%s\"\n"+
+		"Environment=\"NO_PROXY=%s\"\n", s.url, s.url, strings.Join(s.noProxy, ","))), nil
+}
+
+func updateDockerClient(old []byte, s proxySettings) ([]byte, error) {
+	config := map[string]interface{}{}
+	if len(bytes.TrimSpace(old)) > 0 {
+		if err := json.Unmarshal(old, &config); err != nil {
+			return nil, err
+		}
+	}
+	proxies, _ := config["proxies"].(map[string]interface{})
+	if proxies == nil {
+		proxies = map[string]interface{}{}
+		config["proxies"] = proxies
+	}
+	proxies["default"] = map[string]interface{}{
+		"httpProxy":  s.url,
+		"httpsProxy": s.url,
+		"noProxy":    strings.Join(s.noProxy, ","),
+	}
+	b, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(bytes.TrimSpace(old), b) {
+		// Keep the file as it is, if only the trailing whitespace would change.
+		return old, nil
+	}
+	return append(b, '\n'), nil
+}
+
+// alpaca's <proxy> elements in a Maven settings.xml file, along with the whitespace before them.
+var mavenProxyRE = regexp.MustCompile(`(?s)\s*<proxy>\s*<id>alpaca-https?</id>.*?</proxy>`)
+
+func updateMaven(old []byte, s proxySettings) ([]byte, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return nil, err
+	}
+	// Maven doesn't support CIDR blocks in nonProxyHosts.
+	var nonProxyHosts []string
+	for _, host := range s.noProxy {
+		if !strings.Contains(host, "/") {
+			nonProxyHosts = append(nonProxyHosts, host)
+		}
+	}
+	var proxies string
+	for _, protocol := range []string{"http", "https"} {
+		proxies += fmt.Sprintf("\n    <proxy>\n"+
+			"      <id>alpaca-%s</id>\n"+
+			"      <active>true</active>\n"+
+			"      <protocol>%s</protocol>\n"+
+			"      <host>%s</host>\n"+
+			"      <port>%s</port>\n"+
+			"      <nonProxyHosts>%s</nonProxyHosts>\n"+
+			"    </proxy>", protocol, protocol, u.Hostname(), u.Port(),
+			strings.Join(nonProxyHosts, "|"))
+	}
+	content := string(old)
+	if strings.TrimSpace(content) == "" {
+		return []byte("<settings xmlns=\"http://maven.apache.org/SETTINGS/1.0.0\">\n" +
+			"  <proxies>" + proxies + "\n  </proxies>\n</settings>\n"), nil
+	}
+	content = mavenProxyRE.ReplaceAllString(content, "")
+	if i := strings.Index(content, "<proxies>"); i >= 0 {
+		i += len("<proxies>")
+		return []byte(content[:i] + proxies + content[i:]), nil
+	} else if i := strings.LastIndex(content, "</settings>"); i >= 0 {
+		return []byte(content[:i] + "  <proxies>" + proxies + "\n  </proxies>\n" +
+			content[i:]), nil
+	}
+	return nil, errors.New("no <settings> element found")
+}
+
+// setINI sets keys in a section of an INI-style file (such as .gitconfig or pip.conf), adding
+// the section and keys if they aren't there already, and leaving everything else as it is. An
+// empty section means the keys before the first section header (as in .npmrc). Keys are added
+// with the given indent.
+func setINI(content []byte, section string, values [][2]string, indent string) []byte {
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.SplitAfter(string(content), "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			lines[len(lines)-1] += "\n"
+		}
+	}
+	// Find the lines that belong to the section.
+	start, end := -1, len(lines)
+	if section == "" {
+		start = 0
+	}
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "[") {
+			continue
+		} else if start >= 0 {
+			end = i
+			break
+		} else if strings.EqualFold(strings.TrimSpace(strings.Trim(trimmed, "[]")), section) {
+			start = i + 1
+		}
+	}
+	if start < 0 {
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "\n")
+		}
+		lines = append(lines, "["+section+"]\n")
+		start, end = len(lines), len(lines)
+	}
+	for _, kv := range values {
+		line := indent + kv[0] + " = " + kv[1] + "\n"
+		if section == "" {
+			line = kv[0] + "=" + kv[1] + "\n"
+		}
+		found := false
+		for i := start; i < end; i++ {
+			key := strings.TrimSpace(strings.SplitN(lines[i], "=", 2)[0])
+			if strings.EqualFold(key, kv[0]) && strings.Contains(lines[i], "=") {
+				lines[i] = line
+				found = true
+			}
+		}
+		if !found {
+			// Add the key after the last non-blank line in the section.
+			i := end
+			for i > start && strings.TrimSpace(lines[i-1]) == "" {
+				i--
+			}
+			lines = append(lines[:i], append([]string{line}, lines[i:]...)...)
+			end++
+		}
+	}
+	return []byte(strings.Join(lines, ""))
+}
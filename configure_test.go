@@ -0,0 +1,237 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSettings = proxySettings{
+	url:     "http://localhost:3128",
+	noProxy: []string{"localhost", "10.0.0.0/8"},
+}
+
+func TestSetINI(t *testing.T) {
+	values := [][2]string{{"proxy", "http://localhost:3128"}}
+	tests := []struct {
+		name     string
+		content  string
+		section  string
+		expected string
+	}{
+		{"Empty", "", "global", "[global]\nproxy = http://localhost:3128\n"},
+		{
+			"NewSection",
+			"[user]\n\tname = Alice",
+			"http",
+			"[user]\n\tname = Alice\n\n[http]\nproxy = http://localhost:3128\n",
+		},
+		{
+			"ExistingSection",
+			"[http]\n\tsslVerify = false\n\n[user]\n\tname = Alice\n",
+			"http",
+			"[http]\n\tsslVerify = false\nproxy = http://localhost:3128\n\n[user]\n" +
+				"\tname = Alice\n",
+		},
+		{
+			"ExistingKey",
+			"[Global]\nProxy=http://old:80\ntimeout = 60\n",
+			"global",
+			"[Global]\nproxy = http://localhost:3128\ntimeout = 60\n",
+		},
+		{
+			"TopLevel",
+			"registry=https://registry.example\n[section]\nproxy=x\n",
+			"",
+			"registry=https://registry.example\nproxy=http://localhost:3128\n" +
+				"[section]\nproxy=x\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := setINI([]byte(test.content), test.section, values, "")
+			assert.Equal(t, test.expected, string(actual))
+		})
+	}
+}
+
+func TestUpdateGit(t *testing.T) {
+	b, err := updateGit([]byte("[user]\n\tname = Alice\n"), testSettings)
+	require.NoError(t, err)
+	assert.Equal(t, "[user]\n\tname = Alice\n\n[http]\n\tproxy = http://localhost:3128\n\n"+
+		"[https]\n\tproxy = http://localhost:3128\n", string(b))
+	again, err := updateGit(b, testSettings)
+	require.NoError(t, err)
+	assert.Equal(t, string(b), string(again))
+}
+
+func TestUpdateNPM(t *testing.T) {
+	b, err := updateNPM([]byte("proxy=http://old:80\n"), testSettings)
+	require.NoError(t, err)
+	assert.Equal(t, "proxy=http://localhost:3128\nhttps-proxy=http://localhost:3128\n"+
+		"noproxy=localhost,10.0.0.0/8\n", string(b))
+}
+
+func TestUpdateDockerClient(t *testing.T) {
+	old := []byte(`{"auths": {"registry.example": {}}, "proxies": {"other": {}}}`)
+	b, err := updateDockerClient(old, testSettings)
+	require.NoError(t, err)
+	var config map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &config))
+	assert.Contains(t, config, "auths")
+	proxies := config["proxies"].(map[string]interface{})
+	assert.Contains(t, proxies, "other")
+	assert.Equal(t, map[string]interface{}{
+		"httpProxy":  "http://localhost:3128",
+		"httpsProxy": "http://localhost:3128",
+		"noProxy":    "localhost,10.0.0.0/8",
+	}, proxies["default"])
+	again, err := updateDockerClient(b, testSettings)
+	require.NoError(t, err)
+	assert.Equal(t, string(b), string(again))
+}
+
+func TestUpdateDockerClientInvalid(t *testing.T) {
+	_, err := updateDockerClient([]byte("{"), testSettings)
+	assert.Error(t, err)
+}
+
+func TestUpdateMaven(t *testing.T) {
+	b, err := updateMaven(nil, testSettings)
+	require.NoError(t, err)
+	content := string(b)
+	assert.Contains(t, content, "<id>alpaca-http</id>")
+	assert.Contains(t, content, "<id>alpaca-https</id>")
+	assert.Contains(t, content, "<host>localhost</host>")
+	assert.Contains(t, content, "<port>3128</port>")
+	assert.Contains(t, content, "<nonProxyHosts>localhost</nonProxyHosts>")
+	// Updating the file again should replace alpaca's proxies, rather than adding more.
+	other := proxySettings{url: "http://127.0.0.1:8080"}
+	b, err = updateMaven(b, other)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(b), "<id>alpaca-http</id>"))
+	assert.Contains(t, string(b), "<port>8080</port>")
+	assert.NotContains(t, string(b), "<port>3128</port>")
+	again, err := updateMaven(b, other)
+	require.NoError(t, err)
+	assert.Equal(t, string(b), string(again))
+}
+
+func TestUpdateMavenExistingSettings(t *testing.T) {
+	old := "<settings>\n  <localRepository>/tmp/m2</localRepository>\n</settings>\n"
+	b, err := updateMaven([]byte(old), testSettings)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b),
+		"<settings>\n  <localRepository>/tmp/m2</localRepository>\n  <proxies>\n"))
+	assert.True(t, strings.HasSuffix(string(b), "  </proxies>\n</settings>\n"))
+	_, err = updateMaven([]byte("<project/>"), testSettings)
+	assert.Error(t, err)
+}
+
+func TestRunConfigure(t *testing.T) {
+	home := t.TempDir()
+	gitconfig := filepath.Join(home, ".gitconfig")
+	require.NoError(t, os.WriteFile(gitconfig, []byte("[user]\n\tname = Alice\n"), 0600))
+	var out strings.Builder
+	require.NoError(t, runConfigure(&out, home, testSettings, []string{"git"}, true))
+	assert.Contains(t, out.String(), "+[http]\n")
+	assert.Contains(t, out.String(), "+\tproxy = http://localhost:3128\n")
+	b, err := os.ReadFile(gitconfig)
+	require.NoError(t, err)
+	assert.Equal(t, "[user]\n\tname = Alice\n", string(b), "dry run changed the file")
+
+	out.Reset()
+	require.NoError(t, runConfigure(&out, home, testSettings, []string{"git"}, false))
+	assert.Equal(t, "git: updated "+gitconfig+"\n", out.String())
+	b, err = os.ReadFile(gitconfig)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "[https]\n\tproxy = http://localhost:3128\n")
+	fi, err := os.Stat(gitconfig)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	out.Reset()
+	require.NoError(t, runConfigure(&out, home, testSettings, []string{"git"}, false))
+	assert.Equal(t, "git: "+gitconfig+" is already configured\n", out.String())
+}
+
+func TestRunConfigureDefaultClients(t *testing.T) {
+	home := t.TempDir()
+	root := t.TempDir()
+	oldRoot := systemRoot
+	systemRoot = root
+	defer func() { systemRoot = oldRoot }()
+	var out strings.Builder
+	require.NoError(t, runConfigure(&out, home, testSettings, nil, false))
+	for _, c := range clientConfigs {
+		_, err := os.Stat(c.path(home))
+		if c.system {
+			assert.True(t, os.IsNotExist(err), "%s was configured by default", c.name)
+		} else {
+			assert.NoError(t, err, "%s wasn't configured", c.name)
+		}
+	}
+	require.NoError(t, runConfigure(&out, home, testSettings, []string{"apt"}, false))
+	b, err := os.ReadFile(filepath.Join(root, "etc", "apt", "apt.conf.d", "95alpaca"))
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `Acquire::https::Proxy "http://localhost:3128";`)
+}
+
+func TestRunConfigureUnknownClient(t *testing.T) {
+	var out strings.Builder
+	err := runConfigure(&out, t.TempDir(), testSettings, []string{"git", "emacs"}, false)
+	assert.Error(t, err)
+	assert.Empty(t, out.String())
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0600))
+	require.NoError(t, writeFileAtomic(path, []byte("new"), 0600))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(b))
+	// The temporary file is gone.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+	if runtime.GOOS == "windows" {
+		return
+	}
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	// A symlink is kept, and the file that it points to is replaced.
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink(path, link))
+	require.NoError(t, writeFileAtomic(link, []byte("newer"), 0600))
+	fi, err = os.Lstat(link)
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeSymlink)
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "newer", string(b))
+}
@@ -1,4 +1,4 @@
-// Copyright 2019 The Alpaca Authors
+// Copyright 2019, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -28,10 +28,19 @@ const contextKeyID = contextKey("id")
 // context of the http.Request with the key "id" as it passes through the
 // request to the next handler.
 func AddContextID(next http.Handler) http.Handler {
-	var id uint64
+	return (&contextIDs{}).WrapHandler(next)
+}
+
+// contextIDs is like AddContextID, but can wrap several handlers, so that the
+// IDs are unique across all of them (e.g. for each of alpaca's listeners).
+type contextIDs struct {
+	id uint64
+}
+
+func (ci *contextIDs) WrapHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		ctx := context.WithValue(
-			req.Context(), contextKeyID, atomic.AddUint64(&id, 1),
+			req.Context(), contextKeyID, atomic.AddUint64(&ci.id, 1),
 		)
 		next.ServeHTTP(w, req.WithContext(ctx))
 	})
@@ -0,0 +1,497 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a proxy is blocked for by "alpaca ctl block", if no duration is given.
+const defaultManualBlock = time.Hour
+
+// defaultControlPath returns the path of the control socket, which is in a directory that only
+// the current user can use. If there's no such directory, one is created in the (shared)
+// temporary directory when alpaca starts.
+func defaultControlPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "alpaca.sock")
+	} else if runtime.GOOS == "windows" {
+		return filepath.Join(os.TempDir(), "alpaca.sock")
+	}
+	return filepath.Join(privateControlDir(), "alpaca.sock")
+}
+
+// privateControlDir returns the directory that the control socket is created in when there's no
+// runtime directory for the current user.
+func privateControlDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("alpaca-%d", os.Getuid()))
+}
+
+// A controlServer lets "alpaca ctl" inspect and adjust a running instance of alpaca, using HTTP
+// requests over a unix socket that only the user running alpaca can connect to.
+type controlServer struct {
+	started   time.Time
+	creds     *credentialStore // the default credentials (which listeners share)
+	listeners []controlledListener
+	mux       sync.Mutex
+}
+
+type controlledListener struct {
+	addr   string
+	tls    bool
+	finder *ProxyFinder
+}
+
+func newControlServer(creds *credentialStore) *controlServer {
+	return &controlServer{started: time.Now(), creds: creds}
+}
+
+// add registers a listener's ProxyFinder, so that it can be controlled. It is safe to call on a
+// nil controlServer (which does nothing).
+func (cs *controlServer) add(addr string, tls bool, pf *ProxyFinder) {
+	if cs == nil {
+		return
+	}
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.listeners = append(cs.listeners, controlledListener{addr, tls, pf})
+}
+
+func (cs *controlServer) controlled() []controlledListener {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	return append([]controlledListener(nil), cs.listeners...)
+}
+
+// listenControl listens on the control socket, and makes sure that only the current user can
+// connect to it.
+func listenControl(path string) (net.Listener, error) {
+	if dir := filepath.Dir(path); dir == privateControlDir() {
+		if err := makePrivateDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	return listenPrivateUnix(path)
+}
+
+func (cs *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", cs.handleStatus)
+	mux.HandleFunc("/reload", cs.handleReload)
+	mux.HandleFunc("/blocklist", cs.handleBlocklist)
+	mux.HandleFunc("/credentials", cs.handleCredentials)
+	mux.HandleFunc("/loglevel", cs.handleLogLevel)
+	return mux
+}
+
+// controlStatus is the response to a status request.
+type controlStatus struct {
+	Version     string           `json:"version"`
+	PID         int              `json:"pid"`
+	Started     time.Time        `json:"started"`
+	LogLevel    string           `json:"loglevel"`
+	Credentials string           `json:"credentials,omitempty"` // as DOMAIN\username
+	Listeners   []listenerStatus `json:"listeners"`
+}
+
+type listenerStatus struct {
+	Addr string `json:"addr"`
+	TLS  bool   `json:"tls,omitempty"`
+	finderStatus
+}
+
+func (cs *controlServer) status() controlStatus {
+	s := controlStatus{
+		Version:   BuildVersion,
+		PID:       os.Getpid(),
+		Started:   cs.started,
+		LogLevel:  currentLogLevel().String(),
+		Listeners: []listenerStatus{},
+	}
+	if a := cs.creds.get(); a != nil {
+		s.Credentials = a.domain + `\` + a.username
+	}
+	for _, l := range cs.controlled() {
+		s.Listeners = append(s.Listeners, listenerStatus{l.addr, l.tls, l.finder.status()})
+	}
+	return s
+}
+
+func (cs *controlServer) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	cs.writeStatus(w)
+}
+
+func (cs *controlServer) writeStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cs.status()); err != nil {
+		warnf("Error writing status to control socket: %v", err)
+	}
+}
+
+// handleReload downloads the PAC file for each listener again, and responds with the status
+// once they have all finished.
+func (cs *controlServer) handleReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	infof("Reloading PAC files (requested by alpaca ctl)")
+	var wg sync.WaitGroup
+	for _, l := range cs.controlled() {
+		wg.Add(1)
+		go func(pf *ProxyFinder) {
+			defer wg.Done()
+			pf.reload()
+		}(l.finder)
+	}
+	wg.Wait()
+	cs.writeStatus(w)
+}
+
+// handleBlocklist blocks a proxy (for POST requests), or unblocks either one proxy or all of them
+// (for DELETE requests), for every listener. The proxy is given by the "proxy" query parameter,
+// and the "for" parameter says how long to block it for.
+func (cs *controlServer) handleBlocklist(w http.ResponseWriter, req *http.Request) {
+	proxy := req.URL.Query().Get("proxy")
+	switch req.Method {
+	case http.MethodPost:
+		if proxy == "" {
+			http.Error(w, "missing proxy", http.StatusBadRequest)
+			return
+		}
+		d := defaultManualBlock
+		if value := req.URL.Query().Get("for"); value != "" {
+			var err error
+			if d, err = time.ParseDuration(value); err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		logWith("proxy", proxy, "duration", d).
+			Infof("Blocking proxy %q for %v (requested by alpaca ctl)", proxy, d)
+		for _, l := range cs.controlled() {
+			l.finder.blocked.block(proxy, "blocked by alpaca ctl", d)
+		}
+	case http.MethodDelete:
+		if proxy != "" {
+			logWith("proxy", proxy).Infof("Unblocking proxy %q (requested by alpaca ctl)", proxy)
+		} else {
+			infof("Clearing blocklist (requested by alpaca ctl)")
+		}
+		for _, l := range cs.controlled() {
+			if proxy != "" {
+				l.finder.blocked.remove(proxy)
+			} else {
+				l.finder.blocked.clear()
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCredentials replaces the default credentials with those in the request body (in the
+// format of $NTLM_CREDENTIALS). Listeners with their own credentials aren't affected.
+func (cs *controlServer) handleCredentials(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, 4096))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a, err := parseCredentials(strings.TrimSpace(string(body)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	infof("Using credentials for %s\\%s (set by alpaca ctl)", a.domain, a.username)
+	cs.creds.set(a)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLogLevel returns the current log level (for GET requests), or sets it to the level in
+// the request body (for PUT requests).
+func (cs *controlServer) handleLogLevel(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, currentLogLevel())
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(req.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level, err := parseLogLevel(strings.TrimSpace(string(body)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		infof("Log level changed to %s (by alpaca ctl)", level)
+		setLogLevel(level)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ctlCommand implements "alpaca ctl", which sends commands to a running instance of alpaca over
+// its control socket.
+func ctlCommand(args []string) int {
+	fs := flag.NewFlagSet("alpaca ctl", flag.ExitOnError)
+	path := fs.String("control", defaultControlPath(), "path of the control socket of the "+
+		"running alpaca")
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: alpaca ctl [flags] command [args]\n\n"+
+			"Commands:\n"+
+			"  status                      show the PAC URLs, profiles and blocked proxies\n"+
+			"  reload                      download the PAC files again\n"+
+			"  flush-blocklist             unblock all proxies\n"+
+			"  block PROXY [DURATION]      block a proxy (for an hour, by default)\n"+
+			"  unblock PROXY               unblock a proxy\n"+
+			"  set-credentials [-d DOMAIN] [-u USER] [CREDENTIALS]\n"+
+			"                              change the credentials (in the format printed by\n"+
+			"                              alpaca -H, or from $NTLM_CREDENTIALS, or prompted\n"+
+			"                              for if -d is given)\n"+
+			"  loglevel [LEVEL]            show or set the log level (debug, info, warn or "+
+			"error)\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args) //nolint:errcheck
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := runCtl(os.Stdout, newControlClient(*path), fs.Args(), *asJSON); err != nil {
+		fmt.Fprintf(os.Stderr, "alpaca ctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// newControlClient returns an HTTP client that connects to the control socket, whatever the
+// host in the request URL.
+func newControlClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: nil,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				if err := checkSocketOwner(path); err != nil {
+					return nil, err
+				}
+				var d net.Dialer
+				conn, err := d.DialContext(ctx, "unix", path)
+				if err != nil {
+					return nil, fmt.Errorf("can't connect to alpaca (is it running?): %w", err)
+				}
+				return conn, nil
+			},
+		},
+		Timeout: time.Minute,
+	}
+}
+
+func runCtl(w io.Writer, client *http.Client, args []string, asJSON bool) error {
+	usage := func(format string) error {
+		return fmt.Errorf("usage: alpaca ctl %s", format)
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "status", "reload":
+		if len(args) != 0 {
+			return usage(cmd)
+		}
+		method := http.MethodGet
+		if cmd == "reload" {
+			method = http.MethodPost
+		}
+		body, err := ctlRequest(client, method, "/"+cmd, "")
+		if err != nil {
+			return err
+		} else if asJSON {
+			_, err := w.Write(body)
+			return err
+		}
+		var s controlStatus
+		if err := json.Unmarshal(body, &s); err != nil {
+			return err
+		}
+		printStatus(w, s)
+		return nil
+	case "flush-blocklist":
+		if len(args) != 0 {
+			return usage(cmd)
+		}
+		_, err := ctlRequest(client, http.MethodDelete, "/blocklist", "")
+		return err
+	case "block":
+		if len(args) < 1 || len(args) > 2 {
+			return usage("block PROXY [DURATION]")
+		}
+		query := url.Values{"proxy": {args[0]}}
+		if len(args) == 2 {
+			query.Set("for", args[1])
+		}
+		_, err := ctlRequest(client, http.MethodPost, "/blocklist?"+query.Encode(), "")
+		return err
+	case "unblock":
+		if len(args) != 1 {
+			return usage("unblock PROXY")
+		}
+		query := url.Values{"proxy": {args[0]}}
+		_, err := ctlRequest(client, http.MethodDelete, "/blocklist?"+query.Encode(), "")
+		return err
+	case "set-credentials":
+		value, err := ctlCredentials(args)
+		if err != nil {
+			return err
+		}
+		_, err = ctlRequest(client, http.MethodPut, "/credentials", value)
+		return err
+	case "loglevel":
+		if len(args) > 1 {
+			return usage("loglevel [LEVEL]")
+		} else if len(args) == 1 {
+			_, err := ctlRequest(client, http.MethodPut, "/loglevel", args[0])
+			return err
+		}
+		body, err := ctlRequest(client, http.MethodGet, "/loglevel", "")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(body)
+		return err
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// ctlCredentials returns the credentials for "alpaca ctl set-credentials", which are either given
+// as an argument, or found in the same way as when alpaca starts.
+func ctlCredentials(args []string) (string, error) {
+	fs := flag.NewFlagSet("alpaca ctl set-credentials", flag.ContinueOnError)
+	domain := fs.String("d", "", "domain of the proxy account (prompts for the password)")
+	username := fs.String("u", whoAmI(), "username of the proxy account")
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	} else if fs.NArg() > 1 {
+		return "", errors.New("usage: alpaca ctl set-credentials [-d DOMAIN] [-u USER] " +
+			"[CREDENTIALS]")
+	} else if fs.NArg() == 1 {
+		return fs.Arg(0), nil
+	}
+	src, _ := findCredentialSource(*domain, *username)
+	if src == nil {
+		return "", errors.New("no credentials given (use -d, or set $NTLM_CREDENTIALS)")
+	}
+	a, err := src.getCredentials()
+	if err != nil {
+		return "", err
+	}
+	return a.String(), nil
+}
+
+// ctlRequest sends a request to the control socket, and returns the response body. Responses
+// other than 200 OK and 204 No Content are returned as errors.
+func ctlRequest(client *http.Client, method, path, body string) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://alpaca"+path, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		if msg := strings.TrimSpace(string(b)); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return b, nil
+}
+
+func printStatus(w io.Writer, s controlStatus) {
+	version := s.Version
+	if version == "" {
+		version = "(unknown version)"
+	}
+	fmt.Fprintf(w, "Alpaca %s, pid %d, up %v\n", version, s.PID,
+		time.Since(s.Started).Round(time.Second))
+	fmt.Fprintf(w, "Log level: %s\n", s.LogLevel)
+	if s.Credentials != "" {
+		fmt.Fprintf(w, "Credentials: %s\n", s.Credentials)
+	} else {
+		fmt.Fprintf(w, "Credentials: none\n")
+	}
+	for _, l := range s.Listeners {
+		var route string
+		switch {
+		case l.Mode == "proxy":
+			route = "fixed proxies (-P)"
+		case l.Mode == "direct":
+			route = "direct"
+		case l.PACURL == "":
+			route = "direct (no PAC file)"
+		case !l.Connected:
+			route = "direct (not connected to the network for " + l.PACURL + ")"
+		default:
+			route = "PAC file from " + l.PACURL
+		}
+		if l.Profile != "" {
+			route += fmt.Sprintf(", network profile %q", l.Profile)
+		}
+		fmt.Fprintf(w, "Listener %s: %s\n", l.Addr, route)
+		for _, b := range l.Blocked {
+			kind := b.Kind
+			if b.Failures > 0 {
+				kind += fmt.Sprintf(", %d failures", b.Failures)
+			}
+			fmt.Fprintf(w, "  blocked %s until %s (%s)", b.Proxy,
+				b.Expiry.Local().Format("15:04:05"), kind)
+			if b.Reason != "" {
+				fmt.Fprintf(w, ": %s", b.Reason)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
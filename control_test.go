@@ -0,0 +1,169 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestControl starts a control server for a listener that uses the given PAC URL, and returns
+// a client for its socket.
+func newTestControl(t *testing.T, pacurl string) (*controlServer, *ProxyFinder, *http.Client) {
+	creds := newCredentialStore(&authenticator{"CORP", "alice", "0123"})
+	cs := newControlServer(creds)
+	pf := NewProxyFinder(ProxyFinderConfig{PACURLs: []string{pacurl}}, NewPACWrapper(PACData{}))
+	cs.add("localhost:3128", false, pf)
+	cs.add("localhost:3129", false,
+		NewProxyFinder(ProxyFinderConfig{NoPAC: true}, NewPACWrapper(PACData{})))
+	path := filepath.Join(t.TempDir(), "alpaca.sock")
+	l, err := listenControl(path)
+	require.NoError(t, err)
+	s := &http.Server{Handler: cs.handler()}
+	go s.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { s.Close() })
+	return cs, pf, newControlClient(path)
+}
+
+func runTestCtl(t *testing.T, client *http.Client, args ...string) string {
+	var b strings.Builder
+	require.NoError(t, runCtl(&b, client, args, false))
+	return b.String()
+}
+
+func TestControlSocketPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions don't apply to sockets on Windows")
+	}
+	path := filepath.Join(t.TempDir(), "alpaca.sock")
+	l, err := listenControl(path)
+	require.NoError(t, err)
+	defer l.Close()
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestCtlStatus(t *testing.T) {
+	pac := httptest.NewServer(pacjsHandler("function FindProxyForURL(url, host) { return \"DIRECT\" }"))
+	defer pac.Close()
+	_, _, client := newTestControl(t, pac.URL)
+	out := runTestCtl(t, client, "status")
+	assert.Contains(t, out, "Log level: info\n")
+	assert.Contains(t, out, "Credentials: CORP\\alice\n")
+	assert.Contains(t, out, "Listener localhost:3128: PAC file from "+pac.URL+"\n")
+	assert.Contains(t, out, "Listener localhost:3129: direct\n")
+
+	var b strings.Builder
+	require.NoError(t, runCtl(&b, client, []string{"status"}, true))
+	var s controlStatus
+	require.NoError(t, json.Unmarshal([]byte(b.String()), &s))
+	assert.Equal(t, os.Getpid(), s.PID)
+	require.Len(t, s.Listeners, 2)
+	assert.Equal(t, listenerStatus{"localhost:3128", false, finderStatus{
+		Mode: "pac", PACURL: pac.URL, Connected: true, Blocked: []blockInfo{},
+	}}, s.Listeners[0])
+}
+
+func TestCtlReload(t *testing.T) {
+	var downloads int32
+	pac := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		pacjsHandler("function FindProxyForURL(url, host) { return \"DIRECT\" }")(w, req)
+	}))
+	defer pac.Close()
+	_, _, client := newTestControl(t, pac.URL)
+	require.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+	out := runTestCtl(t, client, "reload")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&downloads))
+	assert.Contains(t, out, "Listener localhost:3128: PAC file from "+pac.URL+"\n")
+}
+
+func TestCtlBlocklist(t *testing.T) {
+	_, pf, client := newTestControl(t, "http://pac.invalid/")
+	runTestCtl(t, client, "block", "proxy1:8080", "30m")
+	runTestCtl(t, client, "block", "proxy2:8080")
+	info := pf.blocked.list()
+	require.Len(t, info, 2)
+	assert.Equal(t, "manual", info[0].Kind)
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), info[0].Expiry, time.Minute)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), info[1].Expiry, time.Minute)
+	out := runTestCtl(t, client, "status")
+	assert.Contains(t, out, "  blocked proxy1:8080 until ")
+	assert.Contains(t, out, " (manual): blocked by alpaca ctl\n")
+	// Manual blocks survive reloads and successful requests.
+	runTestCtl(t, client, "reload")
+	pf.reportProxy("proxy1:8080", nil)
+	assert.True(t, pf.blocked.contains("proxy1:8080"))
+	assert.Len(t, pf.blocked.list(), 2)
+
+	runTestCtl(t, client, "unblock", "proxy1:8080")
+	assert.False(t, pf.blocked.contains("proxy1:8080"))
+	assert.True(t, pf.blocked.contains("proxy2:8080"))
+	runTestCtl(t, client, "flush-blocklist")
+	assert.Empty(t, pf.blocked.list())
+
+	var b strings.Builder
+	err := runCtl(&b, client, []string{"block", "proxy1:8080", "soon"}, false)
+	assert.EqualError(t, err, `invalid duration "soon"`)
+	err = runCtl(&b, client, []string{"unblock"}, false)
+	assert.EqualError(t, err, "usage: alpaca ctl unblock PROXY")
+}
+
+func TestCtlSetCredentials(t *testing.T) {
+	cs, _, client := newTestControl(t, "http://pac.invalid/")
+	runTestCtl(t, client, "set-credentials", "bob@PARTNER:4567")
+	assert.Equal(t, &authenticator{"PARTNER", "bob", "4567"}, cs.creds.get())
+	t.Setenv("NTLM_CREDENTIALS", "carol@CORP:89ab")
+	runTestCtl(t, client, "set-credentials")
+	assert.Equal(t, &authenticator{"CORP", "carol", "89ab"}, cs.creds.get())
+	var b strings.Builder
+	err := runCtl(&b, client, []string{"set-credentials", "bob"}, false)
+	assert.EqualError(t, err, "invalid credentials string, please run `alpaca -H`")
+	assert.Equal(t, &authenticator{"CORP", "carol", "89ab"}, cs.creds.get())
+}
+
+func TestCtlLogLevel(t *testing.T) {
+	defer setLogLevel(currentLogLevel())
+	_, _, client := newTestControl(t, "http://pac.invalid/")
+	assert.Equal(t, "info\n", runTestCtl(t, client, "loglevel"))
+	runTestCtl(t, client, "loglevel", "debug")
+	assert.Equal(t, levelDebug, currentLogLevel())
+	assert.Equal(t, "debug\n", runTestCtl(t, client, "loglevel"))
+	var b strings.Builder
+	assert.Error(t, runCtl(&b, client, []string{"loglevel", "verbose"}, false))
+	assert.Equal(t, levelDebug, currentLogLevel())
+}
+
+func TestCtlNotRunning(t *testing.T) {
+	client := newControlClient(filepath.Join(t.TempDir(), "alpaca.sock"))
+	var b strings.Builder
+	err := runCtl(&b, client, []string{"status"}, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't connect to alpaca (is it running?)")
+	assert.EqualError(t, runCtl(&b, client, []string{"restart"}, false),
+		`unknown command "restart"`)
+}
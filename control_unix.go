@@ -0,0 +1,68 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenPrivateUnix listens on a unix socket that only the current user can connect to. The
+// socket is created with a restrictive umask, so that there's no window in which other users can
+// connect to it. (The umask is process-wide, but this only makes files that are created at the
+// same time more restrictive.)
+func listenPrivateUnix(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return listenUnix(path)
+}
+
+// makePrivateDir creates a directory that only the current user can use, or checks that an
+// existing one is such a directory (rather than, say, a symlink created by another user).
+func makePrivateDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	} else if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by another user", dir)
+	} else if fi.Mode().Perm() != 0700 {
+		return fmt.Errorf("%s can be used by other users (mode %v)", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// checkSocketOwner checks that a unix socket was created by the current user, so that secrets
+// (such as credentials) aren't sent to a socket that another user is listening on. It doesn't
+// report an error if the socket doesn't exist, since connecting to it will fail anyway.
+func checkSocketOwner(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by another user (uid %d)", path, st.Uid)
+	}
+	return nil
+}
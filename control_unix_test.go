@@ -0,0 +1,84 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakePrivateDir(t *testing.T) {
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "private")
+	require.NoError(t, makePrivateDir(dir))
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	// An existing private directory is fine...
+	assert.NoError(t, makePrivateDir(dir))
+	// ...but not one that other users can write to, or a symlink (even to a private directory).
+	shared := filepath.Join(tmp, "shared")
+	require.NoError(t, os.Mkdir(shared, 0700))
+	require.NoError(t, os.Chmod(shared, 0777))
+	assert.Error(t, makePrivateDir(shared))
+	link := filepath.Join(tmp, "link")
+	require.NoError(t, os.Symlink(dir, link))
+	assert.Error(t, makePrivateDir(link))
+}
+
+func TestListenControlUmask(t *testing.T) {
+	// The umask is restored after the socket is created.
+	old := syscall.Umask(0022)
+	defer syscall.Umask(old)
+	l, err := listenControl(filepath.Join(t.TempDir(), "alpaca.sock"))
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, 0022, syscall.Umask(0022))
+}
+
+func TestCheckSocketOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alpaca.sock")
+	l, err := listenControl(path)
+	require.NoError(t, err)
+	defer l.Close()
+	assert.NoError(t, checkSocketOwner(path))
+	assert.NoError(t, checkSocketOwner(filepath.Join(t.TempDir(), "missing.sock")))
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of the socket requires root")
+	}
+	require.NoError(t, os.Lchown(path, 65534, -1))
+	assert.Error(t, checkSocketOwner(path))
+}
+
+func TestDefaultControlPathWithoutRuntimeDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("TMPDIR", t.TempDir())
+	path := defaultControlPath()
+	assert.Equal(t, privateControlDir(), filepath.Dir(path))
+	l, err := listenControl(path)
+	require.NoError(t, err)
+	defer l.Close()
+	fi, err := os.Stat(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+}
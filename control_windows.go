@@ -0,0 +1,35 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// On Windows, the control socket is in the user's own temporary directory, and file permissions
+// don't apply to sockets, so these don't need to do anything beyond the basics.
+
+func listenPrivateUnix(path string) (net.Listener, error) {
+	return listenUnix(path)
+}
+
+func makePrivateDir(dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
+
+func checkSocketOwner(path string) error {
+	return nil
+}
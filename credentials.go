@@ -1,4 +1,4 @@
-// Copyright 2021 The Alpaca Authors
+// Copyright 2021, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance from the License.
@@ -18,9 +18,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"strings"
+	"sync"
 
 	"golang.org/x/term"
 )
@@ -29,6 +29,21 @@ type credentialSource interface {
 	getCredentials() (*authenticator, error)
 }
 
+// findCredentialSource returns where the proxy credentials come from (along with a description
+// of it), or nil if there's nowhere to get them from. A domain given on the command line means
+// that the password is read from the terminal; otherwise $NTLM_CREDENTIALS or the keyring are
+// used.
+func findCredentialSource(domain, username string) (credentialSource, string) {
+	if domain != "" {
+		return fromTerminal().forUser(domain, username), "the terminal"
+	} else if value := os.Getenv("NTLM_CREDENTIALS"); value != "" {
+		return fromEnvVar(value), "$NTLM_CREDENTIALS"
+	} else if keyringSupported {
+		return fromKeyring(), "the keychain"
+	}
+	return nil, ""
+}
+
 type terminal struct {
 	readPassword     func() ([]byte, error)
 	stdout           io.Writer
@@ -69,14 +84,47 @@ func fromEnvVar(value string) *envVar {
 }
 
 func (e *envVar) getCredentials() (*authenticator, error) {
-	at := strings.IndexRune(e.value, '@')
-	colon := strings.IndexRune(e.value, ':')
+	a, err := parseCredentials(e.value)
+	if err != nil {
+		return nil, err
+	}
+	infof("Found credentials for %s\\%s in environment", a.domain, a.username)
+	return a, nil
+}
+
+// parseCredentials parses credentials in the format printed by `alpaca -H`, i.e.
+// "username@domain:hash".
+func parseCredentials(value string) (*authenticator, error) {
+	at := strings.IndexRune(value, '@')
+	colon := strings.IndexRune(value, ':')
 	if at == -1 || colon == -1 || at > colon {
 		return nil, errors.New("invalid credentials string, please run `alpaca -H`")
 	}
-	domain := e.value[at+1 : colon]
-	username := e.value[0:at]
-	hash := e.value[colon+1:]
-	log.Printf("Found credentials for %s\\%s in environment", domain, username)
+	domain := value[at+1 : colon]
+	username := value[0:at]
+	hash := value[colon+1:]
 	return &authenticator{domain, username, hash}, nil
 }
+
+// A credentialStore holds credentials that can be changed while alpaca is running (using
+// "alpaca ctl set-credentials").
+type credentialStore struct {
+	auth *authenticator
+	mux  sync.Mutex
+}
+
+func newCredentialStore(auth *authenticator) *credentialStore {
+	return &credentialStore{auth: auth}
+}
+
+func (cs *credentialStore) get() *authenticator {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	return cs.auth
+}
+
+func (cs *credentialStore) set(auth *authenticator) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.auth = auth
+}
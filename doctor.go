@@ -0,0 +1,429 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkWarn checkStatus = "WARN" // something that might be a problem, but isn't always one
+	checkFail checkStatus = "FAIL"
+	checkSkip checkStatus = "SKIP" // the check doesn't apply, or an earlier one failed
+)
+
+const credentialsHint = "run `alpaca -d DOMAIN -u USER -H` and put the output in your " +
+	"shell profile, or pass -d to enter your password"
+
+// A doctor runs the checks for "alpaca doctor", which follow a request through each of the steps
+// that alpaca takes to send it to the right proxy, and reports where it goes wrong.
+type doctor struct {
+	w                io.Writer
+	pacurls          []string // if empty, the system's PAC URL is used
+	domain, username string
+	testURL          *url.URL
+	timeout          time.Duration
+	findPACURL       func() (string, error)
+	lookupHost       func(ctx context.Context, host string) ([]string, error)
+	failures         int
+}
+
+// doctorCommand implements "alpaca doctor".
+func doctorCommand(args []string) int {
+	fs := flag.NewFlagSet("alpaca doctor", flag.ExitOnError)
+	var pacurls stringList
+	fs.Var(&pacurls, "C", "url of proxy auto-config (pac) file; may be repeated")
+	domain := fs.String("d", "", "domain of the proxy account (for NTLM auth)")
+	username := fs.String("u", whoAmI(), "username of the proxy account (for NTLM auth)")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for each check")
+	verbose := fs.Bool("v", false, "show alpaca's log while running the checks")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: alpaca doctor [flags] [test-url]\n\n"+
+			"Checks each of the steps that alpaca takes to send a request (to test-url, which\n"+
+			"is https://example.com/ by default) via the right proxy, and reports any that "+
+			"fail.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args) //nolint:errcheck
+	testURL := "https://example.com/"
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	} else if fs.NArg() == 1 {
+		testURL = fs.Arg(0)
+	}
+	u, err := url.Parse(testURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "alpaca doctor: invalid test URL %q\n", testURL)
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	d := &doctor{
+		w:          os.Stdout,
+		pacurls:    pacurls,
+		domain:     *domain,
+		username:   *username,
+		testURL:    u,
+		timeout:    *timeout,
+		findPACURL: findPACURL,
+		lookupHost: net.DefaultResolver.LookupHost,
+	}
+	if d.run() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// run makes all of the checks, and returns the number that failed.
+func (d *doctor) run() int {
+	pacurls := d.discoverPAC()
+	pacurl, pacjs := d.downloadPAC(pacurls)
+	proxies := d.evaluatePAC(pacjs)
+	auth := d.checkCredentials()
+	d.checkDNS(pacurls, proxies)
+	for _, proxy := range proxies {
+		if proxy != nil {
+			d.checkProxy(proxy, auth)
+		}
+	}
+	d.fetchTestURL(pacurl, auth)
+	if d.failures == 0 {
+		fmt.Fprintln(d.w, "\nAll checks passed.")
+	} else if d.failures == 1 {
+		fmt.Fprintln(d.w, "\n1 check failed.")
+	} else {
+		fmt.Fprintf(d.w, "\n%d checks failed.\n", d.failures)
+	}
+	return d.failures
+}
+
+func (d *doctor) report(status checkStatus, check, detail, hint string) {
+	fmt.Fprintf(d.w, "%s  %s: %s\n", status, check, detail)
+	if hint != "" && status != checkPass {
+		fmt.Fprintf(d.w, "      hint: %s\n", hint)
+	}
+	if status == checkFail {
+		d.failures++
+	}
+}
+
+// discoverPAC returns the PAC URLs given with -C, or the system's PAC URL if there aren't any.
+func (d *doctor) discoverPAC() []string {
+	const check = "PAC discovery"
+	if len(d.pacurls) > 0 {
+		d.report(checkPass, check, "using "+strings.Join(d.pacurls, ", ")+" (from -C)", "")
+		return d.pacurls
+	}
+	pacurl, err := d.findPACURL()
+	if err != nil {
+		d.report(checkFail, check, fmt.Sprintf("couldn't read the system's proxy settings: %v",
+			err), "use -C to give the PAC URL")
+		return nil
+	} else if pacurl == "" {
+		d.report(checkWarn, check, "no PAC URL is configured, so all requests will be made "+
+			"directly", "if you need to use a proxy, use -C to give the PAC URL (or -P to "+
+			"give the proxy)")
+		return nil
+	}
+	d.report(checkPass, check, "found "+pacurl+" in the system's proxy settings", "")
+	return []string{pacurl}
+}
+
+// downloadPAC returns the first PAC URL that can be downloaded, along with its contents.
+func (d *doctor) downloadPAC(pacurls []string) (string, []byte) {
+	const check = "PAC download"
+	if len(pacurls) == 0 {
+		d.report(checkSkip, check, "no PAC URL", "")
+		return "", nil
+	}
+	pf := newPACFetcher()
+	pf.client.Timeout = d.timeout
+	var errs []string
+	for _, pacurl := range pacurls {
+		pacjs, err := pf.fetch(pacurl)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", pacurl, err))
+			continue
+		}
+		for _, msg := range errs {
+			d.report(checkWarn, check, msg, "")
+		}
+		d.report(checkPass, check, fmt.Sprintf("downloaded %d bytes from %s", len(pacjs),
+			pacurl), "")
+		return pacurl, pacjs
+	}
+	d.report(checkFail, check, strings.Join(errs, "; "), "the PAC file is downloaded "+
+		"directly (not via a proxy), so you need to be on the network that it's for (e.g. "+
+		"the office or a VPN); when you're not, alpaca makes requests directly")
+	return "", nil
+}
+
+// evaluatePAC returns the proxies that the PAC script chooses for the test URL, where a nil URL
+// means "DIRECT". If there's no PAC script, all requests are made directly.
+func (d *doctor) evaluatePAC(pacjs []byte) []*url.URL {
+	const check = "PAC evaluation"
+	if pacjs == nil {
+		d.report(checkSkip, check, "no PAC file", "")
+		return direct
+	}
+	runner := new(PACRunner)
+	if err := runner.Update(pacjs); err != nil {
+		d.report(checkFail, check, fmt.Sprintf("the PAC file is invalid: %v", err),
+			"check the PAC file's JavaScript")
+		return nil
+	}
+	result, err := runner.FindProxyForURL(*d.testURL)
+	if err != nil {
+		d.report(checkFail, check, fmt.Sprintf("FindProxyForURL(%q) failed: %v", d.testURL,
+			err), "run alpaca with -pac-trace '*' to see how the PAC file is evaluated")
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodGet, d.testURL.String(), nil)
+	if err != nil {
+		d.report(checkFail, check, err.Error(), "")
+		return nil
+	}
+	pf := &ProxyFinder{blocked: newBlocklist()}
+	proxies, err := pf.parseProxyList(req, result)
+	if err != nil {
+		d.report(checkFail, check, fmt.Sprintf("FindProxyForURL(%q) returned %q: %v",
+			d.testURL, result, err), "the PAC file should return a list of proxies, such as "+
+			"\"PROXY proxy.example:8080; DIRECT\"")
+		return nil
+	}
+	d.report(checkPass, check, fmt.Sprintf("FindProxyForURL(%q) returned %q", d.testURL,
+		result), "")
+	return proxies
+}
+
+// checkCredentials returns the credentials that alpaca would use (if any).
+func (d *doctor) checkCredentials() *authenticator {
+	const check = "Credentials"
+	src, name := findCredentialSource(d.domain, d.username)
+	if src == nil {
+		d.report(checkWarn, check, "no credentials found, so alpaca won't authenticate to "+
+			"proxies", "if your proxy needs a password, "+credentialsHint)
+		return nil
+	}
+	a, err := src.getCredentials()
+	if err != nil {
+		d.report(checkFail, check, fmt.Sprintf("couldn't read credentials from %s: %v", name,
+			err), credentialsHint)
+		return nil
+	}
+	d.report(checkPass, check, fmt.Sprintf("using credentials for %s\\%s from %s", a.domain,
+		a.username, name), "")
+	return a
+}
+
+// checkDNS resolves the hostnames that alpaca needs to connect to: the PAC server, the proxies,
+// and (if the test URL is fetched directly) the test URL's host.
+func (d *doctor) checkDNS(pacurls []string, proxies []*url.URL) {
+	const check = "DNS"
+	var hosts []string
+	add := func(host string) {
+		if host == "" || net.ParseIP(host) != nil {
+			return
+		}
+		for _, h := range hosts {
+			if h == host {
+				return
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	for _, pacurl := range pacurls {
+		if u, err := url.Parse(pacurl); err == nil {
+			add(u.Hostname())
+		}
+	}
+	for _, proxy := range proxies {
+		if proxy == nil {
+			add(d.testURL.Hostname())
+		} else {
+			add(proxy.Hostname())
+		}
+	}
+	if len(hosts) == 0 {
+		d.report(checkSkip, check, "no hostnames to resolve", "")
+		return
+	}
+	for _, host := range hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		addrs, err := d.lookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			d.report(checkFail, check, fmt.Sprintf("couldn't resolve %s: %v", host, err),
+				"check your DNS settings; internal hostnames may only resolve on the "+
+					"office network or a VPN")
+			continue
+		}
+		d.report(checkPass, check, fmt.Sprintf("%s resolves to %s", host,
+			strings.Join(addrs, ", ")), "")
+	}
+}
+
+// checkProxy connects to a proxy and, for HTTP(S) proxies, makes sure that it accepts the
+// credentials (if it asks for them) by opening a tunnel to the test URL's host.
+func (d *doctor) checkProxy(proxy *url.URL, auth *authenticator) {
+	reach := "Proxy " + proxy.Host
+	if proxy.Scheme == "socks5" {
+		conn, err := net.DialTimeout("tcp", proxy.Host, d.timeout)
+		if err != nil {
+			d.report(checkFail, reach, err.Error(), "the proxy may be down, or only reachable "+
+				"from the office network or a VPN")
+			return
+		}
+		conn.Close()
+		d.report(checkPass, reach, "connected (SOCKS5)", "")
+		d.report(checkSkip, "NTLM handshake with "+proxy.Host, "SOCKS proxies don't use NTLM",
+			"")
+		return
+	}
+	var tr transport
+	defer tr.Close()
+	dial := func() error {
+		if err := tr.dial(context.Background(), proxy); err != nil {
+			return err
+		}
+		return tr.conn.SetDeadline(time.Now().Add(d.timeout))
+	}
+	if err := dial(); err != nil {
+		d.report(checkFail, reach, err.Error(), "the proxy may be down, or only reachable "+
+			"from the office network or a VPN")
+		return
+	}
+	d.report(checkPass, reach, "connected", "")
+	check := "NTLM handshake with " + proxy.Host
+	// Proxies usually only allow tunnels to port 443.
+	target := net.JoinHostPort(d.testURL.Hostname(), "443")
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		d.report(checkFail, check, fmt.Sprintf("CONNECT %s: %v", target, err), "")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		d.report(checkPass, check, "the proxy didn't ask for credentials", "")
+		return
+	} else if resp.StatusCode != http.StatusProxyAuthRequired {
+		d.report(checkFail, check, fmt.Sprintf("CONNECT %s: unexpected response status: %s",
+			target, resp.Status), "")
+		return
+	}
+	schemes := resp.Header.Values("Proxy-Authenticate")
+	if !offersNTLM(schemes) {
+		d.report(checkFail, check, fmt.Sprintf("the proxy asked for credentials, but doesn't "+
+			"support NTLM (it offered %q)", strings.Join(schemes, ", ")), "")
+		return
+	} else if auth == nil {
+		d.report(checkFail, check, "the proxy asked for credentials, but none were found",
+			credentialsHint)
+		return
+	}
+	// Like connectViaProxy, redial, since the proxy may have closed the connection.
+	if err := dial(); err != nil {
+		d.report(checkFail, check, err.Error(), "")
+		return
+	}
+	resp, err = auth.do(req, &tr)
+	if err != nil {
+		d.report(checkFail, check, err.Error(), "")
+		return
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		d.report(checkPass, check, fmt.Sprintf("authenticated as %s\\%s", auth.domain,
+			auth.username), "")
+	case http.StatusProxyAuthRequired:
+		d.report(checkFail, check, fmt.Sprintf("the proxy rejected the credentials for %s\\%s",
+			auth.domain, auth.username), "if your password has changed, "+credentialsHint)
+	default:
+		d.report(checkFail, check, fmt.Sprintf("CONNECT %s: unexpected response status: %s",
+			target, resp.Status), "")
+	}
+}
+
+func offersNTLM(schemes []string) bool {
+	for _, scheme := range schemes {
+		if strings.HasPrefix(strings.ToUpper(scheme), "NTLM") {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchTestURL starts an instance of alpaca (with the same PAC URL and credentials as the
+// checks above), and fetches the test URL through it.
+func (d *doctor) fetchTestURL(pacurl string, auth *authenticator) {
+	const check = "Fetch"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		d.report(checkFail, check, err.Error(), "")
+		return
+	}
+	lc := listenerConfig{host: "127.0.0.1", port: l.Addr().(*net.TCPAddr).Port, auth: auth}
+	if pacurl == "" {
+		lc.finder.NoPAC = true
+	} else {
+		lc.finder.PACURLs = []string{pacurl}
+	}
+	s := createServer(lc, serverOptions{})
+	go s.Serve(l) //nolint:errcheck
+	defer closeServer(s)
+	proxy := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxy)},
+		Timeout:   d.timeout,
+	}
+	resp, err := client.Get(d.testURL.String())
+	if err != nil {
+		d.report(checkFail, check, fmt.Sprintf("GET %s: %v", d.testURL, err),
+			"see the checks above, or use -v to see alpaca's log")
+		return
+	}
+	resp.Body.Close()
+	detail := fmt.Sprintf("GET %s via alpaca returned %s", d.testURL, resp.Status)
+	switch resp.StatusCode {
+	case http.StatusProxyAuthRequired:
+		d.report(checkFail, check, detail, credentialsHint)
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		d.report(checkFail, check, detail, "see the checks above, or use -v to see alpaca's log")
+	default:
+		d.report(checkPass, check, detail, "")
+	}
+}
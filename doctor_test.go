@@ -0,0 +1,157 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDoctor(t *testing.T, pacurls ...string) (*doctor, *strings.Builder) {
+	var out strings.Builder
+	u, err := url.Parse("http://www.example.test/")
+	require.NoError(t, err)
+	d := &doctor{
+		w:          &out,
+		pacurls:    pacurls,
+		testURL:    u,
+		timeout:    5 * time.Second,
+		findPACURL: func() (string, error) { return "", nil },
+		lookupHost: func(ctx context.Context, host string) ([]string, error) {
+			return nil, errors.New("no such host")
+		},
+	}
+	return d, &out
+}
+
+func TestDoctor(t *testing.T) {
+	t.Setenv("NTLM_CREDENTIALS", "malory@isis:823893adfad2cda6e1a414f3ebdf58f7")
+	proxy := httptest.NewServer(ntlmServer{t})
+	defer proxy.Close()
+	pac := httptest.NewServer(pacjsHandler(`function FindProxyForURL(url, host) {
+		return "PROXY ` + proxy.Listener.Addr().String() + `";
+	}`))
+	defer pac.Close()
+	d, out := newTestDoctor(t)
+	d.findPACURL = func() (string, error) { return pac.URL, nil }
+	assert.Equal(t, 0, d.run(), out.String())
+	lines := strings.Split(out.String(), "\n")
+	expected := []string{
+		"PASS  PAC discovery: found " + pac.URL + " in the system's proxy settings",
+		"PASS  PAC download: downloaded ",
+		`PASS  PAC evaluation: FindProxyForURL("http://www.example.test/") returned "PROXY `,
+		`PASS  Credentials: using credentials for isis\malory from $NTLM_CREDENTIALS`,
+		"SKIP  DNS: no hostnames to resolve",
+		"PASS  Proxy " + proxy.Listener.Addr().String() + ": connected",
+		"PASS  NTLM handshake with " + proxy.Listener.Addr().String() + `: authenticated as ` +
+			`isis\malory`,
+		"PASS  Fetch: GET http://www.example.test/ via alpaca returned 200 OK",
+		"",
+		"All checks passed.",
+	}
+	require.Len(t, lines, len(expected)+1)
+	for i, prefix := range expected {
+		assert.True(t, strings.HasPrefix(lines[i], prefix), "%q doesn't start with %q",
+			lines[i], prefix)
+	}
+}
+
+func TestDoctorWithoutCredentials(t *testing.T) {
+	t.Setenv("NTLM_CREDENTIALS", "")
+	proxy := httptest.NewServer(ntlmServer{t})
+	defer proxy.Close()
+	d, out := newTestDoctor(t)
+	proxyURL := &url.URL{Scheme: "http", Host: proxy.Listener.Addr().String()}
+	d.checkProxy(proxyURL, d.checkCredentials())
+	assert.Contains(t, out.String(), "WARN  Credentials: no credentials found")
+	assert.Contains(t, out.String(), "FAIL  NTLM handshake with "+proxyURL.Host+
+		": the proxy asked for credentials, but none were found\n      hint: run `alpaca -d")
+}
+
+func TestDoctorPACFailures(t *testing.T) {
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	invalid := httptest.NewServer(pacjsHandler("function FindProxyForURL(url, host) {"))
+	defer invalid.Close()
+	d, out := newTestDoctor(t, notFound.URL, invalid.URL)
+	pacurl, pacjs := d.downloadPAC(d.pacurls)
+	assert.Equal(t, invalid.URL, pacurl)
+	assert.Nil(t, d.evaluatePAC(pacjs))
+	assert.Equal(t, 1, d.failures)
+	lines := strings.Split(out.String(), "\n")
+	require.Len(t, lines, 5)
+	assert.Equal(t, "WARN  PAC download: "+notFound.URL+": expected status 200 OK, got "+
+		"404 Not Found", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "PASS  PAC download: downloaded 37 bytes from "+invalid.URL))
+	assert.True(t, strings.HasPrefix(lines[2], "FAIL  PAC evaluation: the PAC file is invalid"))
+	assert.True(t, strings.HasPrefix(lines[3], "      hint: "))
+}
+
+func TestDoctorPACDownloadFails(t *testing.T) {
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	d, out := newTestDoctor(t, notFound.URL)
+	pacurl, pacjs := d.downloadPAC(d.pacurls)
+	assert.Empty(t, pacurl)
+	assert.Nil(t, pacjs)
+	assert.Equal(t, 1, d.failures)
+	assert.True(t, strings.HasPrefix(out.String(), "FAIL  PAC download: "+notFound.URL))
+	// Without a PAC file, requests are made directly.
+	assert.Equal(t, direct, d.evaluatePAC(pacjs))
+}
+
+func TestDoctorDNS(t *testing.T) {
+	d, out := newTestDoctor(t)
+	d.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host == "proxy.example.test" {
+			return []string{"10.0.0.1"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	proxies := []*url.URL{{Host: "proxy.example.test:8080"}, {Host: "10.0.0.2:8080"}, nil}
+	d.checkDNS([]string{"http://10.0.0.3/proxy.pac"}, proxies)
+	assert.Equal(t, 1, d.failures)
+	lines := strings.Split(out.String(), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, "PASS  DNS: proxy.example.test resolves to 10.0.0.1", lines[0])
+	assert.Equal(t, "FAIL  DNS: couldn't resolve www.example.test: no such host", lines[1])
+}
+
+func TestDoctorProxyUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	addr := server.Listener.Addr().String()
+	server.Close()
+	d, out := newTestDoctor(t)
+	d.checkProxy(&url.URL{Scheme: "http", Host: addr}, nil)
+	assert.Equal(t, 1, d.failures)
+	assert.True(t, strings.HasPrefix(out.String(), "FAIL  Proxy "+addr+": "))
+	assert.NotContains(t, out.String(), "NTLM handshake")
+}
+
+func TestOffersNTLM(t *testing.T) {
+	assert.True(t, offersNTLM([]string{"Basic realm=\"proxy\"", "NTLM"}))
+	assert.True(t, offersNTLM([]string{"ntlm abcd"}))
+	assert.False(t, offersNTLM([]string{"Negotiate", "Basic"}))
+	assert.False(t, offersNTLM(nil))
+}
@@ -0,0 +1,187 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxySettings are the settings that clients need in order to use alpaca.
+type proxySettings struct {
+	url     string   // alpaca's URL, e.g. "http://localhost:3128"
+	noProxy []string // hosts that clients should connect to directly
+}
+
+// proxySettingsFlags adds the flags that choose alpaca's address to a subcommand's flags. The
+// returned function must be called after the flags are parsed. Unless the address is given by
+// the flags, it's the address of the running instance of alpaca (found using its control socket),
+// or localhost:3128 if alpaca isn't running.
+func proxySettingsFlags(fs *flag.FlagSet) func() proxySettings {
+	host := fs.String("l", "localhost", "address that alpaca is listening on (default: "+
+		"the address of the running alpaca, or localhost)")
+	port := fs.Int("p", 3128, "port number that alpaca is listening on (default: the port of "+
+		"the running alpaca, or 3128)")
+	tls := fs.Bool("listen-tls", false, "alpaca is listening for HTTPS connections")
+	noProxy := fs.String("N", "localhost,127.0.0.1,::1", "hosts, domains and CIDRs that "+
+		"should be connected to directly, separated by commas")
+	controlPath := fs.String("control", defaultControlPath(), "path of the control socket of "+
+		"the running alpaca (empty to only use the flags)")
+	return func() proxySettings {
+		var s proxySettings
+		explicit := false
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "l" || f.Name == "p" || f.Name == "listen-tls" {
+				explicit = true
+			}
+		})
+		if !explicit && *controlPath != "" {
+			s.url, _ = runningProxyURL(newControlClient(*controlPath))
+		}
+		if s.url == "" {
+			scheme := "http"
+			if *tls {
+				scheme = "https"
+			}
+			s.url = scheme + "://" + net.JoinHostPort(*host, strconv.Itoa(*port))
+		}
+		for _, entry := range strings.Split(*noProxy, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				s.noProxy = append(s.noProxy, entry)
+			}
+		}
+		return s
+	}
+}
+
+// runningProxyURL asks the running instance of alpaca for the address of its first listener.
+func runningProxyURL(client *http.Client) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://alpaca/status", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var status controlStatus
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response status: %s", resp.Status)
+	} else if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return "", err
+	} else if len(status.Listeners) == 0 {
+		return "", errors.New("alpaca isn't listening on any addresses")
+	}
+	l := status.Listeners[0]
+	host, port, err := net.SplitHostPort(l.Addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		// alpaca is listening on all addresses, so clients on this host can use localhost.
+		host = "localhost"
+	}
+	scheme := "http"
+	if l.TLS {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port), nil
+}
+
+// envVars returns the names and values of the proxy environment variables, in both lowercase
+// (which most tools use) and uppercase (which some tools use instead).
+func (s proxySettings) envVars() [][2]string {
+	var vars [][2]string
+	for _, name := range []string{"http_proxy", "https_proxy", "no_proxy"} {
+		value := s.url
+		if name == "no_proxy" {
+			value = strings.Join(s.noProxy, ",")
+		}
+		vars = append(vars, [2]string{name, value}, [2]string{strings.ToUpper(name), value})
+	}
+	return vars
+}
+
+// envCommand implements "alpaca env", which prints commands that set the proxy environment
+// variables, so that they can be evaluated by the shell, e.g.: eval "$(alpaca env)"
+func envCommand(args []string) int {
+	fs := flag.NewFlagSet("alpaca env", flag.ExitOnError)
+	shell := fs.String("shell", defaultShell(), "syntax to print: bash, zsh, fish or powershell")
+	unset := fs.Bool("unset", false, "print commands that unset the variables instead")
+	settings := proxySettingsFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: alpaca env [flags]\n\n"+
+			"Prints commands that set the proxy environment variables to use alpaca:\n\n"+
+			"  eval \"$(alpaca env)\"                            # bash or zsh\n"+
+			"  alpaca env -shell fish | source                 # fish\n"+
+			"  alpaca env -shell powershell | Invoke-Expression # PowerShell\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args) //nolint:errcheck
+	if err := printEnv(os.Stdout, *shell, settings(), *unset); err != nil {
+		fmt.Fprintf(os.Stderr, "alpaca env: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+// defaultShell guesses which shell the user is running.
+func defaultShell() string {
+	if runtime.GOOS == "windows" {
+		return "powershell"
+	}
+	if shell := filepath.Base(os.Getenv("SHELL")); shell == "fish" || shell == "zsh" {
+		return shell
+	}
+	return "bash"
+}
+
+func printEnv(w io.Writer, shell string, s proxySettings, unset bool) error {
+	// Single quotes stop each shell from expanding anything, but they're escaped differently.
+	var set, clear, quote string
+	switch shell {
+	case "bash", "zsh", "sh":
+		set, clear, quote = "export %s=%s\n", "unset %s\n", `'"'"'`
+	case "fish":
+		set, clear, quote = "set -gx %s %s\n", "set -e %s\n", `\'`
+	case "powershell", "pwsh":
+		set, clear, quote = "$env:%s = %s\n", "Remove-Item Env:%s -ErrorAction Ignore\n", "''"
+	default:
+		return fmt.Errorf("unknown shell %q (expected bash, zsh, fish or powershell)", shell)
+	}
+	for _, v := range s.envVars() {
+		if unset {
+			fmt.Fprintf(w, clear, v[0])
+		} else {
+			fmt.Fprintf(w, set, v[0], "'"+strings.ReplaceAll(v[1], "'", quote)+"'")
+		}
+	}
+	return nil
+}
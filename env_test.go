@@ -0,0 +1,105 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxySettingsFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	settings := proxySettingsFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-l", "::1", "-p", "8080", "-N", "a.com, 10.0.0.0/8,"}))
+	s := settings()
+	assert.Equal(t, "http://[::1]:8080", s.url)
+	assert.Equal(t, []string{"a.com", "10.0.0.0/8"}, s.noProxy)
+}
+
+func TestProxySettingsFromRunningAlpaca(t *testing.T) {
+	cs := newControlServer(newCredentialStore(nil))
+	cs.add(":3129", true, NewProxyFinder(ProxyFinderConfig{NoPAC: true}, NewPACWrapper(PACData{})))
+	path := filepath.Join(t.TempDir(), "alpaca.sock")
+	l, err := listenControl(path)
+	require.NoError(t, err)
+	s := &http.Server{Handler: cs.handler()}
+	go s.Serve(l) //nolint:errcheck
+	defer s.Close()
+	settings := func(args ...string) proxySettings {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		settings := proxySettingsFlags(fs)
+		require.NoError(t, fs.Parse(append([]string{"-control", path}, args...)))
+		return settings()
+	}
+	// The running alpaca's address is used, unless an address is given explicitly.
+	assert.Equal(t, "https://localhost:3129", settings().url)
+	assert.Equal(t, "http://localhost:8080", settings("-p", "8080").url)
+	// If alpaca isn't running, the default address is used.
+	s.Close()
+	assert.Equal(t, "http://localhost:3128", settings().url)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	noControl := proxySettingsFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-control", ""}))
+	assert.Equal(t, "http://localhost:3128", noControl().url)
+}
+
+func TestPrintEnv(t *testing.T) {
+	s := proxySettings{url: "http://localhost:3128", noProxy: []string{"localhost", "it's"}}
+	tests := []struct {
+		shell    string
+		unset    bool
+		expected []string
+	}{
+		{"bash", false, []string{
+			"export http_proxy='http://localhost:3128'",
+			"export HTTPS_PROXY='http://localhost:3128'",
+			`export no_proxy='localhost,it'"'"'s'`,
+		}},
+		{"bash", true, []string{"unset http_proxy", "unset NO_PROXY"}},
+		{"fish", false, []string{
+			"set -gx http_proxy 'http://localhost:3128'",
+			`set -gx NO_PROXY 'localhost,it\'s'`,
+		}},
+		{"fish", true, []string{"set -e https_proxy"}},
+		{"powershell", false, []string{
+			"$env:HTTP_PROXY = 'http://localhost:3128'",
+			"$env:no_proxy = 'localhost,it''s'",
+		}},
+		{"pwsh", true, []string{"Remove-Item Env:https_proxy -ErrorAction Ignore"}},
+	}
+	for _, test := range tests {
+		t.Run(test.shell, func(t *testing.T) {
+			var b strings.Builder
+			require.NoError(t, printEnv(&b, test.shell, s, test.unset))
+			lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+			assert.Len(t, lines, 6)
+			for _, line := range test.expected {
+				assert.Contains(t, lines, line)
+			}
+		})
+	}
+}
+
+func TestPrintEnvUnknownShell(t *testing.T) {
+	var b strings.Builder
+	assert.Error(t, printEnv(&b, "csh", proxySettings{}, false))
+	assert.Empty(t, b.String())
+}
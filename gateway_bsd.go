@@ -0,0 +1,44 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+)
+
+func defaultGateways() ([]net.IP, error) {
+	out, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseRouteGet(string(out)), nil
+}
+
+// parseRouteGet returns the gateway from the output of "route -n get default".
+func parseRouteGet(out string) []net.IP {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "gateway:" {
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				return []net.IP{ip}
+			}
+		}
+	}
+	return nil
+}
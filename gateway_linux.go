@@ -0,0 +1,60 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// The file containing the kernel's IPv4 routing table.
+var procNetRoute = "/proc/net/route"
+
+func defaultGateways() ([]net.IP, error) {
+	f, err := os.Open(procNetRoute)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcNetRoute(f)
+}
+
+// parseProcNetRoute returns the gateways of the default routes in /proc/net/route, where the
+// addresses are in hex (in the host's byte order, which is assumed to be little-endian).
+func parseProcNetRoute(r io.Reader) ([]net.IP, error) {
+	var gateways []net.IP
+	scanner := bufio.NewScanner(r)
+	// Skip the header line.
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			return nil, fmt.Errorf("invalid gateway %q in %s", fields[2], procNetRoute)
+		}
+		gateways = append(gateways, net.IPv4(b[3], b[2], b[1], b[0]))
+	}
+	return gateways, scanner.Err()
+}
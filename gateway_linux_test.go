@@ -0,0 +1,43 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcNetRoute(t *testing.T) {
+	gateways, err := parseProcNetRoute(strings.NewReader(`Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+wlan0	00000000	FE01000A	0003	0	0	600	00000000	0	0	0
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.IPv4(192, 168, 1, 1), net.IPv4(10, 0, 1, 254)}, gateways)
+}
+
+func TestParseProcNetRouteInvalid(t *testing.T) {
+	_, err := parseProcNetRoute(strings.NewReader(`Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	XYZ	0003	0	0	100	00000000	0	0	0
+`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,182 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+var (
+	// preferIP is the address family to try first when connecting to a host: "4" for IPv4,
+	// "6" for IPv6, or "" to use whichever family the resolver returned first.
+	preferIP string
+	// fallbackDelay is how long to wait for a connection attempt before starting the next one
+	// in parallel (the "Connection Attempt Delay" from RFC 8305). If it is zero or negative,
+	// each address is only tried after the previous one has failed.
+	fallbackDelay = 300 * time.Millisecond
+)
+
+// happyEyeballs connects to hosts with both IPv4 and IPv6 addresses by racing connection attempts
+// to each address, as described in RFC 8305 (https://tools.ietf.org/html/rfc8305). This means
+// that a broken IPv6 (or IPv4) network only delays a connection by the fallback delay, rather
+// than the time it takes for the operating system to give up on a connection attempt.
+type happyEyeballs struct {
+	prefer string
+	delay  time.Duration
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func newHappyEyeballs() *happyEyeballs {
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	return &happyEyeballs{
+		prefer: preferIP,
+		delay:  fallbackDelay,
+		lookup: net.DefaultResolver.LookupIPAddr,
+		dial:   dialer.DialContext,
+	}
+}
+
+func (he *happyEyeballs) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, connectTimeout)
+		defer cancel()
+	}
+	ips, err := he.lookup(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	ips = he.sortAddrs(network, ips)
+	if len(ips) == 0 {
+		err := &net.AddrError{Err: "no suitable address found", Addr: host}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return he.race(ctx, network, ips, port)
+}
+
+// sortAddrs orders addresses so that they alternate between address families, starting with the
+// preferred family. Addresses that can't be used with the network are removed.
+func (he *happyEyeballs) sortAddrs(network string, ips []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			if network != "tcp6" {
+				v4 = append(v4, ip)
+			}
+		} else if network != "tcp4" {
+			v6 = append(v6, ip)
+		}
+	}
+	primary, secondary := v6, v4
+	switch {
+	case he.prefer == "4":
+		primary, secondary = v4, v6
+	case he.prefer == "6":
+	case len(ips) > 0 && ips[0].IP.To4() != nil:
+		primary, secondary = v4, v6
+	}
+	sorted := make([]net.IPAddr, 0, len(v4)+len(v6))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			sorted = append(sorted, primary[i])
+		}
+		if i < len(secondary) {
+			sorted = append(sorted, secondary[i])
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// race tries to connect to each address in turn, starting the next attempt whenever the previous
+// one fails or the fallback delay passes, and returns the first connection that is established.
+func (he *happyEyeballs) race(ctx context.Context, network string, ips []net.IPAddr,
+	port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := he.dial(ctx, network, addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+	var timer *time.Timer
+	var fallback <-chan time.Time
+	if he.delay > 0 {
+		timer = time.NewTimer(he.delay)
+		defer timer.Stop()
+		fallback = timer.C
+	}
+	restartTimer := func() {
+		if timer == nil {
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(he.delay)
+	}
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close any connections that are established after this one.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+				restartTimer()
+			}
+		case <-fallback:
+			if next < len(ips) {
+				start()
+				restartTimer()
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,186 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ipAddrs(ips ...string) []net.IPAddr {
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs
+}
+
+func TestSortAddrs(t *testing.T) {
+	ips := ipAddrs("2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	tests := []struct {
+		name     string
+		prefer   string
+		network  string
+		ips      []net.IPAddr
+		expected []net.IPAddr
+	}{
+		{"Resolver", "", "tcp", ips, ipAddrs(
+			"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3")},
+		{"ResolverIPv4First", "", "tcp", ipAddrs("192.0.2.1", "2001:db8::1"),
+			ipAddrs("192.0.2.1", "2001:db8::1")},
+		{"PreferIPv4", "4", "tcp", ips, ipAddrs(
+			"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3")},
+		{"PreferIPv6", "6", "tcp", ipAddrs("192.0.2.1", "2001:db8::1"),
+			ipAddrs("2001:db8::1", "192.0.2.1")},
+		{"TCP4", "6", "tcp4", ips, ipAddrs("192.0.2.1", "192.0.2.2", "192.0.2.3")},
+		{"TCP6", "", "tcp6", ips, ipAddrs("2001:db8::1", "2001:db8::2")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			he := &happyEyeballs{prefer: test.prefer}
+			assert.Equal(t, test.expected, he.sortAddrs(test.network, test.ips))
+		})
+	}
+}
+
+// fakeDialer records the addresses that are dialled. Addresses in the "fail" map fail straight
+// away, addresses in the "hang" map never connect (until the context is cancelled), and all other
+// addresses connect to the listener.
+type fakeDialer struct {
+	listener net.Listener
+	fail     map[string]bool
+	hang     map[string]bool
+	mux      sync.Mutex
+	dialled  []string
+}
+
+func (fd *fakeDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	fd.mux.Lock()
+	fd.dialled = append(fd.dialled, addr)
+	fd.mux.Unlock()
+	if fd.fail[addr] {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("refused: " + addr)}
+	} else if fd.hang[addr] {
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", fd.listener.Addr().String())
+}
+
+func (fd *fakeDialer) attempts() []string {
+	fd.mux.Lock()
+	defer fd.mux.Unlock()
+	return append([]string(nil), fd.dialled...)
+}
+
+func newTestHappyEyeballs(t *testing.T, delay time.Duration, ips []net.IPAddr) (*happyEyeballs,
+	*fakeDialer) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	fd := &fakeDialer{listener: l, fail: map[string]bool{}, hang: map[string]bool{}}
+	he := &happyEyeballs{
+		delay: delay,
+		lookup: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return ips, nil
+		},
+		dial: fd.dial,
+	}
+	return he, fd
+}
+
+func TestHappyEyeballsBrokenIPv6(t *testing.T) {
+	ips := ipAddrs("2001:db8::1", "192.0.2.1")
+	he, fd := newTestHappyEyeballs(t, 50*time.Millisecond, ips)
+	fd.hang["[2001:db8::1]:443"] = true
+	start := time.Now()
+	conn, err := he.DialContext(context.Background(), "tcp", "dualstack.test:443")
+	require.NoError(t, err)
+	conn.Close()
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 50*time.Millisecond)
+	assert.Less(t, elapsed, 5*time.Second)
+	assert.Equal(t, []string{"[2001:db8::1]:443", "192.0.2.1:443"}, fd.attempts())
+}
+
+func TestHappyEyeballsFailureStartsNextAttempt(t *testing.T) {
+	ips := ipAddrs("2001:db8::1", "192.0.2.1")
+	he, fd := newTestHappyEyeballs(t, time.Hour, ips)
+	fd.fail["[2001:db8::1]:443"] = true
+	conn, err := he.DialContext(context.Background(), "tcp", "dualstack.test:443")
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, []string{"[2001:db8::1]:443", "192.0.2.1:443"}, fd.attempts())
+}
+
+func TestHappyEyeballsNoRace(t *testing.T) {
+	ips := ipAddrs("2001:db8::1", "192.0.2.1")
+	he, fd := newTestHappyEyeballs(t, 0, ips)
+	conn, err := he.DialContext(context.Background(), "tcp", "dualstack.test:443")
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, []string{"[2001:db8::1]:443"}, fd.attempts())
+}
+
+func TestHappyEyeballsAllFail(t *testing.T) {
+	ips := ipAddrs("2001:db8::1", "192.0.2.1")
+	he, fd := newTestHappyEyeballs(t, 50*time.Millisecond, ips)
+	fd.fail["[2001:db8::1]:443"] = true
+	fd.fail["192.0.2.1:443"] = true
+	_, err := he.DialContext(context.Background(), "tcp", "dualstack.test:443")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "refused: [2001:db8::1]:443")
+}
+
+func TestHappyEyeballsTimeout(t *testing.T) {
+	setTimeout(t, &connectTimeout, 50*time.Millisecond)
+	ips := ipAddrs("2001:db8::1", "192.0.2.1")
+	he, fd := newTestHappyEyeballs(t, 10*time.Millisecond, ips)
+	fd.hang["[2001:db8::1]:443"] = true
+	fd.hang["192.0.2.1:443"] = true
+	_, err := he.DialContext(context.Background(), "tcp", "dualstack.test:443")
+	require.Error(t, err)
+	assert.Equal(t, failureTimeout, classifyFailure(err))
+}
+
+func TestHappyEyeballsLookupError(t *testing.T) {
+	he := newHappyEyeballs()
+	he.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	_, err := he.DialContext(context.Background(), "tcp", "nonexistent.test:443")
+	require.Error(t, err)
+	assert.Equal(t, failureDNS, classifyFailure(err))
+}
+
+func TestHappyEyeballsLocalhost(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	conn, err := newHappyEyeballs().DialContext(context.Background(), "tcp",
+		net.JoinHostPort("127.0.0.1", port))
+	require.NoError(t, err)
+	conn.Close()
+}
@@ -0,0 +1,178 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// healthChecker periodically probes the upstream proxies that ProxyFinder has come across, so
+// that proxies which are down can be blocked before a request fails, and proxies which have
+// recovered can be unblocked without waiting for their blocklist entry to expire.
+type healthChecker struct {
+	canary  string // if set, the host:port to CONNECT to via each proxy
+	timeout time.Duration
+	report  reportFunc
+	probe   func(*url.URL) error
+	proxies map[string]*url.URL // the proxies to check, keyed by host
+	healthy map[string]bool     // the result of the last check of each proxy
+	mux     sync.Mutex
+}
+
+func newHealthChecker(canary string, timeout time.Duration, report reportFunc) *healthChecker {
+	hc := &healthChecker{
+		canary:  canary,
+		timeout: timeout,
+		report:  report,
+		proxies: map[string]*url.URL{},
+		healthy: map[string]bool{},
+	}
+	hc.probe = hc.check
+	return hc
+}
+
+// watch adds a proxy to the set of proxies that are checked. It is safe to call on a nil
+// healthChecker (which does nothing).
+func (hc *healthChecker) watch(proxy *url.URL) {
+	if hc == nil {
+		return
+	}
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	if _, ok := hc.proxies[proxy.Host]; !ok {
+		hc.proxies[proxy.Host] = proxy
+		hc.healthy[proxy.Host] = true
+	}
+}
+
+// reset forgets about all of the proxies that are being checked (e.g. when the PAC file has
+// changed, and the proxies that it names may have changed too).
+func (hc *healthChecker) reset() {
+	if hc == nil {
+		return
+	}
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	hc.proxies = map[string]*url.URL{}
+	hc.healthy = map[string]bool{}
+}
+
+// run checks the proxies at the given interval, until the context is done.
+func (hc *healthChecker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hc.checkAll()
+		}
+	}
+}
+
+func (hc *healthChecker) checkAll() {
+	hc.mux.Lock()
+	proxies := make([]*url.URL, 0, len(hc.proxies))
+	for _, proxy := range hc.proxies {
+		proxies = append(proxies, proxy)
+	}
+	hc.mux.Unlock()
+	var wg sync.WaitGroup
+	for _, proxy := range proxies {
+		wg.Add(1)
+		go func(proxy *url.URL) {
+			defer wg.Done()
+			hc.update(proxy, hc.probe(proxy))
+		}(proxy)
+	}
+	wg.Wait()
+}
+
+func (hc *healthChecker) update(proxy *url.URL, err error) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	healthy, ok := hc.healthy[proxy.Host]
+	if !ok {
+		// The proxy was removed (by a reset) while it was being checked.
+		return
+	}
+	hc.healthy[proxy.Host] = err == nil
+	if err != nil {
+		if healthy {
+			logWith("proxy", proxy.Host, "error", err).
+				Warnf("Health check failed for proxy %q, blocking: %v", proxy.Host, err)
+		}
+		// Report every failure (not just the first), so that the proxy is kept blocked for
+		// as long as it's down.
+		hc.report(proxy.Host, err)
+	} else if !healthy {
+		logWith("proxy", proxy.Host).Infof("Proxy %q has recovered, unblocking", proxy.Host)
+		hc.report(proxy.Host, nil)
+	}
+}
+
+// check connects to the proxy and (if a canary host has been configured) makes sure that the
+// proxy can tunnel a connection to it. The whole check is limited by hc.timeout.
+func (hc *healthChecker) check(proxy *url.URL) error {
+	if hc.canary == "" {
+		conn, err := net.DialTimeout("tcp", proxy.Host, hc.timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+	if proxy.Scheme == "socks5" {
+		conn, err := dialSOCKS5(ctx, proxy, hc.canary)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	var tr transport
+	defer tr.Close()
+	if err := tr.dial(ctx, proxy); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := tr.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: hc.canary},
+		Host:   hc.canary,
+		Header: make(http.Header),
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// A proxy that wants us to authenticate is still a working proxy. The health checker
+	// doesn't authenticate, since that would mean doing an NTLM handshake on every check.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusProxyAuthRequired {
+		return fmt.Errorf("CONNECT %s: unexpected response status: %s", hc.canary, resp.Status)
+	}
+	return nil
+}
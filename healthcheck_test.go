@@ -0,0 +1,176 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reportTo(b *blocklist) reportFunc {
+	return func(proxy string, err error) {
+		if err == nil {
+			b.remove(proxy)
+		} else {
+			b.fail(proxy, err)
+		}
+	}
+}
+
+func TestHealthCheckerBlocksAndUnblocks(t *testing.T) {
+	b := newBlocklist()
+	hc := newHealthChecker("", time.Second, reportTo(b))
+	up := map[string]bool{"a:80": true, "b:80": true}
+	hc.probe = func(proxy *url.URL) error {
+		if up[proxy.Host] {
+			return nil
+		}
+		return errors.New("down")
+	}
+	hc.watch(&url.URL{Scheme: "http", Host: "a:80"})
+	hc.watch(&url.URL{Scheme: "http", Host: "b:80"})
+	hc.checkAll()
+	assert.False(t, b.contains("a:80"))
+	assert.False(t, b.contains("b:80"))
+	// A proxy that goes down is blocked pre-emptively.
+	up["b:80"] = false
+	hc.checkAll()
+	assert.False(t, b.contains("a:80"))
+	assert.True(t, b.contains("b:80"))
+	// As soon as it recovers, it is unblocked.
+	up["b:80"] = true
+	hc.checkAll()
+	assert.False(t, b.contains("b:80"))
+	// A proxy that was blocked because a request failed is also unblocked once it's healthy.
+	b.add("a:80")
+	up["a:80"] = false
+	hc.checkAll()
+	up["a:80"] = true
+	hc.checkAll()
+	assert.False(t, b.contains("a:80"))
+}
+
+func TestHealthCheckerReset(t *testing.T) {
+	b := newBlocklist()
+	hc := newHealthChecker("", time.Second, reportTo(b))
+	hc.probe = func(*url.URL) error { return errors.New("down") }
+	hc.watch(&url.URL{Scheme: "http", Host: "a:80"})
+	hc.reset()
+	hc.checkAll()
+	assert.False(t, b.contains("a:80"))
+}
+
+func TestHealthCheckerKeepsFailingProxyBlocked(t *testing.T) {
+	// The checks are further apart than the time that the proxy's failure would block it for,
+	// but it stays blocked for as long as it keeps failing.
+	interval := 2 * maxAge
+	config := ProxyFinderConfig{NoPAC: true, HealthInterval: interval, HealthTimeout: time.Second}
+	pf := NewProxyFinder(config, NewPACWrapper(PACData{Port: 1}))
+	defer pf.stop()
+	var now time.Time
+	pf.blocked.now = func() time.Time { return now }
+	pf.health.probe = func(*url.URL) error { return errors.New("down") }
+	pf.health.watch(&url.URL{Scheme: "http", Host: "a:80"})
+	for i := 0; i < 10; i++ {
+		pf.health.checkAll()
+		assert.True(t, pf.blocked.contains("a:80"))
+		now = now.Add(interval + time.Second)
+		assert.True(t, pf.blocked.contains("a:80"), "unblocked before check %d", i+1)
+	}
+	// Once it recovers, it's unblocked straight away.
+	pf.health.probe = func(*url.URL) error { return nil }
+	pf.health.checkAll()
+	assert.False(t, pf.blocked.contains("a:80"))
+}
+
+func TestHealthCheckerRunStops(t *testing.T) {
+	hc := newHealthChecker("", time.Second, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hc.run(ctx, time.Millisecond)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "health checks didn't stop")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	requests := make(chan string, 2)
+	server := httptest.NewServer(testServer{requests})
+	defer server.Close()
+	proxy := httptest.NewServer(newDirectProxy())
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	hc := newHealthChecker("", time.Second, nil)
+	assert.NoError(t, hc.check(proxyURL))
+	assert.Error(t, hc.check(deadProxy(t)))
+	hc.canary = serverURL.Host
+	assert.NoError(t, hc.check(proxyURL))
+	hc.canary = deadProxy(t).Host
+	assert.Error(t, hc.check(proxyURL))
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	setTimeout(t, &tlsHandshakeTimeout, time.Minute)
+	setTimeout(t, &responseHeaderTimeout, time.Minute)
+	l := blackhole(t)
+	hc := newHealthChecker("www.test:443", 100*time.Millisecond, nil)
+	for _, scheme := range []string{"http", "https", "socks5"} {
+		t.Run(scheme, func(t *testing.T) {
+			start := time.Now()
+			assert.Error(t, hc.check(&url.URL{Scheme: scheme, Host: l.Addr().String()}))
+			assert.Less(t, time.Since(start), 5*time.Second)
+		})
+	}
+}
+
+func TestHealthCheckerWatchesPACProxies(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "PROXY a:80; PROXY b:80" }`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer server.Close()
+	config := ProxyFinderConfig{PACURLs: []string{server.URL}}
+	pf := NewProxyFinder(config, NewPACWrapper(PACData{Port: 1}))
+	pf.health = newHealthChecker("", time.Second, pf.reportProxy)
+	pf.health.probe = func(proxy *url.URL) error {
+		if proxy.Host == "a:80" {
+			return errors.New("down")
+		}
+		return nil
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
+	proxies, err := pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "a:80", proxies[0].Host)
+	pf.health.checkAll()
+	proxies, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "b:80", proxies[0].Host)
+}
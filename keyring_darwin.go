@@ -1,4 +1,4 @@
-// Copyright 2019, 2020, 2021 The Alpaca Authors
+// Copyright 2019, 2020, 2021, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -17,7 +17,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
 	"os/exec"
 	"strings"
 
@@ -81,6 +80,6 @@ func (k *keyring) getCredentials() (*authenticator, error) {
 	}
 	user, domain := substrs[0], substrs[1]
 	hash := getNtlmHash([]byte(k.readPasswordFromKeychain(userPrincipal)))
-	log.Printf("Found NoMAD credentials for %s\\%s in system keychain", domain, user)
+	infof("Found NoMAD credentials for %s\\%s in system keychain", domain, user)
 	return &authenticator{domain, user, hash}, nil
 }
@@ -0,0 +1,105 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	server := httptest.NewServer(testServer{make(chan string, 1)})
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "alpaca.sock")
+	listeners, err := listen("localhost:0", path)
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	s := createServer(listenerConfig{host: "localhost", port: 3128, finder: ProxyFinderConfig{NoPAC: true}},
+		serverOptions{})
+	go serve(s, listeners[0]) //nolint:errcheck
+	defer s.Close()
+	tr := &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Host: "alpaca"}),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	testGetRequest(t, tr, server.URL)
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alpaca.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	// The socket is still in use, so it shouldn't be replaced.
+	_, err = listenUnix(path)
+	assert.Error(t, err)
+	// Leave the socket file behind, as if alpaca had crashed.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+	l, err = listenUnix(path)
+	require.NoError(t, err)
+	l.Close()
+	// Other kinds of files are left alone.
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	_, err = listenUnix(path)
+	assert.Error(t, err)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer f.Close()
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "alpaca.socket")
+	listeners, err := systemdListeners(int(f.Fd()))
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	defer listeners[0].Close()
+	assert.Equal(t, l.Addr().String(), listeners[0].Addr().String())
+	_, ok := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, ok)
+	// The variables are only used once.
+	listeners, err = systemdListeners(int(f.Fd()))
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+}
+
+func TestSystemdListenersForAnotherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := systemdListeners(sdListenFDsStart)
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+}
@@ -0,0 +1,123 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listenerConfig describes an address that alpaca listens on, and how the requests that it
+// receives there are sent upstream. Each listener has its own handler chain, with its own
+// ProxyFinder, credentials and PAC file.
+type listenerConfig struct {
+	host   string
+	port   int
+	finder ProxyFinderConfig
+	auth   *authenticator
+	// ownAuth is true if the listener's credentials were set by its credentials or noauth
+	// options, rather than being the default credentials (which alpaca ctl can change).
+	ownAuth bool
+}
+
+func (lc listenerConfig) addr() string {
+	return net.JoinHostPort(lc.host, strconv.Itoa(lc.port))
+}
+
+// anyStaticProxies reports whether any of the listeners use static proxies (rather than a PAC
+// file, or connecting directly).
+func anyStaticProxies(listeners []listenerConfig) bool {
+	for _, lc := range listeners {
+		if lc.finder.Proxies != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseListenerFlag parses the value of the -L flag, which adds a listener in the form
+// "[host:]port[,option...]". The listener uses the same config as the default listener (from
+// base), apart from the host and port, and anything that's changed by these options (the pac,
+// credentials and noauth options also turn off network profiles for the listener):
+//
+//	pac=URL                 use this PAC file (may be repeated, to specify fallbacks)
+//	proxy=HOST:PORT[;...]   use these upstream proxies rather than a PAC file
+//	direct                  send all requests directly
+//	credentials=VALUE       use these NTLM credentials (in the format of $NTLM_CREDENTIALS)
+//	noauth                  don't authenticate to upstream proxies
+func parseListenerFlag(value string, base listenerConfig) (listenerConfig, error) {
+	lc := base
+	fields := strings.Split(value, ",")
+	addr := fields[0]
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return lc, err
+	}
+	if host != "" {
+		lc.host = host
+	}
+	lc.port, err = strconv.Atoi(portStr)
+	if err != nil {
+		return lc, fmt.Errorf("invalid port %q", portStr)
+	}
+	var pacurls []string
+	for _, option := range fields[1:] {
+		key, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			key, value = option[:i], option[i+1:]
+		}
+		switch key {
+		case "pac":
+			pacurls = append(pacurls, value)
+			lc.finder.NoPAC = false
+			lc.finder.Proxies = ""
+			lc.finder.Profiles = nil
+		case "proxy":
+			proxies, err := parseProxyFlag(value)
+			if err == nil && proxies == "" {
+				err = fmt.Errorf("no proxies given")
+			}
+			if err != nil {
+				return lc, fmt.Errorf("invalid proxy list %q: %w", value, err)
+			}
+			lc.finder.Proxies = proxies
+		case "direct":
+			lc.finder.NoPAC = true
+			lc.finder.Proxies = ""
+			lc.finder.Rules = nil
+		case "credentials":
+			a, err := parseCredentials(value)
+			if err != nil {
+				return lc, err
+			}
+			lc.auth, lc.ownAuth = a, true
+			lc.finder.Profiles = nil
+		case "noauth":
+			lc.auth, lc.ownAuth = nil, true
+			lc.finder.Profiles = nil
+		default:
+			return lc, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	if pacurls != nil {
+		lc.finder.PACURLs = pacurls
+	}
+	return lc, nil
+}
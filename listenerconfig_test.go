@@ -0,0 +1,142 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenerFlag(t *testing.T) {
+	base := listenerConfig{
+		host:   "localhost",
+		port:   3128,
+		finder: ProxyFinderConfig{PACURLs: []string{"http://corp/proxy.pac"}},
+		auth:   &authenticator{"CORP", "alice", "0123"},
+	}
+	tests := []struct {
+		name     string
+		value    string
+		expected listenerConfig
+	}{
+		{"PortOnly", "3129", listenerConfig{
+			host: "localhost", port: 3129, finder: base.finder, auth: base.auth,
+		}},
+		{"HostAndPort", "0.0.0.0:3129", listenerConfig{
+			host: "0.0.0.0", port: 3129, finder: base.finder, auth: base.auth,
+		}},
+		{"Direct", "3129,direct", listenerConfig{
+			host:   "localhost",
+			port:   3129,
+			finder: ProxyFinderConfig{PACURLs: base.finder.PACURLs, NoPAC: true},
+			auth:   base.auth,
+		}},
+		{"PAC", "3129,pac=http://a/a.pac,pac=http://b/b.pac", listenerConfig{
+			host:   "localhost",
+			port:   3129,
+			finder: ProxyFinderConfig{PACURLs: []string{"http://a/a.pac", "http://b/b.pac"}},
+			auth:   base.auth,
+		}},
+		{"Proxy", "3130,proxy=partner:8080;backup:8080,noauth", listenerConfig{
+			host: "localhost",
+			port: 3130,
+			finder: ProxyFinderConfig{
+				PACURLs: base.finder.PACURLs,
+				Proxies: "PROXY partner:8080; PROXY backup:8080",
+			},
+			ownAuth: true,
+		}},
+		{"Credentials", "3130,credentials=bob@PARTNER:4567", listenerConfig{
+			host:    "localhost",
+			port:    3130,
+			finder:  base.finder,
+			auth:    &authenticator{"PARTNER", "bob", "4567"},
+			ownAuth: true,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lc, err := parseListenerFlag(test.value, base)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, lc)
+		})
+	}
+}
+
+func TestParseListenerFlagInvalid(t *testing.T) {
+	for _, value := range []string{
+		"", "http", "3129,bogus", "3129,credentials=bob", "[::1", "3129,proxy=",
+	} {
+		t.Run(value, func(t *testing.T) {
+			_, err := parseListenerFlag(value, listenerConfig{host: "localhost", port: 3128})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAnyStaticProxies(t *testing.T) {
+	base := listenerConfig{port: 3128, finder: ProxyFinderConfig{PACURLs: []string{"http://a"}}}
+	assert.False(t, anyStaticProxies([]listenerConfig{base}))
+	lc, err := parseListenerFlag("3129,direct", base)
+	require.NoError(t, err)
+	assert.False(t, anyStaticProxies([]listenerConfig{base, lc}))
+	lc, err = parseListenerFlag("3130,proxy=partner:8080", base)
+	require.NoError(t, err)
+	assert.True(t, anyStaticProxies([]listenerConfig{base, lc}))
+}
+
+func TestMultipleListeners(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Via", "direct")
+	}))
+	defer server.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Via", "upstream")
+	}))
+	defer upstream.Close()
+	base := listenerConfig{host: "localhost", finder: ProxyFinderConfig{NoPAC: true}}
+	direct, err := parseListenerFlag("0,direct", base)
+	require.NoError(t, err)
+	proxied, err := parseListenerFlag("0,proxy="+upstream.Listener.Addr().String(), base)
+	require.NoError(t, err)
+	opts := serverOptions{ids: &contextIDs{}}
+	for _, test := range []struct {
+		lc       listenerConfig
+		expected string
+	}{
+		{direct, "direct"},
+		{proxied, "upstream"},
+	} {
+		l, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		s := createServer(test.lc, opts)
+		go serve(s, l) //nolint:errcheck
+		defer s.Close()
+		proxyURL := &url.URL{Host: l.Addr().String()}
+		client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, test.expected, resp.Header.Get("X-Via"))
+	}
+	// Both listeners assign IDs from the same counter.
+	assert.Equal(t, uint64(2), opts.ids.id)
+}
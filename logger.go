@@ -0,0 +1,278 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each log message has a level, a message, and fields (such as the request ID, URL and proxy),
+// and is written in one of these formats (chosen using the -log-format flag):
+//
+//	text    the message, prefixed with the request ID (if there is one), written using the log
+//	        package; the fields are left out, since the message says the same thing
+//	json    a JSON object per line, with the time, level, caller, message and fields
+//	logfmt  a line of key=value pairs, with the same keys as json
+//
+// Messages below the log level (set using the -log-level flag, or "alpaca ctl loglevel") are
+// dropped.
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+	levelFatal // only used by fatalf, so it can't be chosen using -log-level
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "fatal"}
+
+func (l logLevel) String() string {
+	if l < levelDebug || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	names := levelNames[:levelFatal]
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return levelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (expected %s)", s, strings.Join(names, ", "))
+}
+
+// The minimum level of the messages that are logged. It is accessed atomically.
+var minLogLevel = int32(levelInfo)
+
+func currentLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&minLogLevel))
+}
+
+func setLogLevel(l logLevel) {
+	atomic.StoreInt32(&minLogLevel, int32(l))
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// A logEntry holds the fields for a log message, which is written using its Debugf, Infof,
+// Warnf or Errorf method.
+type logEntry struct {
+	fields []logField
+}
+
+// logWith returns a logEntry with the given fields, as alternating keys and values.
+func logWith(kv ...interface{}) logEntry {
+	return logEntry{}.with(kv...)
+}
+
+// logFor returns a logEntry with the request's ID, method and URL, along with the given fields.
+func logFor(req *http.Request, kv ...interface{}) logEntry {
+	u := req.URL.String()
+	if req.Method == http.MethodConnect {
+		u = req.Host
+	}
+	return logWith("id", req.Context().Value(contextKeyID), "method", req.Method, "url", u).
+		with(kv...)
+}
+
+func (e logEntry) with(kv ...interface{}) logEntry {
+	fields := make([]logField, len(e.fields), len(e.fields)+len(kv)/2)
+	copy(fields, e.fields)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		fields = append(fields, logField{key, kv[i+1]})
+	}
+	return logEntry{fields}
+}
+
+func (e logEntry) Debugf(format string, v ...interface{}) { e.output(2, levelDebug, format, v...) }
+func (e logEntry) Infof(format string, v ...interface{})  { e.output(2, levelInfo, format, v...) }
+func (e logEntry) Warnf(format string, v ...interface{})  { e.output(2, levelWarn, format, v...) }
+func (e logEntry) Errorf(format string, v ...interface{}) { e.output(2, levelError, format, v...) }
+
+// debugf, infof, warnf and errorf log messages without any fields.
+func debugf(format string, v ...interface{}) { logEntry{}.output(2, levelDebug, format, v...) }
+func infof(format string, v ...interface{})  { logEntry{}.output(2, levelInfo, format, v...) }
+func warnf(format string, v ...interface{})  { logEntry{}.output(2, levelWarn, format, v...) }
+func errorf(format string, v ...interface{}) { logEntry{}.output(2, levelError, format, v...) }
+
+// exit is called by fatalf (and can be replaced by tests).
+var exit = os.Exit
+
+// fatalf logs a message at the fatal level (which is never dropped), and then exits, like
+// log.Fatalf.
+func fatalf(format string, v ...interface{}) {
+	logEntry{}.output(2, levelFatal, format, v...)
+	exit(1)
+}
+
+// output writes a log message. The caller is found by skipping the given number of stack frames
+// (where 1 is the caller of output).
+func (e logEntry) output(skip int, level logLevel, format string, v ...interface{}) {
+	if level < currentLogLevel() {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if sl := structuredLog.Load().(*structuredLogger); sl != nil {
+		caller := "???"
+		if _, file, line, ok := runtime.Caller(skip); ok {
+			caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+		}
+		sl.write(level, caller, msg, e.fields)
+		return
+	}
+	if len(e.fields) > 0 && e.fields[0].key == "id" {
+		msg = fmt.Sprintf("[%v] %s", e.fields[0].value, msg)
+	}
+	log.Output(skip+1, msg) //nolint:errcheck
+}
+
+// structuredLog is where messages are written in the json and logfmt formats (it holds a nil
+// *structuredLogger for the text format).
+var structuredLog atomic.Value
+
+func init() {
+	structuredLog.Store((*structuredLogger)(nil))
+}
+
+// setLogFormat sets the format of log messages, which are written to w (unless the format is
+// text, in which case they're written using the log package).
+func setLogFormat(format string, w io.Writer) error {
+	switch format {
+	case "text":
+		structuredLog.Store((*structuredLogger)(nil))
+	case "json", "logfmt":
+		sl := &structuredLogger{format: format, w: w, now: time.Now}
+		structuredLog.Store(sl)
+		// Messages from the log package (e.g. from net/http, or fatal errors) are converted.
+		log.SetFlags(log.Lshortfile)
+		log.SetOutput(sl)
+	default:
+		return fmt.Errorf("unknown log format %q (expected text, json or logfmt)", format)
+	}
+	return nil
+}
+
+type structuredLogger struct {
+	format string // json or logfmt
+	w      io.Writer
+	now    func() time.Time
+	mux    sync.Mutex
+}
+
+// Write converts a message from the log package (with the Lshortfile flag) to an error message.
+func (sl *structuredLogger) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	caller := ""
+	if i := strings.Index(msg, ": "); i >= 0 && strings.Contains(msg[:i], ".go:") {
+		caller, msg = msg[:i], msg[i+2:]
+	}
+	sl.write(levelError, caller, msg, nil)
+	return len(p), nil
+}
+
+func (sl *structuredLogger) write(level logLevel, caller, msg string, fields []logField) {
+	all := append([]logField{
+		{"time", sl.now().Format("2006-01-02T15:04:05.000Z07:00")},
+		{"level", level.String()},
+		{"caller", caller},
+		{"msg", msg},
+	}, fields...)
+	var b bytes.Buffer
+	if sl.format == "json" {
+		b.WriteByte('{')
+		for i, f := range all {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			key, _ := json.Marshal(f.key)
+			b.Write(key)
+			b.WriteByte(':')
+			value, err := json.Marshal(logValue(f.value))
+			if err != nil {
+				value, _ = json.Marshal(fmt.Sprint(f.value))
+			}
+			b.Write(value)
+		}
+		b.WriteByte('}')
+	} else {
+		for i, f := range all {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(f.key)
+			b.WriteByte('=')
+			b.WriteString(logfmtValue(logValue(f.value)))
+		}
+	}
+	b.WriteByte('\n')
+	sl.mux.Lock()
+	defer sl.mux.Unlock()
+	sl.w.Write(b.Bytes()) //nolint:errcheck
+}
+
+// logValue converts a field's value to something that can be encoded in JSON.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func logfmtValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, func(r rune) bool {
+		return r < ' ' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
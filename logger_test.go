@@ -0,0 +1,162 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected logLevel
+	}{
+		{"debug", levelDebug}, {"INFO", levelInfo}, {"warn", levelWarn}, {"warning", levelWarn},
+		{"error", levelError},
+	} {
+		level, err := parseLogLevel(test.value)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, level)
+		assert.Equal(t, strings.TrimSuffix(strings.ToLower(test.value), "ing"), level.String())
+	}
+	_, err := parseLogLevel("verbose")
+	assert.Error(t, err)
+	// The fatal level is only used for fatal errors, so it can't be chosen.
+	_, err = parseLogLevel("fatal")
+	assert.Error(t, err)
+}
+
+// useStructuredLog sends log messages to a buffer, in the given format, until the test finishes.
+func useStructuredLog(t *testing.T, format string) *bytes.Buffer {
+	var buf bytes.Buffer
+	now := func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+	structuredLog.Store(&structuredLogger{format: format, w: &buf, now: now})
+	t.Cleanup(func() { structuredLog.Store((*structuredLogger)(nil)) })
+	return &buf
+}
+
+func TestLogText(t *testing.T) {
+	var buf bytes.Buffer
+	flags, w := log.Flags(), log.Writer()
+	log.SetFlags(0)
+	log.SetOutput(&buf)
+	defer log.SetFlags(flags)
+	defer log.SetOutput(w)
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyID, uint(7)))
+	logFor(req, "route", "DIRECT").Infof("GET %s via DIRECT", req.URL)
+	infof("no fields")
+	assert.Equal(t, "[7] GET http://example.com/ via DIRECT\nno fields\n", buf.String())
+}
+
+func TestFatalf(t *testing.T) {
+	buf := useStructuredLog(t, "logfmt")
+	defer func() { exit = os.Exit }()
+	code := -1
+	exit = func(c int) { code = c }
+	// Fatal errors are logged even if the log level would drop errors.
+	defer setLogLevel(currentLogLevel())
+	setLogLevel(levelFatal)
+	fatalf("Invalid -log-format: %v", "xml")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, buf.String(), `level=fatal`)
+	assert.Contains(t, buf.String(), `msg="Invalid -log-format: xml"`)
+}
+
+func TestLogJSON(t *testing.T) {
+	buf := useStructuredLog(t, "json")
+	req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyID, uint(7)))
+	logFor(req, "proxy", "proxy.test:8080", "duration", 1500*time.Millisecond).
+		with("error", errors.New("oops")).Warnf("Error dialling proxy")
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Regexp(t, `^logger_test\.go:\d+$`, entry["caller"])
+	delete(entry, "caller")
+	assert.Equal(t, map[string]interface{}{
+		"time":     "2026-01-02T03:04:05.000Z",
+		"level":    "warn",
+		"msg":      "Error dialling proxy",
+		"id":       float64(7),
+		"method":   "CONNECT",
+		"url":      "example.com:443",
+		"proxy":    "proxy.test:8080",
+		"duration": "1.5s",
+		"error":    "oops",
+	}, entry)
+}
+
+func TestLogfmt(t *testing.T) {
+	buf := useStructuredLog(t, "logfmt")
+	logWith("status", 200, "user", "", "error", `a "quoted" value`).Errorf("two words")
+	line := buf.String()
+	assert.True(t, strings.HasSuffix(line, "\n"))
+	assert.Regexp(t, `^time=2026-01-02T03:04:05.000Z level=error caller=logger_test\.go:\d+ `+
+		`msg="two words" status=200 user="" error="a \\"quoted\\" value"\n$`, line)
+}
+
+func TestLogLevelFiltering(t *testing.T) {
+	buf := useStructuredLog(t, "logfmt")
+	defer setLogLevel(currentLogLevel())
+	setLogLevel(levelWarn)
+	debugf("debug")
+	infof("info")
+	warnf("warn")
+	errorf("error")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "level=warn")
+	assert.Contains(t, lines[1], "level=error")
+}
+
+func TestStructuredLoggerWrite(t *testing.T) {
+	buf := useStructuredLog(t, "json")
+	// Messages from the log package (with the Lshortfile flag) are logged as errors.
+	sl := structuredLog.Load().(*structuredLogger)
+	logger := log.New(sl, "", log.Lshortfile)
+	logger.Print("http: TLS handshake error")
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "error", entry["level"])
+	assert.Regexp(t, `^logger_test\.go:\d+$`, entry["caller"])
+	assert.Equal(t, "http: TLS handshake error", entry["msg"])
+}
+
+func TestSetLogFormat(t *testing.T) {
+	flags, w := log.Flags(), log.Writer()
+	defer log.SetFlags(flags)
+	defer log.SetOutput(w)
+	defer structuredLog.Store((*structuredLogger)(nil))
+	var buf bytes.Buffer
+	require.NoError(t, setLogFormat("logfmt", &buf))
+	log.Printf("from the log package")
+	assert.Contains(t, buf.String(), `level=error`)
+	assert.Contains(t, buf.String(), `msg="from the log package"`)
+	require.NoError(t, setLogFormat("text", &buf))
+	assert.Nil(t, structuredLog.Load().(*structuredLogger))
+	assert.Error(t, setLogFormat("xml", &buf))
+}
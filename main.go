@@ -1,4 +1,4 @@
-// Copyright 2019, 2021, 2022 The Alpaca Authors
+// Copyright 2019, 2021, 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -22,8 +23,13 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
-	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/glob"
 )
 
 var BuildVersion string
@@ -36,14 +42,139 @@ func whoAmI() string {
 	return me.Username
 }
 
+// flagWasSet reports whether a flag was given on the command line.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func noProxyFromEnv() string {
+	if value := os.Getenv("NO_PROXY"); value != "" {
+		return value
+	}
+	return os.Getenv("no_proxy")
+}
+
+// stringList is a flag.Value that collects the values of a flag that is given multiple times.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ", ")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+// subcommands are run instead of the proxy when their name is the first argument.
+var subcommands = map[string]func(args []string) int{
+	"configure": configureCommand,
+	"ctl":       ctlCommand,
+	"doctor":    doctorCommand,
+	"env":       envCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	host := flag.String("l", "localhost", "address to listen on")
 	port := flag.Int("p", 3128, "port number to listen on")
-	pacurl := flag.String("C", "", "url of proxy auto-config (pac) file")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait "+
+		"for requests and tunnels to finish when shutting down, before closing them")
+	var listenerFlags stringList
+	flag.Var(&listenerFlags, "L", "additional listener, as [host:]port[,option...], where the "+
+		"options are pac=URL, proxy=HOST:PORT, direct, credentials=VALUE or noauth; may be "+
+		"repeated")
+	unixPath := flag.String("unix", "", "path of a unix socket to listen on instead of -l and -p")
+	listenTLS := flag.Bool("listen-tls", false, "accept HTTPS rather than HTTP connections from "+
+		"clients (using a self-signed certificate, unless -listen-cert is given)")
+	listenCert := flag.String("listen-cert", "", "certificate file for -listen-tls")
+	listenKey := flag.String("listen-key", "", "key file for -listen-tls (defaults to the "+
+		"-listen-cert file)")
+	allow := flag.String("allow", "", "IP addresses and CIDR blocks of the clients that are "+
+		"allowed to connect, separated by commas (default: any client)")
+	usersFile := flag.String("auth-file", "", "htpasswd file (with bcrypt hashes) of the "+
+		"usernames and passwords that clients must use to authenticate")
+	accessLogPath := flag.String("access-log", "", "file to write a line to for each request")
+	accessLogFormat := flag.String("access-log-format", "combined", "format of the access log: "+
+		"common, combined or json")
+	accessLogMaxSize := flag.Int("access-log-max-size", 100, "size (in MB) at which the access "+
+		"log is rotated (0 to never rotate it)")
+	accessLogBackups := flag.Int("access-log-backups", 5, "number of rotated access logs to keep")
+	var pacurls stringList
+	flag.Var(&pacurls, "C", "url of proxy auto-config (pac) file; may be repeated to specify "+
+		"fallbacks, which are tried in order")
+	noPAC := flag.Bool("no-pac", false, "don't use a PAC file; route requests using -R rules only")
+	proxies := flag.String("P", "", "upstream proxies to use instead of a PAC file, separated "+
+		"by semicolons (e.g. \"proxy1:8080;proxy2:8080\")")
+	noProxy := flag.String("N", noProxyFromEnv(), "hosts, domains and CIDRs that bypass the "+
+		"-P (or -L proxy=) proxies, separated by commas (defaults to $NO_PROXY; ignored when "+
+		"using a PAC file)")
+	rulesFile := flag.String("R", "", "file containing routing rules, which override the PAC file")
+	pacBypass := flag.String("pac-bypass", "", "hosts, domains and CIDRs that the PAC file "+
+		"served by alpaca sends directly, without going through alpaca, separated by commas")
+	pacFallback := flag.Bool("pac-fallback", false, "make the PAC file served by alpaca fall "+
+		"back to DIRECT when alpaca isn't running")
+	pacWait := flag.Duration("pac-wait", 0, "how long requests wait for the PAC file to be "+
+		"refreshed after a network change (by default, they use the current PAC file)")
+	probeSpec := flag.String("probe", "", "how to check whether you're on the network that a "+
+		"file: PAC URL is for: resolve:HOST, an http(s):// URL, tcp:HOST:PORT or exec:COMMAND "+
+		"(default: assume you're not if Google's DNS servers can be reverse-resolved)")
+	flag.DurationVar(&probeTimeout, "probe-timeout", probeTimeout,
+		"how long to wait for the -probe check")
+	profilesFile := flag.String("profiles", "", "file containing network location profiles, "+
+		"which choose the PAC URL and credentials depending on the network")
+	healthInterval := flag.Duration("health-interval", 0,
+		"how often to check whether upstream proxies are reachable (e.g. 30s; 0 to disable)")
+	healthTimeout := flag.Duration("health-timeout", 5*time.Second,
+		"how long to wait for each proxy health check")
+	healthCanary := flag.String("health-canary", "",
+		"host:port to CONNECT to via each proxy during health checks (default: only connect)")
+	flag.DurationVar(&connectTimeout, "connect-timeout", connectTimeout,
+		"how long to wait when connecting to an upstream proxy or server (0 to wait forever)")
+	flag.DurationVar(&tlsHandshakeTimeout, "tls-handshake-timeout", tlsHandshakeTimeout,
+		"how long to wait for the TLS handshake with an HTTPS proxy (0 to wait forever)")
+	flag.DurationVar(&responseHeaderTimeout, "response-header-timeout", responseHeaderTimeout,
+		"how long to wait for the response headers from an upstream proxy or server "+
+			"(0 to wait forever)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout,
+		"how long a tunnel or keep-alive connection can be idle before it is closed "+
+			"(0 to keep it open forever)")
+	flag.StringVar(&preferIP, "prefer-ip", preferIP,
+		"address family to try first when connecting to dual-stack hosts: 4, 6, or empty to "+
+			"use the order returned by the resolver")
+	flag.DurationVar(&fallbackDelay, "fallback-delay", fallbackDelay,
+		"how long to wait for a connection attempt before also trying the host's next address "+
+			"(0 to only try it after the attempt fails)")
+	var tlsOpts tlsOptions
+	flag.Var((*stringList)(&tlsOpts.caFiles), "tls-ca",
+		"PEM file of CA certificates to trust for HTTPS proxies; may be repeated")
+	flag.Var((*stringList)(&tlsOpts.clientCerts), "tls-client-cert",
+		"client certificate for HTTPS proxies, as [host=]cert.pem[,key.pem]; may be repeated")
+	flag.Var((*stringList)(&tlsOpts.serverNames), "tls-server-name",
+		"server name to send and verify for an HTTPS proxy, as host=name; may be repeated")
+	flag.StringVar(&tlsOpts.minVersion, "tls-min-version", "",
+		"minimum TLS version for HTTPS proxies (1.0, 1.1, 1.2 or 1.3)")
 	domain := flag.String("d", "", "domain of the proxy account (for NTLM auth)")
 	username := flag.String("u", whoAmI(), "username of the proxy account (for NTLM auth)")
 	printHash := flag.Bool("H", false, "print hashed NTLM credentials for non-interactive use")
+	trace := flag.String("pac-trace", "",
+		"log PAC helper calls made while evaluating URLs that match this pattern (e.g. \"*\")")
+	logLevelName := flag.String("log-level", "info", "minimum level of messages to log: debug, "+
+		"info, warn or error")
+	logFormat := flag.String("log-format", "text", "format of log messages: text, json or logfmt")
+	controlPath := flag.String("control", defaultControlPath(), "path of the unix socket that "+
+		"`alpaca ctl` uses to control alpaca (empty to disable)")
 	version := flag.Bool("version", false, "print version number")
 	flag.Parse()
 
@@ -52,20 +183,85 @@ func main() {
 		os.Exit(0)
 	}
 
-	var src credentialSource
-	if *domain != "" {
-		src = fromTerminal().forUser(*domain, *username)
-	} else if value := os.Getenv("NTLM_CREDENTIALS"); value != "" {
-		src = fromEnvVar(value)
-	} else if keyringSupported {
-		src = fromKeyring()
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		fatalf("Invalid -log-level: %v", err)
+	}
+	setLogLevel(level)
+	if err := setLogFormat(*logFormat, os.Stderr); err != nil {
+		fatalf("Invalid -log-format: %v", err)
 	}
+
+	if preferIP != "" && preferIP != "4" && preferIP != "6" {
+		fatalf("Invalid -prefer-ip value %q (must be 4 or 6)", preferIP)
+	}
+
+	if err := configureTLS(tlsOpts); err != nil {
+		fatalf("Invalid TLS options: %v", err)
+	}
+
+	if *trace != "" {
+		g, err := glob.Compile(*trace)
+		if err != nil {
+			fatalf("Invalid -pac-trace pattern %q: %v", *trace, err)
+		}
+		pacTrace = g
+	}
+
+	config := ProxyFinderConfig{
+		PACURLs:        pacurls,
+		NoPAC:          *noPAC,
+		HealthInterval: *healthInterval,
+		HealthTimeout:  *healthTimeout,
+		HealthCanary:   *healthCanary,
+		PACWait:        *pacWait,
+	}
+	if *proxies != "" {
+		list, err := parseProxyFlag(*proxies)
+		if err != nil {
+			fatalf("Invalid -P proxy list %q: %v", *proxies, err)
+		}
+		config.Proxies = list
+	}
+	// The NO_PROXY list only applies to static proxies (from -P or -L proxy=), and is ignored
+	// when using a PAC file (which has its own way of choosing which hosts to connect to
+	// directly). $NO_PROXY is often set for other tools, so it's only worth a warning if -N is
+	// given explicitly (see below).
+	config.NoProxy = parseNoProxy(*noProxy)
+	if *rulesFile != "" {
+		rules, err := loadRules(*rulesFile)
+		if err != nil {
+			fatalf("Error loading rules from %s: %v", *rulesFile, err)
+		}
+		infof("Loaded %d rules from %s", len(rules), *rulesFile)
+		config.Rules = rules
+	}
+	if *probeSpec != "" {
+		p, err := parseProbe(*probeSpec)
+		if err != nil {
+			fatalf("Invalid -probe %q: %v", *probeSpec, err)
+		}
+		config.Probe = p
+	}
+	if *profilesFile != "" {
+		profiles, err := loadProfiles(*profilesFile)
+		if err != nil {
+			fatalf("Error loading profiles from %s: %v", *profilesFile, err)
+		}
+		if config.NoPAC || config.Proxies != "" {
+			warnf("Ignoring -profiles, since -no-pac or -P was given")
+		}
+		infof("Loaded %d profiles from %s", len(profiles), *profilesFile)
+		config.Profiles = profiles
+	}
+
+	src, _ := findCredentialSource(*domain, *username)
 	var a *authenticator
 	if src != nil {
 		var err error
 		a, err = src.getCredentials()
 		if err != nil {
-			log.Printf("Credentials not found, disabling proxy auth: %v", err)
+			warnf("Credentials not found, disabling proxy auth: %v", err)
 		}
 	}
 
@@ -79,17 +275,181 @@ func main() {
 		os.Exit(0)
 	}
 
-	s := createServer(*host, *port, *pacurl, a)
-	log.Printf("Listening on %s", s.Addr)
-	if err := s.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	listeners := []listenerConfig{{host: *host, port: *port, finder: config, auth: a}}
+	for _, value := range listenerFlags {
+		lc, err := parseListenerFlag(value, listeners[0])
+		if err != nil {
+			fatalf("Invalid -L listener %q: %v", value, err)
+		}
+		listeners = append(listeners, lc)
+	}
+	if flagWasSet("N") && !anyStaticProxies(listeners) {
+		warnf("Ignoring -N, since it only applies to the proxies given by -P or " +
+			"-L proxy=")
 	}
+
+	creds := newCredentialStore(a)
+	control := newControlServer(creds)
+	opts := serverOptions{
+		pac:     PACData{Bypass: *pacBypass, Fallback: *pacFallback},
+		creds:   creds,
+		control: control,
+	}
+	if *listenTLS {
+		var err error
+		opts.tls, err = serverTLSConfig(*listenCert, *listenKey, *host)
+		if err != nil {
+			fatalf("Error loading listener certificate: %v", err)
+		}
+	}
+	if *allow != "" || *usersFile != "" {
+		nets, err := parseAllowList(*allow)
+		if err != nil {
+			fatalf("Invalid -allow list %q: %v", *allow, err)
+		}
+		var users map[string][]byte
+		if *usersFile != "" {
+			users, err = loadUsers(*usersFile)
+			if err != nil {
+				fatalf("Error loading users from %s: %v", *usersFile, err)
+			}
+		}
+		opts.access = newAccessControl(nets, users)
+	} else {
+		for _, lc := range listeners {
+			if !isLoopback(lc.host) {
+				warnf("Listening on %s without -allow or -auth-file, so anyone "+
+					"who can connect to alpaca can use your proxy credentials", lc.host)
+				break
+			}
+		}
+	}
+
+	if *accessLogPath != "" {
+		f, err := openRotatingFile(*accessLogPath, int64(*accessLogMaxSize)<<20,
+			*accessLogBackups)
+		if err != nil {
+			fatalf("Error opening access log: %v", err)
+		}
+		opts.accessLog, err = newAccessLog(*accessLogFormat, f)
+		if err != nil {
+			fatalf("Invalid -access-log-format: %v", err)
+		}
+	}
+
+	tracker := newConnTracker()
+	opts.tracker = tracker
+	opts.ids = &contextIDs{}
+	var servers []*http.Server
+	var ls []net.Listener
+	var lservers []*http.Server // the server for each of ls
+	for i, lc := range listeners {
+		s := createServer(lc, opts)
+		servers = append(servers, s)
+		// Socket activation and unix sockets only apply to the default listener.
+		unix := ""
+		if i == 0 {
+			unix = *unixPath
+		}
+		l, err := listen(s.Addr, unix)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		for range l {
+			lservers = append(lservers, s)
+		}
+		ls = append(ls, l...)
+	}
+	if *controlPath != "" {
+		l, err := listenControl(*controlPath)
+		if err != nil {
+			warnf("Alpaca ctl won't work, since the control socket can't be "+
+				"created: %v", err)
+		} else {
+			s := &http.Server{Handler: control.handler()}
+			go s.Serve(l) //nolint:errcheck
+			// The control socket is closed (and removed) when alpaca shuts down.
+			servers = append(servers, s)
+		}
+	}
+	errs := make(chan error, len(ls))
+	for i, l := range ls {
+		s := lservers[i]
+		if s.TLSConfig != nil {
+			infof("Listening on %s (HTTPS)", l.Addr())
+		} else {
+			infof("Listening on %s", l.Addr())
+		}
+		go func(s *http.Server, l net.Listener) { errs <- serve(s, l) }(s, l)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		warnf("Error notifying systemd: %v", err)
+	}
+	go sdWatchdog()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		_ = sdNotify("STOPPING=1")
+		fatalf("%v", err)
+	case sig := <-sigs:
+		// Let a second signal kill alpaca straight away, rather than waiting for shutdown.
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		infof("Received %v, shutting down", sig)
+		_ = sdNotify("STOPPING=1")
+		shutdown(servers, tracker, *shutdownTimeout)
+		// The access log is closed once the servers have drained, so that the requests that
+		// were in progress are still logged.
+		if err := opts.accessLog.Close(); err != nil {
+			warnf("Error closing access log: %v", err)
+		}
+	}
+}
+
+// serverOptions configure how alpaca accepts connections from clients.
+type serverOptions struct {
+	tls    *tls.Config    // if set, clients connect to alpaca using HTTPS
+	access *accessControl // if set, restricts which clients can use alpaca
+	// tracker, if set, keeps track of the requests and tunnels that are in progress
+	tracker *connTracker
+	// ids, if set, assigns IDs to requests (so that they're unique across listeners)
+	ids *contextIDs
+	// pac sets the bypass list and fallback for the PAC file that alpaca serves (the address
+	// comes from the listener)
+	pac PACData
+	// creds, if set, holds the default credentials (for listeners that don't have their own),
+	// so that they can be changed by alpaca ctl
+	creds *credentialStore
+	// control, if set, is told about each listener, so that alpaca ctl can control it
+	control *controlServer
+	// accessLog, if set, is written to for each request
+	accessLog *accessLog
 }
 
-func createServer(host string, port int, pacurl string, a *authenticator) *http.Server {
-	pacWrapper := NewPACWrapper(PACData{Port: port})
-	proxyFinder := NewProxyFinder(pacurl, pacWrapper)
-	proxyHandler := NewProxyHandler(a, getProxyFromContext, proxyFinder.blockProxy)
+// isLoopback reports whether host (as given to the -l flag) only accepts local connections.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func createServer(lc listenerConfig, opts serverOptions) *http.Server {
+	pacData := opts.pac
+	pacData.Host, pacData.Port, pacData.TLS = lc.host, lc.port, opts.tls != nil
+	if lc.host == "" {
+		// An empty host means that we're listening on all addresses.
+		pacData.Host = "::"
+	}
+	pacWrapper := NewPACWrapper(pacData)
+	proxyFinder := NewProxyFinder(lc.finder, pacWrapper)
+	proxyHandler := NewProxyHandler(lc.auth, getProxyFromContext, proxyFinder.reportProxy)
+	proxyHandler.tunnels = opts.tracker
+	if !lc.ownAuth {
+		proxyHandler.creds = opts.creds
+	}
+	opts.control.add(lc.addr(), opts.tls != nil, proxyFinder)
 	mux := http.NewServeMux()
 	pacWrapper.SetupHandlers(mux)
 
@@ -98,14 +458,38 @@ func createServer(host string, port int, pacurl string, a *authenticator) *http.
 	handler = RequestLogger(handler)
 	handler = proxyHandler.WrapHandler(handler)
 	handler = proxyFinder.WrapHandler(handler)
-	handler = AddContextID(handler)
+	if opts.access != nil {
+		handler = opts.access.WrapHandler(handler)
+	}
+	if opts.accessLog != nil {
+		handler = opts.accessLog.WrapHandler(handler)
+	}
+	if opts.ids == nil {
+		opts.ids = &contextIDs{}
+	}
+	handler = opts.ids.WrapHandler(handler)
 
-	return &http.Server{
+	s := &http.Server{
 		// Set the addr to host(defaults to localhost) : port(defaults to 3128)
-		Addr:    net.JoinHostPort(host, strconv.Itoa(port)),
-		Handler: handler,
+		Addr:      lc.addr(),
+		Handler:   handler,
+		TLSConfig: opts.tls,
 		// TODO: Implement HTTP/2 support. In the meantime, set TLSNextProto to a non-nil
 		// value to disable HTTP/2.
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
+	if opts.tracker != nil {
+		s.ConnState = opts.tracker.connState
+	}
+	s.RegisterOnShutdown(proxyFinder.stop)
+	return s
+}
+
+// closeServer closes a server created by createServer immediately (like http.Server.Close), but
+// also stops its background goroutines, which only http.Server.Shutdown does.
+func closeServer(s *http.Server) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx) //nolint:errcheck
+	return s.Close()
 }
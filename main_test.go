@@ -1,4 +1,4 @@
-// Copyright 2022 The Alpaca Authors
+// Copyright 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -190,9 +190,13 @@ func TestWithSquid(t *testing.T) {
 	// Run (most of) Alpaca in a goroutine.
 	port, err := strconv.Atoi(findAvailablePort(t))
 	require.NoError(t, err)
-	alpaca := createServer(port, pacServer.URL, nil)
+	alpaca := createServer(listenerConfig{
+		host:   "localhost",
+		port:   port,
+		finder: ProxyFinderConfig{PACURLs: []string{pacServer.URL}},
+	}, serverOptions{})
 	go alpaca.ListenAndServe()
-	defer alpaca.Close()
+	defer closeServer(alpaca)
 	waitForServer(alpaca.Addr)
 	t.Logf("alpaca is listening on port %d", port)
 
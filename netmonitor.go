@@ -1,4 +1,4 @@
-// Copyright 2019, 2021 The Alpaca Authors
+// Copyright 2019, 2021, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -15,10 +15,15 @@
 package main
 
 import (
-	"log"
+	"errors"
 	"net"
+	"runtime"
 )
 
+// errNetworkChangesUnsupported is returned by notifyNetworkChanges on platforms where alpaca
+// can't be notified of network changes.
+var errNetworkChangesUnsupported = errors.New("network change notifications not supported")
+
 type netMonitor interface {
 	addrsChanged() bool
 }
@@ -26,24 +31,42 @@ type netMonitor interface {
 type netMonitorImpl struct {
 	addrs    map[string]struct{}
 	getAddrs func() ([]net.Addr, error)
+	// The default gateways are also compared, since a route can change (e.g. when a VPN
+	// connects) without any of the addresses changing.
+	gateways    map[string]struct{}
+	getGateways func() ([]net.IP, error) // may be nil
 }
 
 func newNetMonitor() *netMonitorImpl {
-	return &netMonitorImpl{getAddrs: net.InterfaceAddrs}
+	nm := &netMonitorImpl{getAddrs: net.InterfaceAddrs}
+	// On Linux, netlink reports route changes, and the gateways are read from /proc. Elsewhere,
+	// the monitor is checked on every request, and finding the gateways means running a
+	// command, which is too slow to do that often.
+	if runtime.GOOS == "linux" {
+		nm.getGateways = defaultGateways
+	}
+	return nm
 }
 
+// addrsChanged reports whether the network interface addresses or the default gateways have
+// changed since it was last called.
 func (nm *netMonitorImpl) addrsChanged() bool {
 	addrs, err := nm.getAddrs()
 	if err != nil {
-		log.Printf("Error while getting network interface addresses: %q", err)
+		logWith("error", err).Errorf("Error while getting network interface addresses: %q", err)
 		return false
 	}
-	set := addrSliceToSet(addrs)
-	if setsAreEqual(set, nm.addrs) {
+	var gateways []net.IP
+	if nm.getGateways != nil {
+		// On platforms where the gateways can't be found, only the addresses are compared.
+		gateways, _ = nm.getGateways()
+	}
+	addrSet, gatewaySet := addrSliceToSet(addrs), ipSliceToSet(gateways)
+	if setsAreEqual(addrSet, nm.addrs) && setsAreEqual(gatewaySet, nm.gateways) {
 		return false
 	} else {
-		log.Printf("Network changes detected: %v", addrs)
-		nm.addrs = set
+		infof("Network changes detected: %v (gateways: %v)", addrs, gateways)
+		nm.addrs, nm.gateways = addrSet, gatewaySet
 		return true
 	}
 }
@@ -56,6 +79,14 @@ func addrSliceToSet(slice []net.Addr) map[string]struct{} {
 	return set
 }
 
+func ipSliceToSet(slice []net.IP) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, ip := range slice {
+		set[ip.String()] = struct{}{}
+	}
+	return set
+}
+
 func setsAreEqual(a, b map[string]struct{}) bool {
 	if len(a) != len(b) {
 		return false
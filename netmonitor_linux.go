@@ -0,0 +1,101 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// The netlink multicast groups for changes to addresses and routes (from linux/rtnetlink.h, since
+// the syscall package doesn't define them).
+const (
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+
+	netlinkGroups = rtmgrpIPv4IfAddr | rtmgrpIPv4Route | rtmgrpIPv6IfAddr | rtmgrpIPv6Route
+)
+
+// notifyNetworkChanges sends to the channel whenever an address or route is added or removed, by
+// listening for netlink (rtnetlink(7)) messages. Sends don't block, so changes that happen while
+// the receiver is busy are coalesced. If reading from the socket fails, failed is called and no
+// more changes are sent. Closing the returned io.Closer stops listening.
+func notifyNetworkChanges(changes chan<- struct{}, failed func()) (io.Closer, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: netlinkGroups}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// Since the socket is non-blocking, reads go through the runtime's poller, which means that
+	// closing the file interrupts a read that's waiting for a message.
+	f := os.NewFile(uintptr(fd), "netlink")
+	go readNetworkChanges(f, changes, failed)
+	return f, nil
+}
+
+// readNetworkChanges reads netlink messages until the reader is closed, sending to the channel
+// whenever one of them is a change to an address or route.
+func readNetworkChanges(r io.Reader, changes chan<- struct{}, failed func()) {
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, err := r.Read(buf)
+		if errors.Is(err, syscall.ENOBUFS) {
+			// The socket's buffer overflowed, so some messages were lost; assume that the
+			// network has changed.
+		} else if errors.Is(err, os.ErrClosed) {
+			return
+		} else if err != nil {
+			warnf("Error reading network changes from netlink, will check on each request: %v",
+				err)
+			failed()
+			return
+		} else if !netlinkChanged(buf[:n]) {
+			continue
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// netlinkChanged reports whether a netlink message contains any changes to addresses or routes.
+func netlinkChanged(buf []byte) bool {
+	msgs, err := syscall.ParseNetlinkMessage(buf)
+	if err != nil {
+		warnf("Error parsing netlink message: %v", err)
+		return true
+	}
+	for _, msg := range msgs {
+		switch msg.Header.Type {
+		case syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_NEWROUTE,
+			syscall.RTM_DELROUTE:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// netlinkMessage returns a netlink message with the given type and an empty body.
+func netlinkMessage(typ uint16) []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN)
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.LittleEndian.PutUint16(b[4:6], typ)
+	return b
+}
+
+func TestNetlinkChanged(t *testing.T) {
+	tests := []struct {
+		name     string
+		types    []uint16
+		expected bool
+	}{
+		{"NewAddr", []uint16{syscall.RTM_NEWADDR}, true},
+		{"DelAddr", []uint16{syscall.RTM_DELADDR}, true},
+		{"NewRoute", []uint16{syscall.RTM_NEWROUTE}, true},
+		{"DelRoute", []uint16{syscall.RTM_DELROUTE}, true},
+		{"NewLink", []uint16{syscall.RTM_NEWLINK}, false},
+		{"Multiple", []uint16{syscall.RTM_NEWLINK, syscall.RTM_DELROUTE}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf []byte
+			for _, typ := range test.types {
+				buf = append(buf, netlinkMessage(typ)...)
+			}
+			assert.Equal(t, test.expected, netlinkChanged(buf))
+		})
+	}
+}
+
+func TestNetlinkChangedInvalidMessage(t *testing.T) {
+	// If a message can't be parsed, assume that something has changed.
+	buf := netlinkMessage(syscall.RTM_NEWLINK)
+	binary.LittleEndian.PutUint32(buf[0:4], 100)
+	assert.True(t, netlinkChanged(buf))
+}
+
+// netlinkReader returns each of its messages in turn, followed by its error.
+type netlinkReader struct {
+	msgs [][]byte
+	err  error
+}
+
+func (r *netlinkReader) Read(p []byte) (int, error) {
+	if len(r.msgs) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.msgs[0])
+	r.msgs = r.msgs[1:]
+	return n, nil
+}
+
+func TestReadNetworkChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		failed bool
+	}{
+		{"Closed", &os.PathError{Op: "read", Path: "netlink", Err: os.ErrClosed}, false},
+		{"Error", &os.PathError{Op: "read", Path: "netlink", Err: syscall.EBADF}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msgs := [][]byte{netlinkMessage(syscall.RTM_NEWADDR)}
+			r := &netlinkReader{msgs: msgs, err: test.err}
+			changes := make(chan struct{}, 1)
+			failed := false
+			readNetworkChanges(r, changes, func() { failed = true })
+			assert.Len(t, changes, 1)
+			assert.Equal(t, test.failed, failed)
+		})
+	}
+}
+
+func TestNotifyNetworkChangesClose(t *testing.T) {
+	changes := make(chan struct{}, 1)
+	failed := make(chan struct{})
+	netlink, err := notifyNetworkChanges(changes, func() { close(failed) })
+	require.NoError(t, err)
+	require.NoError(t, netlink.Close())
+	// Closing stops the reader, which isn't treated as a failure.
+	select {
+	case <-failed:
+		assert.Fail(t, "closing the netlink socket was treated as a failure")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.True(t, errors.Is(netlink.Close(), os.ErrClosed))
+}
@@ -1,4 +1,4 @@
-// Copyright 2019 The Alpaca Authors
+// Copyright 2019, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -60,6 +60,25 @@ func TestNetworkMonitor(t *testing.T) {
 	assert.True(t, nm.addrsChanged())
 }
 
+func TestNetworkMonitorGatewayChanges(t *testing.T) {
+	addrs := toAddrs("127.0.0.1/8", "192.168.1.6/24")
+	gateways := []net.IP{net.ParseIP("192.168.1.1")}
+	nm := &netMonitorImpl{
+		getAddrs:    func() ([]net.Addr, error) { return addrs, nil },
+		getGateways: func() ([]net.IP, error) { return gateways, nil },
+	}
+	assert.True(t, nm.addrsChanged())
+	assert.False(t, nm.addrsChanged())
+	// A new default route (e.g. from a VPN) is a change, even though the addresses are the same.
+	gateways = []net.IP{net.ParseIP("10.8.0.1")}
+	assert.True(t, nm.addrsChanged())
+	assert.False(t, nm.addrsChanged())
+	// If the gateways can't be found, only the addresses are compared.
+	nm.getGateways = func() ([]net.IP, error) { return nil, errors.New("unsupported") }
+	assert.True(t, nm.addrsChanged())
+	assert.False(t, nm.addrsChanged())
+}
+
 func TestFailToGetAddrs(t *testing.T) {
 	alwaysFail := func() ([]net.Addr, error) { return nil, errors.New("failed") }
 	nm := &netMonitorImpl{getAddrs: alwaysFail}
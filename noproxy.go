@@ -0,0 +1,104 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// noProxyList is a list of hosts that should be connected to directly rather than via the
+// upstream proxies, in the format of the NO_PROXY environment variable: a comma-separated list of
+// domain names (which also match their subdomains), IP addresses, CIDR blocks, or "*" to match
+// everything. Domains and IP addresses may have a port, in which case only that port matches.
+type noProxyList struct {
+	all     bool
+	entries []noProxyEntry
+}
+
+type noProxyEntry struct {
+	cidr   *net.IPNet
+	ip     net.IP
+	domain string
+	port   string
+}
+
+func parseNoProxy(value string) *noProxyList {
+	np := &noProxyList{}
+	for _, s := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		if s == "*" {
+			np.all = true
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(s); err == nil {
+			np.entries = append(np.entries, noProxyEntry{cidr: cidr})
+			continue
+		}
+		var entry noProxyEntry
+		if host, port, err := net.SplitHostPort(s); err == nil {
+			s, entry.port = host, port
+		}
+		if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+			entry.ip = ip
+		} else {
+			// Leading "*." or "." prefixes are commonly used to mean "this domain and its
+			// subdomains", which is what we do for all domains anyway.
+			s = strings.TrimPrefix(s, "*")
+			entry.domain = strings.ToLower(strings.TrimPrefix(s, "."))
+		}
+		np.entries = append(np.entries, entry)
+	}
+	return np
+}
+
+// match reports whether the given URL should bypass the upstream proxies.
+func (np *noProxyList) match(u *url.URL) bool {
+	if np == nil {
+		return false
+	} else if np.all {
+		return true
+	}
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[scheme]
+	}
+	ip := net.ParseIP(host)
+	for _, entry := range np.entries {
+		if entry.port != "" && entry.port != port {
+			continue
+		}
+		switch {
+		case entry.cidr != nil:
+			if ip != nil && entry.cidr.Contains(ip) {
+				return true
+			}
+		case entry.ip != nil:
+			if entry.ip.Equal(ip) {
+				return true
+			}
+		case host == entry.domain || strings.HasSuffix(host, "."+entry.domain):
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoProxy(t *testing.T) {
+	np := parseNoProxy("localhost, .corp.test,*.lab.test,10.0.0.0/8,192.0.2.1, build.test:8080,[::1]")
+	tests := []struct {
+		url      string
+		expected bool
+	}{
+		{"http://localhost/", true},
+		{"http://corp.test/", true},
+		{"http://www.corp.test/", true},
+		{"https://WWW.CORP.TEST/", true},
+		{"http://notcorp.test/", false},
+		{"http://host.lab.test/", true},
+		{"http://10.1.2.3/", true},
+		{"//10.1.2.3:443", true},
+		{"http://11.1.2.3/", false},
+		{"http://192.0.2.1/", true},
+		{"http://192.0.2.2/", false},
+		{"http://build.test:8080/", true},
+		{"http://build.test/", false},
+		{"http://[::1]:3128/", true},
+		{"http://www.test/", false},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, np.match(u))
+		})
+	}
+}
+
+func TestNoProxyWildcard(t *testing.T) {
+	u, err := url.Parse("http://www.test/")
+	require.NoError(t, err)
+	assert.True(t, parseNoProxy("*").match(u))
+	assert.False(t, parseNoProxy("").match(u))
+	var np *noProxyList
+	assert.False(t, np.match(u))
+}
@@ -1,4 +1,4 @@
-// Copyright 2019, 2021, 2022 The Alpaca Authors
+// Copyright 2019, 2021, 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -19,11 +19,11 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,11 +35,21 @@ const maxResponseBytes = 1 * 1024 * 1024
 var delayAfterFailedDownload = 2 * time.Second
 
 type pacFetcher struct {
-	pacurl     string
+	pacurls    []string
 	monitor    netMonitor
 	client     *http.Client
 	lookupAddr func(context.Context, string) ([]string, error)
-	connected  bool
+	probe      *probe // if set, used to check whether we're connected, for file: PAC URLs
+	// profiles, if set, are matched against the network to decide which PAC URL to use
+	profiles    []*profile
+	networkInfo func() networkInfo
+	reachable   func(string) bool
+	// connected, profile and source are guarded by mux, since they're read while a download is
+	// in progress
+	connected bool
+	profile   *profile // the profile that matched the network (if any)
+	source    string   // the PAC URL that was most recently downloaded successfully
+	mux       sync.Mutex
 	//cache  []byte
 	//modified time.Time
 	//fetched time.Time
@@ -47,27 +57,32 @@ type pacFetcher struct {
 	//etag     string
 }
 
-func newPACFetcher(pacurl string) *pacFetcher {
-	client := &http.Client{Timeout: 30 * time.Second}
-	if strings.HasPrefix(pacurl, "file:") {
-		log.Printf("Warning: Alpaca supports file:// PAC URLs, but Windows and macOS don't")
-		if runtime.GOOS == "windows" {
-			client.Transport = http.NewFileTransport(http.Dir("C:"))
-		} else {
-			client.Transport = http.NewFileTransport(http.Dir("/"))
-		}
+// newPACFetcher returns a pacFetcher that tries each of the given PAC URLs in order, using the
+// first one that can be downloaded. If no URLs are given, the system's PAC URL is used instead.
+func newPACFetcher(pacurls ...string) *pacFetcher {
+	// The DefaultClient in net/http uses the proxy specified in the http(s)_proxy environment
+	// variable, which could be pointing at this instance of alpaca. When fetching the PAC
+	// file, we always use a client that goes directly to the server, rather than via a proxy.
+	tr := &http.Transport{Proxy: nil}
+	if runtime.GOOS == "windows" {
+		tr.RegisterProtocol("file", http.NewFileTransport(http.Dir("C:")))
 	} else {
-		// The DefaultClient in net/http uses the proxy specified in the http(s)_proxy
-		// environment variable, which could be pointing at this instance of alpaca. When
-		// fetching the PAC file, we always use a client that goes directly to the server,
-		// rather than via a proxy.
-		client.Transport = &http.Transport{Proxy: nil}
+		tr.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	}
+	for _, pacurl := range pacurls {
+		if strings.HasPrefix(pacurl, "file:") {
+			warnf("Alpaca supports file:// PAC URLs, but Windows and macOS don't")
+			break
+		}
 	}
+	client := &http.Client{Transport: tr, Timeout: 30 * time.Second}
 	return &pacFetcher{
-		pacurl:     pacurl,
-		monitor:    newNetMonitor(),
-		client:     client,
-		lookupAddr: net.DefaultResolver.LookupAddr,
+		pacurls:     pacurls,
+		monitor:     newNetMonitor(),
+		client:      client,
+		lookupAddr:  net.DefaultResolver.LookupAddr,
+		networkInfo: getNetworkInfo,
+		reachable:   func(canary string) bool { return reachable(client, canary) },
 	}
 }
 
@@ -86,63 +101,154 @@ func (pf *pacFetcher) download() []byte {
 	if !pf.monitor.addrsChanged() {
 		return nil
 	}
-	pf.connected = false
-	pacurl := pf.pacurl
-	if pacurl == "" {
-		var err error
-		pacurl, err = findPACURL()
+	return pf.refresh()
+}
+
+// refresh downloads the PAC script after a network change, and updates whether we're connected
+// to the network that it's for.
+func (pf *pacFetcher) refresh() []byte {
+	p := pf.locate()
+	source, pacjs, connected := pf.downloadPAC(p)
+	pf.mux.Lock()
+	defer pf.mux.Unlock()
+	pf.connected = connected
+	pf.profile = p
+	pf.source = source
+	return pacjs
+}
+
+// locate returns the first profile that matches the network, or nil if there are no profiles
+// (or none of them match).
+func (pf *pacFetcher) locate() *profile {
+	if len(pf.profiles) == 0 {
+		return nil
+	}
+	p := matchProfile(pf.profiles, pf.networkInfo(), pf.reachable)
+	if p == nil {
+		infof("No network profile matches; using the default settings")
+	} else {
+		logWith("profile", p.name).Infof("Using network profile %q", p.name)
+	}
+	return p
+}
+
+// downloadPAC downloads the PAC script (after a network change), and returns the URL that it
+// was downloaded from, along with whether we're connected to the network that it's for. If a
+// profile matched the network, its settings are used instead of the default PAC URLs.
+func (pf *pacFetcher) downloadPAC(p *profile) (string, []byte, bool) {
+	pacurls := pf.pacurls
+	if p != nil && p.direct {
+		logWith("profile", p.name).
+			Infof("Network profile %q is direct; all requests will be made directly", p.name)
+		return "", nil, false
+	} else if p != nil && p.pacurls != nil {
+		pacurls = p.pacurls
+	}
+	if len(pacurls) == 0 {
+		pacurl, err := findPACURL()
 		if err != nil {
-			log.Printf("Error while trying to detect PAC URL: %v", err)
-			return nil
+			logWith("error", err).Errorf("Error while trying to detect PAC URL: %v", err)
+			return "", nil, false
 		} else if pacurl == "" {
-			log.Println("No PAC URL specified or detected; all requests will be made directly")
-			return nil
+			infof("No PAC URL specified or detected; all requests will be made directly")
+			return "", nil, false
 		}
+		pacurls = []string{pacurl}
 	}
-	log.Printf("Attempting to download PAC from %s", pacurl)
-	resp, err := requireOK(pf.client.Get(pacurl))
-	if err != nil {
+	pacurl, pacjs := pf.fetchFirst(pacurls)
+	if pacjs == nil {
 		// Sometimes, if we try to download too soon after a network change, the PAC
 		// download can fail. See https://github.com/samuong/alpaca/issues/8 for details.
-		log.Printf("Error downloading PAC file, will retry after %v: %q",
-			delayAfterFailedDownload, err)
+		warnf("Error downloading PAC file, will retry after %v", delayAfterFailedDownload)
 		time.Sleep(delayAfterFailedDownload)
-		if resp, err = requireOK(pf.client.Get(pacurl)); err != nil {
-			log.Printf("Error downloading PAC file, giving up: %q", err)
-			return nil
+		if pacurl, pacjs = pf.fetchFirst(pacurls); pacjs == nil {
+			errorf("Error downloading PAC file, giving up")
+			return "", nil, false
 		}
 	}
+	logWith("pacurl", pacurl).Infof("Downloaded PAC from %s", pacurl)
+	if p == nil && strings.HasPrefix(pacurl, "file:") {
+		// When using a local PAC file the online/offline status can't be determined by the
+		// fact that the PAC file is returned, so it's checked using a probe instead. (This
+		// isn't needed if a profile has already told us where we are.)
+		return pacurl, pacjs, pf.probeConnected()
+	}
+	return pacurl, pacjs, true
+}
+
+// probeConnected reports whether we're connected to the network that a local PAC file is for,
+// using the probe (if there is one). Otherwise, it tries reverse DNS resolution of Google's
+// Public DNS Servers, and assumes that we're not connected if that succeeds.
+func (pf *pacFetcher) probeConnected() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if pf.probe != nil {
+		if err := pf.probe.check(ctx); err != nil {
+			logWith("error", err).
+				Infof("Connectivity probe %s failed (%v); bypassing proxy", pf.probe, err)
+			return false
+		}
+		infof("Connectivity probe %s succeeded", pf.probe)
+		return true
+	}
+	_, err1 := pf.lookupAddr(ctx, "8.8.8.8")
+	_, err2 := pf.lookupAddr(ctx, "2001:4860:4860::8888")
+	if err1 == nil || err2 == nil {
+		infof("Successfully resolved public address; bypassing proxy")
+		return false
+	}
+	return true
+}
+
+// fetchFirst tries to fetch each of the given PAC URLs in order, and returns the first one that
+// succeeds along with its contents. If none of them succeed, the returned PAC JS is nil.
+func (pf *pacFetcher) fetchFirst(pacurls []string) (string, []byte) {
+	for _, pacurl := range pacurls {
+		logWith("pacurl", pacurl).Debugf("Attempting to download PAC from %s", pacurl)
+		pacjs, err := pf.fetch(pacurl)
+		if err != nil {
+			logWith("pacurl", pacurl, "error", err).Warnf("Error downloading PAC from %s: %q", pacurl, err)
+			continue
+		}
+		return pacurl, pacjs
+	}
+	return "", nil
+}
+
+func (pf *pacFetcher) fetch(pacurl string) ([]byte, error) {
+	resp, err := requireOK(pf.client.Get(pacurl))
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 	var buf bytes.Buffer
 	_, err = io.CopyN(&buf, resp.Body, maxResponseBytes)
 	if err == io.EOF {
-		if strings.HasPrefix(pf.pacurl, "file:") {
-			// When using a local PAC file the online/offline status can't be determined
-			// by the fact that the PAC file is returned. Instead try reverse DNS
-			// resolution of Google's Public DNS Servers.
-			const timeout = 2 * time.Second
-			ctx, cancel := context.WithTimeout(context.TODO(), timeout)
-			defer cancel()
-			_, err1 := pf.lookupAddr(ctx, "8.8.8.8")
-			_, err2 := pf.lookupAddr(ctx, "2001:4860:4860::8888")
-			if err1 == nil || err2 == nil {
-				log.Printf("Successfully resolved public address; bypassing proxy")
-			} else {
-				pf.connected = true
-			}
-		} else {
-			pf.connected = true
-		}
-		return buf.Bytes()
+		return buf.Bytes(), nil
 	} else if err != nil {
-		log.Printf("Error reading PAC JS from response body: %q", err)
-		return nil
+		return nil, fmt.Errorf("error reading PAC JS from response body: %w", err)
 	} else {
-		log.Printf("PAC JS is too big (limit is %d bytes)", maxResponseBytes)
-		return nil
+		return nil, fmt.Errorf("PAC JS is too big (limit is %d bytes)", maxResponseBytes)
 	}
 }
 
+// activeProfile returns the profile that matched the network (if any) when the PAC file was last
+// downloaded.
+func (pf *pacFetcher) activeProfile() *profile {
+	pf.mux.Lock()
+	defer pf.mux.Unlock()
+	return pf.profile
+}
+
+// pacSource returns the URL that the current PAC script was downloaded from (if any).
+func (pf *pacFetcher) pacSource() string {
+	pf.mux.Lock()
+	defer pf.mux.Unlock()
+	return pf.source
+}
+
 func (pf *pacFetcher) isConnected() bool {
+	pf.mux.Lock()
+	defer pf.mux.Unlock()
 	return pf.connected
 }
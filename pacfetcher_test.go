@@ -1,4 +1,4 @@
-// Copyright 2019, 2021, 2022 The Alpaca Authors
+// Copyright 2019, 2021, 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -104,11 +104,43 @@ func TestDownloadWithNetworkChanges(t *testing.T) {
 	s2 := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script 2")))
 	defer s2.Close()
 	nm.changed = true
-	pf.pacurl = s2.URL
+	pf.pacurls = []string{s2.URL}
 	assert.Equal(t, []byte("test script 2"), pf.download())
 	assert.True(t, pf.isConnected())
 }
 
+func TestDownloadFailover(t *testing.T) {
+	s1 := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script 1")))
+	s1.Close()
+	s2 := httptest.NewServer(http.NotFoundHandler())
+	defer s2.Close()
+	s3 := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script 3")))
+	defer s3.Close()
+	s4 := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script 4")))
+	defer s4.Close()
+	pf := newPACFetcher(s1.URL, s2.URL, s3.URL, s4.URL)
+	assert.Equal(t, []byte("test script 3"), pf.download())
+	assert.True(t, pf.isConnected())
+	assert.Equal(t, s3.URL, pf.source)
+}
+
+func TestDownloadFailoverToFile(t *testing.T) {
+	content := []byte(`function FindProxyForURL(url, host) { return "DIRECT" }`)
+	tempdir, err := os.MkdirTemp("", "alpaca")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	pacPath := path.Join(tempdir, "test.pac")
+	require.NoError(t, os.WriteFile(pacPath, content, 0644))
+	pacURL := &url.URL{Scheme: "file", Path: filepath.ToSlash(pacPath)}
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	pf := newPACFetcher(server.URL, pacURL.String())
+	pf.lookupAddr = testNetwork{true}.LookupAddr
+	assert.Equal(t, content, pf.download())
+	assert.True(t, pf.isConnected())
+	assert.Equal(t, pacURL.String(), pf.source)
+}
+
 func TestResponseLimit(t *testing.T) {
 	bigscript := strings.Repeat("x", 2*1024*1024) // 2 MB
 	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(bigscript)))
@@ -164,3 +196,63 @@ func TestPacFromFilesystem(t *testing.T) {
 	assert.Equal(t, content, pf.download())
 	assert.True(t, pf.isConnected())
 }
+
+func TestDownloadWithProfiles(t *testing.T) {
+	office := httptest.NewServer(http.HandlerFunc(pacjsHandler("office script")))
+	defer office.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(pacjsHandler("default script")))
+	defer fallback.Close()
+	profiles, err := parseProfiles(strings.NewReader(fmt.Sprintf(`
+		office  domain=corp.test  pac=%s
+		home    domain=home.test  direct
+	`, office.URL)))
+	require.NoError(t, err)
+	nm := &fakeNetMonitor{}
+	var info networkInfo
+	pf := newPACFetcher(fallback.URL)
+	pf.monitor = nm
+	pf.profiles = profiles
+	pf.networkInfo = func() networkInfo { return info }
+	// At the office, the profile's PAC URL is used.
+	info.domains, nm.changed = []string{"corp.test"}, true
+	assert.Equal(t, []byte("office script"), pf.download())
+	assert.True(t, pf.isConnected())
+	assert.Equal(t, "office", pf.activeProfile().name)
+	// At home, requests are made directly without downloading a PAC file.
+	info.domains, nm.changed = []string{"home.test"}, true
+	assert.Nil(t, pf.download())
+	assert.False(t, pf.isConnected())
+	assert.Equal(t, "home", pf.activeProfile().name)
+	// Elsewhere, no profile matches, so the default PAC URL is used.
+	info.domains, nm.changed = []string{"cafe.test"}, true
+	assert.Equal(t, []byte("default script"), pf.download())
+	assert.True(t, pf.isConnected())
+	assert.Nil(t, pf.activeProfile())
+}
+
+func TestPacFromFilesystemWithProbe(t *testing.T) {
+	content := []byte(`function FindProxyForURL(url, host) { return "DIRECT" }`)
+	pacPath := filepath.Join(t.TempDir(), "test.pac")
+	require.NoError(t, os.WriteFile(pacPath, content, 0644))
+	pacURL := &url.URL{Scheme: "file", Path: filepath.ToSlash(pacPath)}
+	connected := false
+	nm := &fakeNetMonitor{}
+	pf := newPACFetcher(pacURL.String())
+	pf.monitor = nm
+	pf.probe = &probe{spec: "test", check: func(ctx context.Context) error {
+		if !connected {
+			return fmt.Errorf("not connected")
+		}
+		return nil
+	}}
+	pf.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		t.Fatal("the probe should be used instead of reverse DNS")
+		return nil, nil
+	}
+	nm.changed = true
+	assert.Equal(t, content, pf.download())
+	assert.False(t, pf.isConnected())
+	connected, nm.changed = true, true
+	assert.Equal(t, content, pf.download())
+	assert.True(t, pf.isConnected())
+}
@@ -1,4 +1,4 @@
-// Copyright 2019, 2021 The Alpaca Authors
+// Copyright 2019, 2021, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -18,7 +18,6 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"os/exec"
 	"strings"
 )
@@ -49,7 +48,7 @@ func findPACURL() (string, error) {
 		networkService := strings.TrimSuffix(strings.TrimPrefix(line, "(*)"), "\n")
 		url, err := getAutoProxyURL(networkService)
 		if err != nil {
-			log.Printf("Error getting auto proxy URL for %v: %v", networkService, err)
+			warnf("Error getting auto proxy URL for %v: %v", networkService, err)
 			continue
 		} else if url == "(null)" {
 			continue
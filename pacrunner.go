@@ -1,4 +1,4 @@
-// Copyright 2019 The Alpaca Authors
+// Copyright 2019, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -18,7 +18,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,8 +31,16 @@ import (
 
 // https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_(PAC)_file
 
+// pacTrace selects the URLs for which calls to PAC helper functions are logged, so that it's
+// possible to see why FindProxyForURL returned what it did. It is set using the -pac-trace flag.
+var pacTrace glob.Glob
+
 type PACRunner struct {
 	vm *otto.Otto
+	// The ID of the request currently being evaluated (if any), and whether it is being traced.
+	// These are only valid while the mutex is held.
+	id      interface{}
+	tracing bool
 	sync.Mutex
 }
 
@@ -41,8 +51,9 @@ func (pr *PACRunner) Update(pacjs []byte) error {
 		if err != nil {
 			return
 		}
-		err = vm.Set(name, handler)
+		err = vm.Set(name, pr.traced(name, handler))
 	}
+	set("alert", pr.alert)
 	set("isPlainHostName", isPlainHostName)
 	set("dnsDomainIs", dnsDomainIs)
 	set("localHostOrDomainIs", localHostOrDomainIs)
@@ -65,6 +76,9 @@ func (pr *PACRunner) Update(pacjs []byte) error {
 	if err != nil {
 		return err
 	}
+	pr.Lock()
+	defer pr.Unlock()
+	pr.id, pr.tracing = nil, false
 	_, err = vm.Run(pacjs)
 	if err != nil {
 		return err
@@ -74,6 +88,16 @@ func (pr *PACRunner) Update(pacjs []byte) error {
 }
 
 func (pr *PACRunner) FindProxyForURL(u url.URL) (string, error) {
+	return pr.findProxyForURL(u, nil)
+}
+
+// FindProxyForRequest is like FindProxyForURL, but any messages logged while evaluating the PAC
+// script (from alert() or from tracing) are tagged with the ID of the request.
+func (pr *PACRunner) FindProxyForRequest(req *http.Request) (string, error) {
+	return pr.findProxyForURL(*req.URL, req.Context().Value(contextKeyID))
+}
+
+func (pr *PACRunner) findProxyForURL(u url.URL, id interface{}) (string, error) {
 	pr.Lock()
 	defer pr.Unlock()
 	if u.Scheme == "" {
@@ -92,15 +116,70 @@ func (pr *PACRunner) FindProxyForURL(u url.URL) (string, error) {
 		u.RawQuery = ""
 		u.Fragment = ""
 	}
+	if pr.vm == nil {
+		return "", errors.New("no PAC script has been loaded")
+	}
+	pr.id = id
+	pr.tracing = pacTrace != nil && pacTrace.Match(u.String())
 	val, err := pr.vm.Call("FindProxyForURL", nil, u.String(), u.Hostname())
 	if err != nil {
+		pr.trace("FindProxyForURL(%q, %q) threw %v", u.String(), u.Hostname(), err)
 		return "", err
-	} else if !val.IsString() {
+	}
+	pr.trace("FindProxyForURL(%q, %q) = %s", u.String(), u.Hostname(), formatValue(val))
+	if !val.IsString() {
 		return "", errors.New("FindProxyForURL didn't return a string")
 	}
 	return val.String(), nil
 }
 
+// logf logs a message on behalf of the PAC script, prefixed with the current request ID.
+func (pr *PACRunner) logf(format string, v ...interface{}) {
+	var e logEntry
+	if pr.id != nil {
+		e = logWith("id", pr.id)
+	}
+	e.Infof(format, v...)
+}
+
+func (pr *PACRunner) trace(format string, v ...interface{}) {
+	if pr.tracing {
+		pr.logf("PAC trace: "+format, v...)
+	}
+}
+
+// traced wraps a PAC helper function so that its arguments and return value are logged when
+// the current request is being traced.
+func (pr *PACRunner) traced(
+	name string, handler func(otto.FunctionCall) otto.Value,
+) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		result := handler(call)
+		if pr.tracing {
+			args := make([]string, len(call.ArgumentList))
+			for i, arg := range call.ArgumentList {
+				args[i] = formatValue(arg)
+			}
+			pr.trace("%s(%s) = %s", name, strings.Join(args, ", "), formatValue(result))
+		}
+		return result
+	}
+}
+
+func formatValue(value otto.Value) string {
+	if value.IsString() {
+		return strconv.Quote(value.String())
+	}
+	return value.String()
+}
+
+// alert is not one of the standard PAC functions, but many browsers implement it (and PAC scripts
+// use it for debugging), so we provide an implementation that writes the message to our log.
+func (pr *PACRunner) alert(call otto.FunctionCall) otto.Value {
+	pr.logf("PAC alert: %s", call.Argument(0).String())
+	return otto.UndefinedValue()
+}
+
 func toValue(unwrapped interface{}) otto.Value {
 	wrapped, err := otto.ToValue(unwrapped)
 	if err != nil {
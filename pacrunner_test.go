@@ -1,4 +1,4 @@
-// Copyright 2019 The Alpaca Authors
+// Copyright 2019, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -15,12 +15,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"log"
 	"net"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gobwas/glob"
 	"github.com/robertkrimen/otto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -35,6 +40,16 @@ func TestDirect(t *testing.T) {
 	assert.Equal(t, "DIRECT", proxy)
 }
 
+func TestFindProxyForURLWithoutScript(t *testing.T) {
+	var pr PACRunner
+	_, err := pr.FindProxyForURL(url.URL{Scheme: "https", Host: "anz.com"})
+	assert.Error(t, err)
+	// A script that can't be loaded leaves the runner without one.
+	assert.Error(t, pr.Update([]byte("function FindProxyForURL(")))
+	_, err = pr.FindProxyForURL(url.URL{Scheme: "https", Host: "anz.com"})
+	assert.Error(t, err)
+}
+
 func TestFindProxyForURL(t *testing.T) {
 	tests := []struct {
 		name, input, expected string
@@ -58,6 +73,45 @@ func TestFindProxyForURL(t *testing.T) {
 	}
 }
 
+func TestAlert(t *testing.T) {
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+	var pr PACRunner
+	pacjs := []byte(`
+		alert("loading");
+		function FindProxyForURL(url, host) { alert("evaluating " + host); return "DIRECT" }`)
+	require.NoError(t, pr.Update(pacjs))
+	assert.Contains(t, logs.String(), "PAC alert: loading")
+	req := httptest.NewRequest("GET", "http://alpaca.test/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyID, 42))
+	proxy, err := pr.FindProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "DIRECT", proxy)
+	assert.Contains(t, logs.String(), "[42] PAC alert: evaluating alpaca.test")
+}
+
+func TestPACTrace(t *testing.T) {
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+	defer func() { pacTrace = nil }()
+	pacTrace = glob.MustCompile("*://traced.test*")
+	var pr PACRunner
+	pacjs := []byte(`function FindProxyForURL(url, host) {
+		return isPlainHostName(host) ? "PROXY proxy.test:80" : "DIRECT";
+	}`)
+	require.NoError(t, pr.Update(pacjs))
+	_, err := pr.FindProxyForURL(url.URL{Scheme: "http", Host: "untraced.test"})
+	require.NoError(t, err)
+	assert.Empty(t, logs.String())
+	_, err = pr.FindProxyForURL(url.URL{Scheme: "http", Host: "traced.test"})
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), `PAC trace: isPlainHostName("traced.test") = false`)
+	assert.Contains(t, logs.String(),
+		`PAC trace: FindProxyForURL("http://traced.test", "traced.test") = "DIRECT"`)
+}
+
 func TestIsPlainHostName(t *testing.T) {
 	tests := []struct {
 		host     string
@@ -1,4 +1,4 @@
-// Copyright 2019 The Alpaca Authors
+// Copyright 2019, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -16,35 +16,89 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 // PACData contains program configuration to be made available to the pacWrapTmpl.
 type PACData struct {
+	// Host and Port are the address that alpaca is listening on. If the host is empty, then
+	// "localhost" is used; if it's unspecified (e.g. "0.0.0.0"), the host that the client used
+	// to fetch the PAC file is used instead.
+	Host string
 	Port int
+	// TLS is true if alpaca is listening for HTTPS rather than HTTP connections.
+	TLS bool
+	// Bypass lists hosts that should always be connected to directly (in the same format as
+	// $NO_PROXY), without going through alpaca.
+	Bypass string
+	// Fallback is true if clients should connect directly when alpaca isn't running.
+	Fallback bool
+}
+
+// ProxyType returns the type of proxy that alpaca should be listed as in the PAC file.
+func (d PACData) ProxyType() string {
+	if d.TLS {
+		return "HTTPS"
+	}
+	return "PROXY"
+}
+
+// Addr returns alpaca's address, as it should appear in the PAC file.
+func (d PACData) Addr() string {
+	host := d.Host
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(d.Port))
+}
+
+// Proxy returns the result that the PAC file returns for requests that should go via alpaca.
+func (d PACData) Proxy() string {
+	proxy := d.ProxyType() + " " + d.Addr()
+	if d.Fallback {
+		proxy += "; DIRECT"
+	}
+	return proxy
 }
 
 type pacData struct {
 	PACData
 	UpstreamPAC string
+	// BypassJS is a JavaScript expression which is true if the request should bypass alpaca.
+	BypassJS string
 }
 
 type PACWrapper struct {
 	data      pacData
 	tmpl      *template.Template
 	alpacaPAC string
+	modified  time.Time // when alpacaPAC last changed
+	mux       sync.Mutex
 }
 
 // PACWrapper template for serving a PAC file to point at alpaca or DIRECT. If we have a valid
 // PAC file, we wrap that PAC file with a wrapper function that only returns "DIRECT" or
-// "localhost:port". If we do not have a PAC file, the PAC function we serve only returns "DIRECT",
-// which should prevent all requests reaching us.
+// "PROXY host:port" (or "HTTPS host:port" if we're listening for HTTPS, optionally followed by
+// "; DIRECT"). If we do not have a PAC file, the PAC function we serve only returns "DIRECT",
+// which should prevent all requests reaching us. Hosts in the bypass list are always DIRECT.
 var pacWrapTmpl = `// Wrapped for and by alpaca
 function FindProxyForURL(url, host) {
+{{- if .BypassJS }}
+  if ({{.BypassJS}}) {
+    return "DIRECT";
+  }
+{{- end }}
 {{ if .UpstreamPAC }}
-  return FindProxyForURL(url, host) === "DIRECT" ? "DIRECT" : "PROXY localhost:{{.Port}}";
+  return FindProxyForURL(url, host) === "DIRECT" ? "DIRECT" : "{{.Proxy}}";
 {{.UpstreamPAC}}
 {{ else }}
   return "DIRECT";
@@ -54,21 +108,72 @@ function FindProxyForURL(url, host) {
 
 func NewPACWrapper(data PACData) *PACWrapper {
 	t := template.Must(template.New("alpaca").Parse(pacWrapTmpl))
-	return &PACWrapper{pacData{data, ""}, t, ""}
+	return &PACWrapper{data: pacData{data, "", bypassJS(parseNoProxy(data.Bypass))}, tmpl: t}
+}
+
+// bypassJS converts a bypass list into a JavaScript expression, for use in the PAC file.
+// Entries with a port are left out, since FindProxyForURL would have to parse the URL to check
+// them.
+func bypassJS(np *noProxyList) string {
+	if np.all {
+		return "true"
+	}
+	var conds []string
+	for _, entry := range np.entries {
+		switch {
+		case entry.port != "":
+			host := entry.domain
+			if entry.ip != nil {
+				host = entry.ip.String()
+			}
+			warnf("Ignoring bypass entry with a port (%s) in alpaca.pac",
+				net.JoinHostPort(host, entry.port))
+		case entry.cidr != nil && entry.cidr.IP.To4() != nil:
+			// Only match IP addresses, so that the browser doesn't have to resolve hostnames.
+			conds = append(conds, fmt.Sprintf(
+				`/^\d+\.\d+\.\d+\.\d+$/.test(host) && isInNet(host, "%s", "%s")`,
+				entry.cidr.IP, net.IP(entry.cidr.Mask)))
+		case entry.cidr != nil:
+			conds = append(conds, fmt.Sprintf(
+				`typeof isInNetEx === "function" && isInNetEx(host, "%s")`, entry.cidr))
+		case entry.ip != nil:
+			conds = append(conds, fmt.Sprintf(`host === "%s"`, entry.ip))
+		default:
+			conds = append(conds, fmt.Sprintf(`host === "%s" || dnsDomainIs(host, ".%s")`,
+				entry.domain, entry.domain))
+		}
+	}
+	for i, cond := range conds {
+		if len(conds) > 1 {
+			conds[i] = "(" + cond + ")"
+		}
+	}
+	return strings.Join(conds, " ||\n      ")
 }
 
 func (pw *PACWrapper) Wrap(pacjs []byte) {
+	pw.mux.Lock()
+	defer pw.mux.Unlock()
 	pac := string(pacjs)
 	if pac == pw.data.UpstreamPAC && pw.alpacaPAC != "" {
 		return
 	}
 	pw.data.UpstreamPAC = pac
-	b := &bytes.Buffer{}
-	if err := pw.tmpl.Execute(b, pw.data); err != nil {
-		log.Printf("error executing PAC wrap template: %v", err)
+	b, err := pw.render(pw.data)
+	if err != nil {
+		errorf("error executing PAC wrap template: %v", err)
 		return
 	}
-	pw.alpacaPAC = b.String()
+	pw.alpacaPAC = b
+	pw.modified = time.Now()
+}
+
+func (pw *PACWrapper) render(data pacData) (string, error) {
+	b := &bytes.Buffer{}
+	if err := pw.tmpl.Execute(b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
 }
 
 func (pw *PACWrapper) SetupHandlers(mux *http.ServeMux) {
@@ -76,12 +181,70 @@ func (pw *PACWrapper) SetupHandlers(mux *http.ServeMux) {
 }
 
 func (pw *PACWrapper) handlePAC(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodGet {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	pw.mux.Lock()
+	pac, modified, data := pw.alpacaPAC, pw.modified, pw.data
+	pw.mux.Unlock()
+	if host := requestHostname(req); host != "" && data.Addr() != data.withHost(host).Addr() {
+		// We're listening on all addresses, so the PAC file should point clients at the
+		// address that they used to reach us.
+		var err error
+		if pac, err = pw.render(data.withHost(host)); err != nil {
+			errorf("error executing PAC wrap template: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	sum := sha256.Sum256([]byte(pac))
 	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
-	if _, err := w.Write([]byte(pw.alpacaPAC)); err != nil {
-		log.Printf("Error writing PAC to response: %v", err)
+	// The PAC file depends on the Host header when we're listening on all addresses.
+	w.Header().Set("Vary", "Host")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	http.ServeContent(w, req, "", modified, strings.NewReader(pac))
+}
+
+// withHost returns the data with the host replaced, if alpaca is listening on an unspecified
+// address.
+func (d pacData) withHost(host string) pacData {
+	if ip := net.ParseIP(d.Host); ip != nil && ip.IsUnspecified() {
+		d.Host = host
+	}
+	return d
+}
+
+// requestHostname returns the hostname from the request's Host header, or an empty string if it
+// isn't an IP address or a valid DNS name (since it ends up in the PAC file).
+func requestHostname(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) == nil && !isDNSName(host) {
+		return ""
+	}
+	return host
+}
+
+// isDNSName reports whether a name consists of letters, digits and hyphens, in labels of up to
+// 63 characters that don't start or end with a hyphen.
+func isDNSName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+				c == '-') {
+				return false
+			}
+		}
 	}
+	return true
 }
@@ -1,4 +1,4 @@
-// Copyright 2019, 2022 The Alpaca Authors
+// Copyright 2019, 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -18,6 +18,8 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -32,6 +34,12 @@ func TestWrapPAC(t *testing.T) {
 	assert.Contains(t, pw.alpacaPAC, `"DIRECT" : "PROXY localhost:1234"`)
 }
 
+func TestWrapPACWithTLS(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1234, TLS: true})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "DIRECT" }`))
+	assert.Contains(t, pw.alpacaPAC, `"DIRECT" : "HTTPS localhost:1234"`)
+}
+
 func TestWrapEmptyPAC(t *testing.T) {
 	pw := NewPACWrapper(PACData{Port: 1234})
 	pw.Wrap(nil)
@@ -59,3 +67,124 @@ func TestPACServe(t *testing.T) {
 	assert.Contains(t, body, `"DIRECT" : "PROXY localhost:1234"`)
 	resp.Body.Close()
 }
+
+func TestWrapPACWithHost(t *testing.T) {
+	pw := NewPACWrapper(PACData{Host: "::1", Port: 1234})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "DIRECT" }`))
+	assert.Contains(t, pw.alpacaPAC, `"DIRECT" : "PROXY [::1]:1234"`)
+}
+
+func TestWrapPACWithFallback(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1234, Fallback: true})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "DIRECT" }`))
+	assert.Contains(t, pw.alpacaPAC, `"DIRECT" : "PROXY localhost:1234; DIRECT"`)
+}
+
+func TestWrapPACWithBypass(t *testing.T) {
+	bypass := "internal.test, 10.0.0.0/8, 192.0.2.1, fd00::/8, ports.test:8080"
+	pw := NewPACWrapper(PACData{Port: 1234, Bypass: bypass})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY upstream:8080" }`))
+	var pr PACRunner
+	require.NoError(t, pr.Update([]byte(pw.alpacaPAC)))
+	tests := []struct {
+		url, expected string
+	}{
+		{"http://internal.test/", "DIRECT"},
+		{"http://www.internal.test/", "DIRECT"},
+		{"http://notinternal.test/", "PROXY localhost:1234"},
+		{"http://10.1.2.3/", "DIRECT"},
+		{"http://11.1.2.3/", "PROXY localhost:1234"},
+		{"http://192.0.2.1/", "DIRECT"},
+		{"http://ports.test:8080/", "PROXY localhost:1234"},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			require.NoError(t, err)
+			result, err := pr.FindProxyForURL(*u)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
+
+func TestWrapPACBypassEverything(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1234, Bypass: "*"})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY upstream:8080" }`))
+	assert.Contains(t, pw.alpacaPAC, "if (true) {")
+}
+
+func TestPACServeUsesRequestHost(t *testing.T) {
+	pw := NewPACWrapper(PACData{Host: "0.0.0.0", Port: 1234})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY upstream:8080" }`))
+	assert.Contains(t, pw.alpacaPAC, `"PROXY localhost:1234"`)
+	req := httptest.NewRequest(http.MethodGet, "http://192.0.2.1:1234/alpaca.pac", nil)
+	w := httptest.NewRecorder()
+	pw.handlePAC(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"PROXY 192.0.2.1:1234"`)
+	assert.Equal(t, "Host", w.Header().Get("Vary"))
+}
+
+func TestPACServeIgnoresInvalidHost(t *testing.T) {
+	pw := NewPACWrapper(PACData{Host: "0.0.0.0", Port: 1234})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY upstream:8080" }`))
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"alpaca.example.com:1234", `"PROXY alpaca.example.com:1234"`},
+		{"[2001:db8::1]:1234", `"PROXY [2001:db8::1]:1234"`},
+		{`evil"; return "PROXY attacker:80`, `"PROXY localhost:1234"`},
+		{"evil\\u0022.example.com", `"PROXY localhost:1234"`},
+		{"-bad-.example.com", `"PROXY localhost:1234"`},
+		{"", `"PROXY localhost:1234"`},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:1234/alpaca.pac", nil)
+			req.Host = test.host
+			w := httptest.NewRecorder()
+			pw.handlePAC(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), test.expected)
+			assert.NotContains(t, w.Body.String(), "attacker")
+		})
+	}
+}
+
+func TestIsDNSName(t *testing.T) {
+	assert.True(t, isDNSName("localhost"))
+	assert.True(t, isDNSName("alpaca-1.corp.example"))
+	assert.False(t, isDNSName(""))
+	assert.False(t, isDNSName("a..b"))
+	assert.False(t, isDNSName("under_score.example"))
+	assert.False(t, isDNSName(strings.Repeat("a", 64)+".example"))
+	assert.False(t, isDNSName("a b"))
+}
+
+func TestPACServeConditional(t *testing.T) {
+	pw := NewPACWrapper(PACData{Port: 1234})
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "DIRECT" }`))
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:1234/alpaca.pac", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		pw.handlePAC(w, req)
+		return w
+	}
+	w := get("", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	require.NotEmpty(t, etag)
+	require.NotEmpty(t, lastModified)
+	assert.Equal(t, http.StatusNotModified, get("If-None-Match", etag).Code)
+	assert.Equal(t, http.StatusNotModified, get("If-Modified-Since", lastModified).Code)
+	// When the PAC file changes, so does the ETag.
+	pw.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY upstream:8080" }`))
+	w = get("If-None-Match", etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
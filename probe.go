@@ -0,0 +1,114 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// How long a connectivity probe can take before it's considered to have failed. It is set using
+// the -probe-timeout flag.
+var probeTimeout = 2 * time.Second
+
+// A probe checks whether alpaca is connected to the network that a local (file:) PAC file is
+// for, since that can't be decided by whether the PAC file can be downloaded. It is set using the
+// -probe flag, which takes one of:
+//
+//	resolve:HOST         HOST (e.g. an internal hostname) can be resolved
+//	http://URL           URL (e.g. an intranet page) returns 200 OK, without using a proxy
+//	https://URL
+//	tcp:HOST:PORT        a TCP connection to HOST:PORT can be made
+//	exec:COMMAND         COMMAND (run by the shell) exits with status 0
+type probe struct {
+	spec  string
+	check func(ctx context.Context) error
+}
+
+func (p *probe) String() string {
+	return p.spec
+}
+
+func parseProbe(spec string) (*probe, error) {
+	p := &probe{spec: spec}
+	switch {
+	case strings.HasPrefix(spec, "resolve:"):
+		host := strings.TrimPrefix(spec, "resolve:")
+		if host == "" {
+			return nil, errors.New("missing hostname")
+		}
+		p.check = func(ctx context.Context) error {
+			_, err := net.DefaultResolver.LookupHost(ctx, host)
+			return err
+		}
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		if _, err := http.NewRequest(http.MethodGet, spec, nil); err != nil {
+			return nil, err
+		}
+		// As with PAC files, the probe goes directly to the server, rather than via a proxy
+		// (which could be this instance of alpaca).
+		client := &http.Client{Transport: &http.Transport{Proxy: nil}}
+		p.check = func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, spec, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := requireOK(client.Do(req))
+			if err != nil {
+				return err
+			}
+			return resp.Body.Close()
+		}
+	case strings.HasPrefix(spec, "tcp:"):
+		addr := strings.TrimPrefix(spec, "tcp:")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, err
+		}
+		p.check = func(ctx context.Context) error {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	case strings.HasPrefix(spec, "exec:"):
+		command := strings.TrimPrefix(spec, "exec:")
+		if command == "" {
+			return nil, errors.New("missing command")
+		}
+		p.check = func(ctx context.Context) error {
+			return shellCommand(ctx, command).Run()
+		}
+	default:
+		return nil, fmt.Errorf("unknown probe type (expected resolve:, http://, https://, " +
+			"tcp: or exec:)")
+	}
+	return p, nil
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
@@ -0,0 +1,94 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runProbe(t *testing.T, spec string) error {
+	p, err := parseProbe(spec)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return p.check(ctx)
+}
+
+func TestResolveProbe(t *testing.T) {
+	assert.NoError(t, runProbe(t, "resolve:localhost"))
+	assert.Error(t, runProbe(t, "resolve:nonexistent.invalid"))
+}
+
+func TestHTTPProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	assert.NoError(t, runProbe(t, server.URL+"/ok"))
+	assert.Error(t, runProbe(t, server.URL+"/missing"))
+}
+
+func TestTCPProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	assert.NoError(t, runProbe(t, "tcp:"+addr))
+	l.Close()
+	assert.Error(t, runProbe(t, "tcp:"+addr))
+}
+
+func TestExecProbe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		assert.NoError(t, runProbe(t, "exec:exit 0"))
+		assert.Error(t, runProbe(t, "exec:exit 1"))
+		return
+	}
+	assert.NoError(t, runProbe(t, "exec:test -d /"))
+	assert.Error(t, runProbe(t, "exec:test -d /nonexistent"))
+}
+
+func TestProbeTimeout(t *testing.T) {
+	// The server accepts connections, but never responds.
+	l := blackhole(t)
+	p, err := parseProbe("http://" + l.Addr().String() + "/")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Error(t, p.check(ctx))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestParseInvalidProbe(t *testing.T) {
+	for _, spec := range []string{
+		"", "ping:host", "resolve:", "tcp:host", "exec:", "http://[::1",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			_, err := parseProbe(spec)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+// A profile describes a network location (e.g. the office, a VPN or home), and how alpaca should
+// behave there. Profiles are read from a file with one profile per line. Each profile has a
+// name, zero or more conditions (all of which must match), and zero or more settings:
+//
+//	# name  conditions                                  settings
+//	office  gateway=10.1.0.1 domain=corp.example        pac=http://wpad.corp.example/wpad.dat
+//	vpn     interface=utun* canary=http://intranet.corp.example/ credentials=alice@CORP:0123abcd
+//	home    direct
+//
+// The conditions are:
+//   - gateway: the IP address of the default gateway
+//   - domain: a shell expression which must match one of the DNS search domains
+//   - interface: a shell expression which must match the name of a network interface that is up
+//   - canary: a URL which must be reachable (i.e. return any HTTP response) without a proxy
+//
+// The settings are:
+//   - pac: the PAC URL to use (may be repeated, to specify fallbacks)
+//   - direct: send all requests directly, without downloading a PAC file
+//   - credentials: the NTLM credentials to use (in the same format as $NTLM_CREDENTIALS)
+//   - noauth: don't authenticate to upstream proxies
+//
+// Each time the network changes, the first profile that matches is used. A profile without any
+// conditions always matches, so it can be used as a default at the end of the file.
+type profile struct {
+	name    string
+	line    int
+	gateway net.IP
+	domain  glob.Glob
+	iface   glob.Glob
+	canary  string
+	pacurls []string
+	direct  bool
+	setAuth bool           // if true, auth overrides the listener's credentials
+	auth    *authenticator // nil if the profile doesn't authenticate
+}
+
+// networkInfo describes the network that alpaca is connected to, for matching profiles.
+type networkInfo struct {
+	gateways   []net.IP
+	domains    []string
+	interfaces []string
+}
+
+// The path of the file containing the DNS search domains.
+var resolvConfPath = "/etc/resolv.conf"
+
+func loadProfiles(path string) ([]*profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProfiles(f)
+}
+
+func parseProfiles(r io.Reader) ([]*profile, error) {
+	var profiles []*profile
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parseProfile(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		} else if names[p.name] {
+			return nil, fmt.Errorf("line %d: duplicate profile %q", n, p.name)
+		}
+		names[p.name] = true
+		p.line = n
+		profiles = append(profiles, p)
+	}
+	return profiles, scanner.Err()
+}
+
+func parseProfile(line string) (*profile, error) {
+	fields := strings.Fields(line)
+	p := &profile{name: fields[0]}
+	if strings.Contains(p.name, "=") {
+		return nil, fmt.Errorf("missing profile name before %q", p.name)
+	}
+	for _, field := range fields[1:] {
+		key, value := field, ""
+		if i := strings.Index(field, "="); i >= 0 {
+			key, value = field[:i], field[i+1:]
+		}
+		var err error
+		switch key {
+		case "gateway":
+			if p.gateway = net.ParseIP(value); p.gateway == nil {
+				return nil, fmt.Errorf("invalid gateway address %q", value)
+			}
+		case "domain":
+			if p.domain, err = glob.Compile(value); err != nil {
+				return nil, fmt.Errorf("invalid domain pattern %q: %w", value, err)
+			}
+		case "interface":
+			if p.iface, err = glob.Compile(value); err != nil {
+				return nil, fmt.Errorf("invalid interface pattern %q: %w", value, err)
+			}
+		case "canary":
+			if !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+				return nil, fmt.Errorf("invalid canary URL %q", value)
+			}
+			p.canary = value
+		case "pac":
+			p.pacurls = append(p.pacurls, value)
+		case "direct":
+			p.direct = true
+		case "credentials":
+			if p.auth, err = parseCredentials(value); err != nil {
+				return nil, err
+			}
+			p.setAuth = true
+		case "noauth":
+			p.auth, p.setAuth = nil, true
+		default:
+			return nil, fmt.Errorf("unknown condition or setting %q", key)
+		}
+	}
+	if p.direct && p.pacurls != nil {
+		return nil, errors.New("a profile can't have both pac and direct settings")
+	}
+	return p, nil
+}
+
+// match reports whether the profile matches the network. The reachable function is only called
+// if the profile has a canary URL and all of its other conditions match.
+func (p *profile) match(info networkInfo, reachable func(string) bool) bool {
+	if p.gateway != nil && !containsIP(info.gateways, p.gateway) {
+		return false
+	}
+	if p.domain != nil && !matchAny(p.domain, info.domains) {
+		return false
+	}
+	if p.iface != nil && !matchAny(p.iface, info.interfaces) {
+		return false
+	}
+	if p.canary != "" && !reachable(p.canary) {
+		return false
+	}
+	return true
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, x := range ips {
+		if x.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(g glob.Glob, values []string) bool {
+	for _, value := range values {
+		if g.Match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchProfile returns the first profile that matches the network, or nil if none of them do.
+func matchProfile(profiles []*profile, info networkInfo, reachable func(string) bool) *profile {
+	for _, p := range profiles {
+		if p.match(info, reachable) {
+			return p
+		}
+	}
+	return nil
+}
+
+// getNetworkInfo returns the default gateways, DNS search domains and network interfaces. Any
+// information that isn't available (e.g. the default gateway on an unsupported platform) is
+// left out.
+func getNetworkInfo() networkInfo {
+	var info networkInfo
+	info.gateways, _ = defaultGateways()
+	info.domains = searchDomains(resolvConfPath)
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp != 0 {
+				info.interfaces = append(info.interfaces, iface.Name)
+			}
+		}
+	}
+	return info
+}
+
+// searchDomains returns the DNS search domains from a resolv.conf(5) file.
+func searchDomains(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && (fields[0] == "search" || fields[0] == "domain") {
+			domains = append(domains, fields[1:]...)
+		}
+	}
+	return domains
+}
+
+// reachable reports whether a canary URL returns an HTTP response (with any status) when
+// requested directly, rather than via a proxy.
+func reachable(client *http.Client, canary string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, canary, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
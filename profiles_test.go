@@ -0,0 +1,125 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProfiles(t *testing.T) {
+	profiles, err := parseProfiles(strings.NewReader(`
+		# comment
+		office  gateway=10.1.0.1 domain=corp.test   pac=http://wpad.corp.test/wpad.dat
+
+		vpn     interface=tun* canary=http://intranet.corp.test/ credentials=bob@CORP:0123
+		home    direct noauth
+	`))
+	require.NoError(t, err)
+	require.Len(t, profiles, 3)
+	assert.Equal(t, "office", profiles[0].name)
+	assert.Equal(t, 3, profiles[0].line)
+	assert.Equal(t, "10.1.0.1", profiles[0].gateway.String())
+	assert.True(t, profiles[0].domain.Match("corp.test"))
+	assert.Equal(t, []string{"http://wpad.corp.test/wpad.dat"}, profiles[0].pacurls)
+	assert.False(t, profiles[0].setAuth)
+	assert.True(t, profiles[1].iface.Match("tun0"))
+	assert.Equal(t, "http://intranet.corp.test/", profiles[1].canary)
+	assert.True(t, profiles[1].setAuth)
+	assert.Equal(t, &authenticator{"CORP", "bob", "0123"}, profiles[1].auth)
+	assert.True(t, profiles[2].direct)
+	assert.True(t, profiles[2].setAuth)
+	assert.Nil(t, profiles[2].auth)
+}
+
+func TestParseInvalidProfiles(t *testing.T) {
+	tests := []struct {
+		name, input string
+	}{
+		{"MissingName", "gateway=10.1.0.1 direct"},
+		{"UnknownSetting", "office proxy=proxy.test:8080"},
+		{"InvalidGateway", "office gateway=10.1.0 direct"},
+		{"InvalidGlob", "office domain=[ direct"},
+		{"InvalidCanary", "office canary=intranet.test direct"},
+		{"InvalidCredentials", "office credentials=bob"},
+		{"PACAndDirect", "office pac=http://wpad.test/wpad.dat direct"},
+		{"Duplicate", "office direct\noffice direct"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseProfiles(strings.NewReader(test.input))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMatchProfile(t *testing.T) {
+	profiles, err := parseProfiles(strings.NewReader(`
+		office  gateway=10.1.0.1 domain=*corp.test
+		vpn     interface=tun* canary=http://intranet.corp.test/
+		lab     domain=lab.test
+		home
+	`))
+	require.NoError(t, err)
+	var canaries []string
+	reachable := func(canary string) bool {
+		canaries = append(canaries, canary)
+		return canary == "http://intranet.corp.test/"
+	}
+	tests := []struct {
+		name     string
+		info     networkInfo
+		expected string
+	}{
+		{"Office", networkInfo{
+			gateways: []net.IP{net.ParseIP("10.1.0.1")},
+			domains:  []string{"eng.corp.test"},
+		}, "office"},
+		{"WrongGateway", networkInfo{
+			gateways: []net.IP{net.ParseIP("10.1.0.2")},
+			domains:  []string{"corp.test"},
+		}, "home"},
+		{"VPN", networkInfo{interfaces: []string{"lo", "tun0"}}, "vpn"},
+		{"Lab", networkInfo{domains: []string{"home.test", "lab.test"}}, "lab"},
+		{"Home", networkInfo{interfaces: []string{"lo", "eth0"}}, "home"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := matchProfile(profiles, test.info, reachable)
+			require.NotNil(t, p)
+			assert.Equal(t, test.expected, p.name)
+		})
+	}
+	// The canary is only checked if the interface matches.
+	assert.Equal(t, []string{"http://intranet.corp.test/"}, canaries)
+	assert.Nil(t, matchProfile(profiles[:1], networkInfo{}, reachable))
+}
+
+func TestSearchDomains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(path, []byte(`# comment
+domain corp.test
+nameserver 10.1.0.53
+search eng.corp.test corp.test
+`), 0644))
+	assert.Equal(t, []string{"corp.test", "eng.corp.test", "corp.test"}, searchDomains(path))
+	assert.Nil(t, searchDomains(filepath.Join(t.TempDir(), "nonexistent")))
+}
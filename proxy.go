@@ -1,4 +1,4 @@
-// Copyright 2019, 2021, 2022 The Alpaca Authors
+// Copyright 2019, 2021, 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -16,15 +16,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/samuong/alpaca/cancelable"
 )
@@ -34,14 +36,28 @@ var tlsClientConfig *tls.Config
 type ProxyHandler struct {
 	transport *http.Transport
 	auth      *authenticator
-	block     func(string)
+	creds     *credentialStore // if set, used instead of auth (so that it can be changed)
+	report    reportFunc
+	tunnels   *connTracker // if set, keeps track of CONNECT tunnels
 }
 
 type proxyFunc func(*http.Request) (*url.URL, error)
 
-func NewProxyHandler(auth *authenticator, proxy proxyFunc, block func(string)) ProxyHandler {
-	tr := &http.Transport{Proxy: proxy, TLSClientConfig: tlsClientConfig}
-	return ProxyHandler{tr, auth, block}
+// reportFunc is called with the outcome of each attempt to use an upstream proxy: a nil error
+// if the proxy worked, or the error if the proxy itself failed.
+type reportFunc func(proxy string, err error)
+
+func NewProxyHandler(auth *authenticator, proxy proxyFunc, report reportFunc) ProxyHandler {
+	dial := newHappyEyeballs().DialContext
+	td := &tlsDialer{dial: dial}
+	tr := &http.Transport{
+		Proxy:                 td.proxy(proxy),
+		DialContext:           dial,
+		DialTLSContext:        td.DialTLSContext,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		IdleConnTimeout:       idleTimeout,
+	}
+	return ProxyHandler{transport: tr, auth: auth, report: report}
 }
 
 func (ph ProxyHandler) WrapHandler(next http.Handler) http.Handler {
@@ -66,28 +82,26 @@ func (ph ProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodConnect {
 		ph.handleConnect(w, req)
 	} else {
-		ph.proxyRequest(w, req, ph.auth)
+		ph.proxyRequest(w, req, ph.authFor(req))
+	}
+}
+
+// authFor returns the credentials to use for a request: those of the network profile that's in
+// use (if it has any), or else the listener's (which may have been changed by alpaca ctl).
+func (ph ProxyHandler) authFor(req *http.Request) *authenticator {
+	if auth, ok := req.Context().Value(contextKeyAuth).(*authenticator); ok {
+		return auth
+	} else if ph.creds != nil {
+		return ph.creds.get()
 	}
+	return ph.auth
 }
 
 func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 	// Establish a connection to the server, or an upstream proxy.
 	id := req.Context().Value(contextKeyID)
-	proxy, err := ph.transport.Proxy(req)
-	if err != nil {
-		log.Printf("[%d] Error finding proxy for request: %v", id, err)
-	}
-	var server net.Conn
-	if proxy == nil {
-		server, err = connectDirect(req)
-	} else {
-		server, err = connectViaProxy(req, proxy, ph.auth)
-		var oe *net.OpError
-		if errors.As(err, &oe) && oe.Op == "proxyconnect" {
-			log.Printf("[%d] Temporarily blocking proxy: %q", id, proxy.Host)
-			ph.block(proxy.Host)
-		}
-	}
+	logger := logFor(req)
+	server, err := ph.connect(req)
 	if err != nil {
 		w.WriteHeader(http.StatusBadGateway)
 		return
@@ -97,13 +111,13 @@ func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 	// Take over the connection back to the client by hijacking the ResponseWriter.
 	h, ok := w.(http.Hijacker)
 	if !ok {
-		log.Printf("[%d] Error hijacking response writer", id)
+		logger.Errorf("Error hijacking response writer")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	client, _, err := h.Hijack()
 	if err != nil {
-		log.Printf("[%d] Error hijacking connection: %v", id, err)
+		logger.with("error", err).Errorf("Error hijacking connection: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -119,54 +133,207 @@ func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 		ContentLength: -1,
 	}
 	if err := resp.Write(client); err != nil {
-		log.Printf("[%d] Error writing response: %v", id, err)
+		logger.with("error", err).Warnf("Error writing response: %v", err)
 		return
 	}
+	rec := accessRecordFor(req)
+	rec.openTunnel()
 	// Kick off goroutines to copy data in each direction. Whichever goroutine finishes first
 	// will close the Reader for the other goroutine, forcing any blocked copy to unblock. This
 	// prevents any goroutine from blocking indefinitely (which will leak a file descriptor).
 	serverCloser.Cancel()
 	clientCloser.Cancel()
-	go func() { _, _ = io.Copy(server, client); server.Close() }()
-	go func() { _, _ = io.Copy(client, server); client.Close() }()
+	t := &tunnel{id: id, host: req.Host, start: time.Now(), client: client, server: server}
+	ph.tunnels.addTunnel(t)
+	// If there's an idle timeout, both connections are closed once no data has been copied in
+	// either direction for that long.
+	var fromClient, fromServer io.Reader = client, server
+	stop := func() bool { return false }
+	if timeout := idleTimeout; timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			logger.with("duration", timeout).Infof("Closing tunnel to %s after being idle for %v",
+				req.Host, timeout)
+			client.Close()
+			server.Close()
+		})
+		fromClient = activityReader{client, timer, timeout}
+		fromServer = activityReader{server, timer, timeout}
+		stop = timer.Stop
+	}
+	var up, down int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		up, _ = io.Copy(server, fromClient)
+		server.Close()
+		stop()
+		ph.tunnels.removeTunnel(t)
+		wg.Done()
+	}()
+	go func() {
+		down, _ = io.Copy(client, fromServer)
+		client.Close()
+		stop()
+		ph.tunnels.removeTunnel(t)
+		wg.Done()
+	}()
+	// The request is written to the access log once the tunnel has closed.
+	go func() {
+		wg.Wait()
+		rec.closeTunnel(up, down)
+	}()
+}
+
+// connect opens a connection to the server (for a CONNECT request), either directly or via the
+// proxy chosen by ProxyFinder. If the proxy can't be reached, it is temporarily blocked and the
+// next proxy in the list is tried instead.
+func (ph ProxyHandler) connect(req *http.Request) (net.Conn, error) {
+	for {
+		proxy, err := ph.transport.Proxy(req)
+		if err != nil {
+			logFor(req, "error", err).Errorf("Error finding proxy for request: %v", err)
+		}
+		if proxy == nil {
+			accessRecordFor(req).setRoute("DIRECT")
+			return connectDirect(req)
+		}
+		accessRecordFor(req).setRoute(proxy.Host)
+		var server net.Conn
+		if proxy.Scheme == "socks5" {
+			server, err = dialSOCKS5(context.Background(), proxy, req.Host)
+			if err != nil {
+				logFor(req, "proxy", proxy.Host, "error", err).
+					Warnf("Error connecting via SOCKS proxy %s: %v", proxy.Host, err)
+			}
+		} else {
+			server, err = connectViaProxy(req, proxy, ph.authFor(req))
+		}
+		if err == nil {
+			ph.report(proxy.Host, nil)
+			return server, nil
+		} else if !isProxyFailure(err) {
+			return nil, err
+		}
+		logFor(req, "proxy", proxy.Host, "error", err).
+			Warnf("Temporarily blocking proxy: %q", proxy.Host)
+		ph.report(proxy.Host, err)
+		next, ok := nextProxy(req)
+		if !ok {
+			return nil, err
+		}
+		req = next
+		logFor(req, "route", describeProxy(req)).
+			Infof("Retrying %s %s via %s", req.Method, req.Host, describeProxy(req))
+	}
+}
+
+func isProxyConnectError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "proxyconnect"
+}
+
+// proxyStatusError is returned when a proxy responds to a CONNECT request with an error status.
+type proxyStatusError struct {
+	status     string
+	statusCode int
+}
+
+func (e *proxyStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status: %s", e.status)
+}
+
+// isProxyFailure reports whether an error means that the proxy itself has failed (and so it
+// should be blocked, and the request retried via a different proxy). An error status from the
+// proxy only counts if it's one that the proxy generates when it's overloaded or broken; a 502
+// or 504 generally means that the proxy couldn't reach the server, which isn't its fault.
+func isProxyFailure(err error) bool {
+	var pse *proxyStatusError
+	if errors.As(err, &pse) {
+		return pse.statusCode == http.StatusInternalServerError ||
+			pse.statusCode == http.StatusServiceUnavailable
+	}
+	return isProxyConnectError(err)
+}
+
+// isProxyGenerated reports whether a response was generated by the proxy itself, rather than
+// passed on from the server. Proxies say so using a Proxy-Status header with an error parameter
+// (RFC 9209), or in Squid's case, an X-Squid-Error header.
+func isProxyGenerated(resp *http.Response) bool {
+	if resp.Header.Get("X-Squid-Error") != "" {
+		return true
+	}
+	for _, value := range resp.Header.Values("Proxy-Status") {
+		if strings.Contains(strings.ToLower(value), "error=") {
+			return true
+		}
+	}
+	return false
+}
+
+// isReplayable reports whether a request can safely be sent again after it has been sent to a
+// proxy, i.e. whether its method is idempotent (RFC 7231, section 4.2.2) or it has an
+// idempotency key.
+func isReplayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut,
+		http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+func describeProxy(req *http.Request) string {
+	if proxy, _ := getProxyFromContext(req); proxy != nil {
+		return proxy.Host
+	}
+	return "DIRECT"
 }
 
 func connectDirect(req *http.Request) (net.Conn, error) {
-	server, err := net.Dial("tcp", req.Host)
+	server, err := newHappyEyeballs().DialContext(req.Context(), "tcp", req.Host)
 	if err != nil {
-		id := req.Context().Value(contextKeyID)
-		log.Printf("[%d] Error dialling host %s: %v", id, req.Host, err)
+		logFor(req, "route", "DIRECT", "error", err).
+			Errorf("Error dialling host %s: %v", req.Host, err)
 	}
 	return server, err
 }
 
 func connectViaProxy(req *http.Request, proxy *url.URL, auth *authenticator) (net.Conn, error) {
-	id := req.Context().Value(contextKeyID)
-	var tr transport
+	logger := logFor(req, "proxy", proxy.Host)
+	tr := transport{headerTimeout: responseHeaderTimeout}
 	defer tr.Close()
-	if err := tr.dial(proxy); err != nil {
-		log.Printf("[%d] Error dialling proxy %s: %v", id, proxy.Host, err)
+	if err := tr.dial(context.Background(), proxy); err != nil {
+		logger.with("error", err).Warnf("Error dialling proxy %s: %v", proxy.Host, err)
 		return nil, err
 	}
+	rec := accessRecordFor(req)
 	resp, err := tr.RoundTrip(req)
 	if err != nil {
-		log.Printf("[%d] Error reading CONNECT response: %v", id, err)
+		logger.with("error", err).Warnf("Error reading CONNECT response: %v", err)
 		return nil, err
-	} else if resp.StatusCode == http.StatusProxyAuthRequired && auth != nil {
-		log.Printf("[%d] Got %q response, retrying with auth", id, resp.Status)
+	}
+	rec.setUpstreamStatus(resp.StatusCode)
+	if resp.StatusCode == http.StatusProxyAuthRequired && auth != nil {
+		logger.with("status", resp.StatusCode).Debugf("Got %q response, retrying with auth",
+			resp.Status)
 		resp.Body.Close()
-		if err := tr.dial(proxy); err != nil {
-			log.Printf("[%d] Error re-dialling %s: %v", id, proxy.Host, err)
+		if err := tr.dial(context.Background(), proxy); err != nil {
+			logger.with("error", err).Warnf("Error re-dialling %s: %v", proxy.Host, err)
 			return nil, err
 		}
+		rec.addAuthAttempt()
 		resp, err = auth.do(req, &tr)
 		if err != nil {
 			return nil, err
 		}
+		rec.setUpstreamStatus(resp.StatusCode)
 	}
 	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("[%d] Unexpected response status: %s", id, resp.Status)
+		err := &proxyStatusError{resp.Status, resp.StatusCode}
+		logger.with("status", resp.StatusCode, "error", err).
+			Errorf("Error establishing tunnel via %s: %v", proxy.Host, err)
+		return nil, err
 	}
 	return tr.hijack(), nil
 }
@@ -174,46 +341,98 @@ func connectViaProxy(req *http.Request, proxy *url.URL, auth *authenticator) (ne
 func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, auth *authenticator) {
 	// Make a copy of the request body, in case we have to replay it (for authentication)
 	var buf bytes.Buffer
-	id := req.Context().Value(contextKeyID)
 	if n, err := io.Copy(&buf, req.Body); err != nil {
-		log.Printf("[%d] Error copying request body (got %d/%d): %v",
-			id, n, req.ContentLength, err)
+		logFor(req, "bytes", n, "error", err).
+			Errorf("Error copying request body (got %d/%d): %v", n, req.ContentLength, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	rd := bytes.NewReader(buf.Bytes())
-	req.Body = io.NopCloser(rd)
-	resp, err := ph.transport.RoundTrip(req)
-	if err != nil {
-		log.Printf("[%d] Error forwarding request: %v", id, err)
-		w.WriteHeader(http.StatusBadGateway)
-		var oe *net.OpError
-		if errors.As(err, &oe) && oe.Op == "proxyconnect" {
-			proxy, err := ph.transport.Proxy(req)
-			if err != nil {
-				log.Printf("[%d] Proxy connect error to unknown proxy: %v", id, err)
-				return
+	rec := accessRecordFor(req)
+	var rd *bytes.Reader
+	var resp *http.Response
+	var err error
+	for {
+		rd = bytes.NewReader(buf.Bytes())
+		req.Body = io.NopCloser(rd)
+		rec.setRoute(describeProxy(req))
+		resp, err = ph.transport.RoundTrip(req)
+		if err == nil {
+			proxy, _ := ph.transport.Proxy(req)
+			if proxy == nil {
+				break
+			}
+			// An error status that the proxy generates when it's overloaded or broken means
+			// that it has failed, just as if it couldn't be reached. (The same status from the
+			// server, which the proxy passes on, says nothing about the proxy.)
+			serr := &proxyStatusError{resp.Status, resp.StatusCode}
+			if !isProxyFailure(serr) || !isProxyGenerated(resp) {
+				ph.report(proxy.Host, nil)
+				break
+			}
+			logFor(req, "proxy", proxy.Host, "status", resp.StatusCode).
+				Warnf("Temporarily blocking proxy: %q (%v)", proxy.Host, serr)
+			ph.report(proxy.Host, serr)
+			if !isReplayable(req) {
+				// The proxy might have passed the request on before it failed, so sending it
+				// again could repeat its effects.
+				logFor(req).Debugf("Not retrying %s %s, since it isn't idempotent",
+					req.Method, req.URL)
+				break
 			}
-			log.Printf("[%d] Temporarily blocking proxy: %q", id, proxy.Host)
-			ph.block(proxy.Host)
+			next, ok := nextProxy(req)
+			if !ok {
+				// There's nothing else to try, so the client gets the proxy's response.
+				break
+			}
+			resp.Body.Close()
+			req = next
+			logFor(req, "route", describeProxy(req)).
+				Infof("Retrying %s %s via %s", req.Method, req.URL, describeProxy(req))
+			continue
 		}
-		return
+		logFor(req, "route", describeProxy(req), "error", err).
+			Errorf("Error forwarding request: %v", err)
+		if !isProxyConnectError(err) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		proxy, perr := ph.transport.Proxy(req)
+		if perr != nil || proxy == nil {
+			logFor(req, "error", perr).Errorf("Proxy connect error to unknown proxy: %v", perr)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		logFor(req, "proxy", proxy.Host, "error", err).
+			Warnf("Temporarily blocking proxy: %q", proxy.Host)
+		ph.report(proxy.Host, err)
+		next, ok := nextProxy(req)
+		if !ok {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		req = next
+		logFor(req, "route", describeProxy(req)).
+			Infof("Retrying %s %s via %s", req.Method, req.URL, describeProxy(req))
 	}
 	defer resp.Body.Close()
+	rec.setUpstreamStatus(resp.StatusCode)
 	if resp.StatusCode == http.StatusProxyAuthRequired && auth != nil {
-		log.Printf("[%d] Got %q response, retrying with auth", id, resp.Status)
+		logFor(req, "status", resp.StatusCode).
+			Debugf("Got %q response, retrying with auth", resp.Status)
 		_, err = rd.Seek(0, io.SeekStart)
 		if err != nil {
-			log.Printf("[%d] Error while seeking to start of request body: %v", id, err)
+			logFor(req, "error", err).Errorf("Error while seeking to start of request body: %v", err)
 		} else {
 			req.Body = io.NopCloser(rd)
+			rec.addAuthAttempt()
 			resp, err = auth.do(req, ph.transport)
 			if err != nil {
-				log.Printf("[%d] Error forwarding request (with auth): %v", id, err)
+				logFor(req, "error", err).Errorf("Error forwarding request (with auth): %v", err)
 				w.WriteHeader(http.StatusBadGateway)
 				return
 			}
 			defer resp.Body.Close()
+			rec.setUpstreamStatus(resp.StatusCode)
 		}
 	}
 	copyResponseHeaders(w, resp)
@@ -222,7 +441,7 @@ func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, au
 	if err != nil {
 		// The response status has already been sent, so if copying fails, we can't return
 		// an error status to the client.  Instead, log the error.
-		log.Printf("[%d] Error copying response body: %v", id, err)
+		logFor(req, "error", err).Warnf("Error copying response body: %v", err)
 		return
 	}
 }
@@ -1,4 +1,4 @@
-// Copyright 2019, 2021, 2022 The Alpaca Authors
+// Copyright 2019, 2021, 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -54,12 +54,12 @@ func (tp testProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func newDirectProxy() ProxyHandler {
-	return NewProxyHandler(nil, http.ProxyURL(nil), func(string) {})
+	return NewProxyHandler(nil, http.ProxyURL(nil), func(string, error) {})
 }
 
 func newChildProxy(parent *httptest.Server) http.Handler {
 	parentURL := &url.URL{Host: parent.Listener.Addr().String()}
-	childProxy := NewProxyHandler(nil, getProxyFromContext, func(string) {})
+	childProxy := NewProxyHandler(nil, getProxyFromContext, func(string, error) {})
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		ctx := context.WithValue(req.Context(), contextKeyProxy, parentURL)
 		reqWithProxy := req.WithContext(ctx)
@@ -357,3 +357,235 @@ func TestTransportReturnsProxyConnectOpError(t *testing.T) {
 	oe := err.(*net.OpError)
 	assert.Equal(t, "proxyconnect", oe.Op)
 }
+
+func TestGetOverTlsViaSOCKSProxy(t *testing.T) {
+	requests := make(chan string, 2)
+	server := httptest.NewTLSServer(testServer{requests})
+	defer server.Close()
+	socks := socks5Server(t)
+	defer socks.Close()
+	socksURL := &url.URL{Scheme: "socks5", Host: socks.Addr().String()}
+	child := NewProxyHandler(nil, getProxyFromContext, func(string, error) {})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- fmt.Sprintf("%s to proxy", req.Method)
+		ctx := context.WithValue(req.Context(), contextKeyProxy, socksURL)
+		child.ServeHTTP(w, req.WithContext(ctx))
+	}))
+	defer proxy.Close()
+	tr := &http.Transport{Proxy: proxyServer(t, proxy), TLSClientConfig: tlsConfig(server)}
+	testGetRequest(t, tr, server.URL)
+	require.Len(t, requests, 2)
+	assert.Equal(t, "CONNECT to proxy", <-requests)
+	assert.Equal(t, "GET to server", <-requests)
+}
+
+// newFailoverProxy returns a ProxyHandler that sends requests via each of the given proxies in
+// turn (as if they'd been returned by ProxyFinder), recording any that get blocked.
+func newFailoverProxy(blocked chan<- string, proxies ...*url.URL) http.Handler {
+	ph := NewProxyHandler(nil, getProxyFromContext, func(p string, err error) {
+		if err != nil {
+			blocked <- p
+		}
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), contextKeyProxy, proxies[0])
+		ctx = context.WithValue(ctx, contextKeyFallbacks, proxies[1:])
+		ph.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func deadProxy(t *testing.T) *url.URL {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	l.Close()
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestFailoverToNextProxy(t *testing.T) {
+	for _, tls := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TLS=%t", tls), func(t *testing.T) {
+			requests := make(chan string, 3)
+			var server *httptest.Server
+			if tls {
+				server = httptest.NewTLSServer(testServer{requests})
+			} else {
+				server = httptest.NewServer(testServer{requests})
+			}
+			defer server.Close()
+			parent := httptest.NewServer(testProxy{requests, "parent", newDirectProxy()})
+			defer parent.Close()
+			dead := deadProxy(t)
+			blocked := make(chan string, 1)
+			live := &url.URL{Scheme: "http", Host: parent.Listener.Addr().String()}
+			child := httptest.NewServer(newFailoverProxy(blocked, dead, live))
+			defer child.Close()
+			tr := &http.Transport{Proxy: proxyServer(t, child)}
+			if tls {
+				tr.TLSClientConfig = tlsConfig(server)
+			}
+			testGetRequest(t, tr, server.URL)
+			require.Len(t, blocked, 1)
+			assert.Equal(t, dead.Host, <-blocked)
+			require.Len(t, requests, 2)
+			if tls {
+				assert.Equal(t, "CONNECT to parent", <-requests)
+			} else {
+				assert.Equal(t, "GET to parent", <-requests)
+			}
+			assert.Equal(t, "GET to server", <-requests)
+		})
+	}
+}
+
+func TestFailoverToDirect(t *testing.T) {
+	requests := make(chan string, 1)
+	server := httptest.NewTLSServer(testServer{requests})
+	defer server.Close()
+	blocked := make(chan string, 2)
+	dead1, dead2 := deadProxy(t), deadProxy(t)
+	proxy := httptest.NewServer(newFailoverProxy(blocked, dead1, dead2, nil))
+	defer proxy.Close()
+	tr := &http.Transport{Proxy: proxyServer(t, proxy), TLSClientConfig: tlsConfig(server)}
+	testGetRequest(t, tr, server.URL)
+	require.Len(t, blocked, 2)
+	assert.Equal(t, dead1.Host, <-blocked)
+	assert.Equal(t, dead2.Host, <-blocked)
+	require.Len(t, requests, 1)
+	assert.Equal(t, "GET to server", <-requests)
+}
+
+func TestFailoverGivesUp(t *testing.T) {
+	blocked := make(chan string, 2)
+	proxy := httptest.NewServer(newFailoverProxy(blocked, deadProxy(t), deadProxy(t)))
+	defer proxy.Close()
+	tr := &http.Transport{Proxy: proxyServer(t, proxy)}
+	resp, err := tr.RoundTrip(httptest.NewRequest(http.MethodGet, "http://alpaca.test", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Len(t, blocked, 2)
+}
+
+// statusProxy is an upstream proxy that responds to every request with the given status. If
+// proxyStatus is set, it is sent as a Proxy-Status header, to say that the proxy generated the
+// response itself (rather than passing it on from the server).
+func statusProxy(t *testing.T, status int, proxyStatus string) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if proxyStatus != "" {
+			w.Header().Set("Proxy-Status", proxyStatus)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return &url.URL{Scheme: "http", Host: server.Listener.Addr().String()}
+}
+
+func TestFailoverOnProxyErrorStatus(t *testing.T) {
+	requests := make(chan string, 2)
+	server := httptest.NewServer(testServer{requests})
+	defer server.Close()
+	parent := httptest.NewServer(testProxy{requests, "parent", newDirectProxy()})
+	defer parent.Close()
+	overloaded := statusProxy(t, http.StatusServiceUnavailable,
+		"overloaded; error=proxy_internal_error")
+	blocked := make(chan string, 1)
+	live := &url.URL{Scheme: "http", Host: parent.Listener.Addr().String()}
+	child := httptest.NewServer(newFailoverProxy(blocked, overloaded, live))
+	defer child.Close()
+	testGetRequest(t, &http.Transport{Proxy: proxyServer(t, child)}, server.URL)
+	require.Len(t, blocked, 1)
+	assert.Equal(t, overloaded.Host, <-blocked)
+	require.Len(t, requests, 2)
+	assert.Equal(t, "GET to parent", <-requests)
+	assert.Equal(t, "GET to server", <-requests)
+}
+
+func TestProxyErrorStatusWithoutFailover(t *testing.T) {
+	const failed = "proxy; error=proxy_internal_error"
+	tests := []struct {
+		name        string
+		status      int
+		proxyStatus string
+		blocked     int
+	}{
+		// The proxy is blocked, but there's nothing else to try, so its response is returned.
+		{"InternalServerError", http.StatusInternalServerError, failed, 1},
+		{"ServiceUnavailable", http.StatusServiceUnavailable, failed, 1},
+		// 502 and 504 mean that the proxy couldn't reach the server, which isn't its fault.
+		{"BadGateway", http.StatusBadGateway, "proxy; error=destination_unavailable", 0},
+		{"GatewayTimeout", http.StatusGatewayTimeout, "proxy; error=connection_timeout", 0},
+		// An error from the server (passed on by the proxy) isn't the proxy's fault either.
+		{"FromServer", http.StatusServiceUnavailable, "", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocked := make(chan string, 1)
+			upstream := statusProxy(t, test.status, test.proxyStatus)
+			proxy := httptest.NewServer(newFailoverProxy(blocked, upstream))
+			defer proxy.Close()
+			tr := &http.Transport{Proxy: proxyServer(t, proxy)}
+			req := httptest.NewRequest(http.MethodGet, "http://alpaca.test", nil)
+			resp, err := tr.RoundTrip(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, test.status, resp.StatusCode)
+			assert.Len(t, blocked, test.blocked)
+		})
+	}
+}
+
+func TestNoFailoverForNonIdempotentRequest(t *testing.T) {
+	requests := make(chan string, 2)
+	parent := httptest.NewServer(testProxy{requests, "parent", newDirectProxy()})
+	defer parent.Close()
+	overloaded := statusProxy(t, http.StatusServiceUnavailable,
+		"overloaded; error=proxy_internal_error")
+	blocked := make(chan string, 1)
+	live := &url.URL{Scheme: "http", Host: parent.Listener.Addr().String()}
+	child := httptest.NewServer(newFailoverProxy(blocked, overloaded, live))
+	defer child.Close()
+	tr := &http.Transport{Proxy: proxyServer(t, child)}
+	req := httptest.NewRequest(http.MethodPost, "http://alpaca.test", strings.NewReader("data"))
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	// The proxy is blocked, but the request isn't sent again via the next one.
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Len(t, blocked, 1)
+	assert.Empty(t, requests)
+}
+
+func TestIsProxyGenerated(t *testing.T) {
+	header := func(kv ...string) *http.Response {
+		resp := &http.Response{Header: http.Header{}}
+		for i := 0; i < len(kv); i += 2 {
+			resp.Header.Add(kv[i], kv[i+1])
+		}
+		return resp
+	}
+	assert.False(t, isProxyGenerated(header()))
+	assert.False(t, isProxyGenerated(header("Proxy-Status", "proxy; received-status=503")))
+	assert.True(t, isProxyGenerated(header("Proxy-Status", "proxy; error=http_request_error")))
+	assert.True(t, isProxyGenerated(header("X-Squid-Error", "ERR_CONNECT_FAIL 111")))
+}
+
+func TestAuthForRequest(t *testing.T) {
+	listener := &authenticator{"LISTENER", "alice", "0123"}
+	ph := NewProxyHandler(listener, nil, nil)
+	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
+	assert.Equal(t, listener, ph.authFor(req))
+	// A network profile can override the listener's credentials, or turn them off.
+	profile := &authenticator{"PROFILE", "bob", "4567"}
+	ctx := context.WithValue(req.Context(), contextKeyAuth, profile)
+	assert.Equal(t, profile, ph.authFor(req.WithContext(ctx)))
+	ctx = context.WithValue(req.Context(), contextKeyAuth, (*authenticator)(nil))
+	assert.Nil(t, ph.authFor(req.WithContext(ctx)))
+	// The listener's credentials can be changed (by alpaca ctl) if they're in a store.
+	ph.creds = newCredentialStore(listener)
+	assert.Equal(t, listener, ph.authFor(req))
+	changed := &authenticator{"CTL", "carol", "89ab"}
+	ph.creds.set(changed)
+	assert.Equal(t, changed, ph.authFor(req))
+	assert.Equal(t, profile, ph.authFor(req.WithContext(
+		context.WithValue(req.Context(), contextKeyAuth, profile))))
+}
@@ -1,4 +1,4 @@
-// Copyright 2019, 2021, 2022 The Alpaca Authors
+// Copyright 2019, 2021, 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -17,16 +17,29 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const contextKeyProxy = contextKey("proxy")
+const (
+	contextKeyProxy     = contextKey("proxy")
+	contextKeyFallbacks = contextKey("fallbacks")
+	// contextKeyAuth is set when a network profile overrides the listener's credentials
+	contextKeyAuth = contextKey("auth")
+)
+
+// direct is the list of proxies for a request that should be sent directly to the server.
+var direct = []*url.URL{nil}
 
+// getProxyFromContext returns the proxy that ProxyFinder chose for the request, or nil if the
+// request should be sent directly.
 func getProxyFromContext(req *http.Request) (*url.URL, error) {
 	if value := req.Context().Value(contextKeyProxy); value != nil {
 		proxy := value.(*url.URL)
@@ -35,74 +48,343 @@ func getProxyFromContext(req *http.Request) (*url.URL, error) {
 	return nil, nil
 }
 
+// errBlocked is returned by findProxyForRequest when a rule says that a request should be blocked.
+var errBlocked = errors.New("request blocked by rule")
+
+// ProxyFinderConfig contains the configuration that a ProxyFinder uses to decide where to send
+// each request.
+type ProxyFinderConfig struct {
+	PACURLs []string     // PAC URLs to try (in order); if empty, the system's PAC URL is used
+	NoPAC   bool         // if true, don't use a PAC file at all; only Rules are used
+	Rules   []rule       // rules which are evaluated before the PAC file
+	Proxies string       // if set, upstream proxies to use instead of a PAC file
+	NoProxy *noProxyList // hosts that should bypass the upstream Proxies
+	// Profiles choose the PAC URL and credentials, depending on the network location
+	Profiles []*profile
+	// Probe checks whether we're connected to the network that a file: PAC URL is for
+	Probe *probe
+	// PACWait is how long requests wait for a PAC refresh that's in progress (zero means they
+	// use the current PAC script straight away)
+	PACWait time.Duration
+
+	HealthInterval time.Duration // how often to check upstream proxies (zero disables this)
+	HealthTimeout  time.Duration // how long to wait for each check
+	HealthCanary   string        // if set, the host:port that checks CONNECT to via each proxy
+}
+
+// pacState is what requests are routed with when using a PAC file. It's replaced as a whole once
+// a refresh has finished, so that requests never see a connected state (or a profile) without
+// the PAC script that goes with it.
+type pacState struct {
+	connected bool       // whether we're connected to the network that the PAC file is for
+	profile   *profile   // the profile that matched the network (if any)
+	runner    *PACRunner // the PAC script, which is only used if connected
+}
+
 type ProxyFinder struct {
-	runner  *PACRunner
+	state   atomic.Value // the current *pacState
 	fetcher *pacFetcher
 	wrapper *PACWrapper
 	blocked *blocklist
-	sync.Mutex
+	rules   []rule
+	proxies string
+	noProxy *noProxyList
+	health  *healthChecker
+	// healthHold is how long a proxy that fails its health check stays blocked
+	healthHold time.Duration
+	stopHealth context.CancelFunc // stops the health checks, if there are any
+	// watching is non-zero if updates are checked for when the network changes, rather than on
+	// each request. It's accessed atomically, since it's cleared if watching fails.
+	watching int32
+	changes  chan struct{} // network changes (or requests, if not watching) trigger refreshes
+	netlink  io.Closer     // stops watching for network changes, if alpaca is watching
+	done     chan struct{} // closed when the ProxyFinder is stopped
+	stopOnce sync.Once
+	// wait is how long requests wait for a refresh that's in progress, rather than using the
+	// PAC script that's currently loaded
+	wait       time.Duration
+	refreshing chan struct{} // closed when the refresh in progress finishes
+	refreshMux sync.Mutex    // guards refreshing
+	sync.Mutex               // held while refreshing
 }
 
-func NewProxyFinder(pacurl string, wrapper *PACWrapper) *ProxyFinder {
-	pf := &ProxyFinder{wrapper: wrapper, blocked: newBlocklist()}
-	pf.runner = new(PACRunner)
-	pf.fetcher = newPACFetcher(pacurl)
+func NewProxyFinder(config ProxyFinderConfig, wrapper *PACWrapper) *ProxyFinder {
+	pf := &ProxyFinder{
+		wrapper: wrapper,
+		blocked: newBlocklist(),
+		rules:   config.Rules,
+		proxies: config.Proxies,
+		noProxy: config.NoProxy,
+		wait:    config.PACWait,
+		done:    make(chan struct{}),
+	}
+	pf.state.Store(&pacState{})
+	if config.HealthInterval > 0 {
+		// A proxy that fails its health check is kept blocked until the next check has
+		// finished, allowing for that check to be delayed by a slow one.
+		pf.healthHold = 2*config.HealthInterval + config.HealthTimeout
+		pf.health = newHealthChecker(config.HealthCanary, config.HealthTimeout, pf.reportHealth)
+		ctx, cancel := context.WithCancel(context.Background())
+		pf.stopHealth = cancel
+		go pf.health.run(ctx, config.HealthInterval)
+	}
+	if config.NoPAC || config.Proxies != "" {
+		// Without a PAC file, alpaca makes all of the routing decisions, so the PAC file that
+		// we serve should send everything to alpaca.
+		wrapper.Wrap([]byte(`function FindProxyForURL(url, host) { return "PROXY alpaca"; }`))
+		return pf
+	}
+	pf.fetcher = newPACFetcher(config.PACURLs...)
+	pf.fetcher.profiles = config.Profiles
+	pf.fetcher.probe = config.Probe
+	// The PAC script is loaded before alpaca starts serving requests; after that, it's refreshed
+	// in the background.
 	pf.checkForUpdates()
+	pf.changes = make(chan struct{}, 1)
+	// If watching fails, requests go back to checking for changes themselves.
+	netlink, err := notifyNetworkChanges(pf.changes, func() { pf.setWatching(false) })
+	if err == nil {
+		pf.netlink = netlink
+		pf.setWatching(true)
+	} else if err != errNetworkChangesUnsupported {
+		warnf("Error watching for network changes, will check on each request: %v", err)
+	}
+	go pf.watchForUpdates(pf.changes)
 	return pf
 }
 
 func (pf *ProxyFinder) WrapHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		pf.checkForUpdates()
-		proxy, err := pf.findProxyForRequest(req)
-		if err != nil {
-			log.Printf("[%d] %v", req.Context().Value(contextKeyID), err)
+		if pf.fetcher != nil && !pf.isWatching() {
+			// Ask the background goroutine to check for network changes. If requests wait for
+			// refreshes, the check counts as a refresh in progress until it has finished, so
+			// that this request waits for it too.
+			if pf.wait > 0 {
+				pf.beginRefresh()
+			}
+			select {
+			case pf.changes <- struct{}{}:
+			default:
+				// There's already a check queued, which will end the refresh.
+			}
+		}
+		pf.waitForRefresh()
+		proxies, err := pf.findProxyForRequest(req)
+		if errors.Is(err, errBlocked) {
+			accessRecordFor(req).setRoute(resultBlock)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		} else if err != nil {
+			logFor(req, "error", err).Errorf("%v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if proxy != nil {
-			ctx := context.WithValue(req.Context(), contextKeyProxy, proxy)
-			req = req.WithContext(ctx)
+		ctx := context.WithValue(req.Context(), contextKeyProxy, proxies[0])
+		ctx = context.WithValue(ctx, contextKeyFallbacks, proxies[1:])
+		if p := pf.current().profile; p != nil && p.setAuth {
+			ctx = context.WithValue(ctx, contextKeyAuth, p.auth)
 		}
-		next.ServeHTTP(w, req)
+		next.ServeHTTP(w, req.WithContext(ctx))
 	})
 }
 
+// watchForUpdates checks for updates each time there's a network change, until the channel is
+// closed or the ProxyFinder is stopped.
+func (pf *ProxyFinder) watchForUpdates(changes <-chan struct{}) {
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+			pf.checkForUpdates()
+		case <-pf.done:
+			return
+		}
+	}
+}
+
+func (pf *ProxyFinder) isWatching() bool {
+	return atomic.LoadInt32(&pf.watching) != 0
+}
+
+func (pf *ProxyFinder) setWatching(watching bool) {
+	var v int32
+	if watching {
+		v = 1
+	}
+	atomic.StoreInt32(&pf.watching, v)
+}
+
+// waitForRefresh waits (for up to pf.wait) for a refresh that's in progress to finish, so that
+// the request can use the new PAC script.
+func (pf *ProxyFinder) waitForRefresh() {
+	if pf.wait <= 0 {
+		return
+	}
+	pf.refreshMux.Lock()
+	done := pf.refreshing
+	pf.refreshMux.Unlock()
+	if done == nil {
+		return
+	}
+	timer := time.NewTimer(pf.wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// beginRefresh marks a refresh (or a check for updates) as being in progress, if there isn't
+// one already.
+func (pf *ProxyFinder) beginRefresh() {
+	pf.refreshMux.Lock()
+	defer pf.refreshMux.Unlock()
+	if pf.refreshing == nil {
+		pf.refreshing = make(chan struct{})
+	}
+}
+
+// endRefresh marks the refresh in progress (if any) as finished, releasing any requests that
+// are waiting for it.
+func (pf *ProxyFinder) endRefresh() {
+	pf.refreshMux.Lock()
+	defer pf.refreshMux.Unlock()
+	if pf.refreshing != nil {
+		close(pf.refreshing)
+		pf.refreshing = nil
+	}
+}
+
+// checkForUpdates downloads the PAC script if the network has changed. Requests aren't blocked
+// while this happens; they keep using the current PAC script until the new one is loaded (unless
+// pf.wait is set).
 func (pf *ProxyFinder) checkForUpdates() {
+	if pf.fetcher == nil {
+		return
+	}
 	pf.Lock()
 	defer pf.Unlock()
-	pacjs := pf.fetcher.download()
+	if !pf.fetcher.monitor.addrsChanged() {
+		pf.endRefresh()
+		return
+	}
+	pf.refresh()
+}
+
+// reload downloads the PAC script again, even if the network hasn't changed (e.g. because the
+// PAC file has been changed on the server).
+func (pf *ProxyFinder) reload() {
+	if pf.fetcher == nil {
+		return
+	}
+	pf.Lock()
+	defer pf.Unlock()
+	pf.refresh()
+}
+
+// refresh downloads and loads the PAC script. It must be called with pf locked.
+func (pf *ProxyFinder) refresh() {
+	pf.beginRefresh()
+	defer pf.endRefresh()
+	pacjs := pf.fetcher.refresh()
+	connected, profile := pf.fetcher.isConnected(), pf.fetcher.activeProfile()
 	if pacjs == nil {
-		if !pf.fetcher.isConnected() {
-			pf.blocked = newBlocklist()
+		if !connected {
+			pf.blocked.clearFailures()
+			pf.health.reset()
 			pf.wrapper.Wrap(nil)
+			pf.state.Store(&pacState{profile: profile})
 		}
 		return
 	}
-	pf.blocked = newBlocklist()
-	if err := pf.runner.Update(pacjs); err != nil {
-		log.Printf("Error running PAC JS: %q", err)
-	} else {
-		pf.wrapper.Wrap(pacjs)
+	pf.blocked.clearFailures()
+	pf.health.reset()
+	runner := new(PACRunner)
+	if err := runner.Update(pacjs); err != nil {
+		// Requests keep using the current PAC script (or connect directly, if there isn't one).
+		logWith("error", err).Errorf("Error running PAC JS: %q", err)
+		return
+	}
+	pf.state.Store(&pacState{connected: connected, profile: profile, runner: runner})
+	pf.wrapper.Wrap(pacjs)
+}
+
+// current returns the state that requests are currently routed with.
+func (pf *ProxyFinder) current() *pacState {
+	return pf.state.Load().(*pacState)
+}
+
+// finderStatus describes how a ProxyFinder is currently choosing proxies.
+type finderStatus struct {
+	Mode      string      `json:"mode"` // "pac", "proxy" (for -P) or "direct"
+	PACURL    string      `json:"pacurl,omitempty"`
+	Profile   string      `json:"profile,omitempty"`
+	Connected bool        `json:"connected"`
+	Blocked   []blockInfo `json:"blocked"`
+}
+
+func (pf *ProxyFinder) status() finderStatus {
+	s := finderStatus{Mode: "direct", Blocked: pf.blocked.list()}
+	if pf.fetcher != nil {
+		s.Mode = "pac"
+		s.PACURL = pf.fetcher.pacSource()
+		st := pf.current()
+		s.Connected = st.connected
+		if p := st.profile; p != nil {
+			s.Profile = p.name
+		}
+	} else if pf.proxies != "" {
+		s.Mode = "proxy"
+		s.Connected = true
 	}
+	return s
 }
 
-func (pf *ProxyFinder) findProxyForRequest(req *http.Request) (*url.URL, error) {
-	id := req.Context().Value(contextKeyID)
+// findProxyForRequest returns the proxies that the request should be sent to, in the order that
+// they should be tried. A nil URL in this list means that the request should be sent directly.
+func (pf *ProxyFinder) findProxyForRequest(req *http.Request) ([]*url.URL, error) {
+	if r, ok := matchRules(req.Context(), pf.rules, req.URL); ok {
+		logFor(req).Debugf("%s %s matched rule on line %d", req.Method, req.URL, r.line)
+		return pf.parseProxyList(req, r.result)
+	}
+	if pf.proxies != "" {
+		if pf.noProxy.match(req.URL) {
+			logFor(req, "route", "DIRECT").
+				Infof(`%s %s via "DIRECT" (matched no_proxy)`, req.Method, req.URL)
+			return direct, nil
+		}
+		return pf.parseProxyList(req, pf.proxies)
+	}
 	if pf.fetcher == nil {
-		log.Printf(`[%d] %s %s via "DIRECT"`, id, req.Method, req.URL)
-		return nil, nil
+		logFor(req, "route", "DIRECT").Infof(`%s %s via "DIRECT"`, req.Method, req.URL)
+		return direct, nil
 	}
-	if !pf.fetcher.isConnected() {
-		log.Printf(`[%d] %s %s via "DIRECT" (not connected to PAC server)`,
-			id, req.Method, req.URL)
-		return nil, nil
+	st := pf.current()
+	if !st.connected {
+		if p := st.profile; p != nil && p.direct {
+			logFor(req, "route", "DIRECT", "profile", p.name).
+				Infof(`%s %s via "DIRECT" (network profile %q)`, req.Method, req.URL, p.name)
+		} else {
+			logFor(req, "route", "DIRECT").
+				Infof(`%s %s via "DIRECT" (not connected to PAC server)`, req.Method, req.URL)
+		}
+		return direct, nil
 	}
-	str, err := pf.runner.FindProxyForURL(*req.URL)
+	str, err := st.runner.FindProxyForRequest(req)
 	if err != nil {
 		return nil, err
 	}
-	var fallback *url.URL
+	return pf.parseProxyList(req, str)
+}
+
+// parseProxyList parses a list of proxies in the format returned by FindProxyForURL (e.g.
+// "PROXY proxy.test:8080; DIRECT") and returns the proxies that should be tried (in order), where
+// a nil URL means "DIRECT". Proxies that are currently blocked are moved to the end of the list.
+func (pf *ProxyFinder) parseProxyList(req *http.Request, str string) ([]*url.URL, error) {
+	var proxies, blocked []*url.URL
+	var first string
 	for _, elem := range strings.Split(str, ";") {
 		fields := strings.Fields(strings.TrimSpace(elem))
 		var scheme string
@@ -110,39 +392,144 @@ func (pf *ProxyFinder) findProxyForRequest(req *http.Request) (*url.URL, error)
 		if len(fields) == 0 {
 			continue
 		} else if fields[0] == "DIRECT" {
-			log.Printf("[%d] %s %s via %q", id, req.Method, req.URL, elem)
-			return nil, nil
+			// Connecting directly is always the last resort, so there's no need to look at
+			// anything that comes after it.
+			if first == "" {
+				first = elem
+			}
+			proxies = append(proxies, nil)
+			break
+		} else if fields[0] == resultBlock {
+			logFor(req, "route", resultBlock).Infof("%s %s blocked", req.Method, req.URL)
+			return nil, errBlocked
+		} else if len(fields) < 2 {
+			logFor(req).Warnf("Couldn't parse proxy: %q", elem)
+			continue
 		} else if fields[0] == "PROXY" || fields[0] == "HTTP" {
 			scheme = "http"
 			defaultPort = "80"
 		} else if fields[0] == "HTTPS" {
 			scheme = "https"
 			defaultPort = "443"
+		} else if fields[0] == "SOCKS" || fields[0] == "SOCKS5" {
+			scheme = "socks5"
+			defaultPort = "1080"
 		} else {
-			log.Printf("[%d] Couldn't parse proxy: %q", id, elem)
+			logFor(req).Warnf("Couldn't parse proxy: %q", elem)
 			continue
 		}
 		proxy := &url.URL{Scheme: scheme, Host: fields[1]}
 		if proxy.Port() == "" {
 			proxy.Host = net.JoinHostPort(proxy.Host, defaultPort)
 		}
+		pf.health.watch(proxy)
 		if pf.blocked.contains(proxy.Host) {
-			if fallback == nil {
-				fallback = proxy
-			}
+			blocked = append(blocked, proxy)
 			continue
 		}
-		log.Printf("[%d] %s %s via %q", id, req.Method, req.URL, elem)
-		return proxy, nil
+		if first == "" {
+			first = elem
+		}
+		proxies = append(proxies, proxy)
+	}
+	if len(proxies) == 0 && len(blocked) == 0 {
+		return nil, errors.New("no proxies available")
 	}
-	if fallback != nil {
+	if len(proxies) == 0 {
 		// All the proxies are currently blocked. In this case, we'll temporarily ignore the
-		// blocklist and fall back to the first proxy that we saw (and skipped).
-		return fallback, nil
+		// blocklist and fall back to the proxies that we skipped.
+		logFor(req, "route", blocked[0].Host).
+			Warnf("%s %s via %q (all proxies are blocked)", req.Method, req.URL, blocked[0].Host)
+	} else {
+		route := "DIRECT"
+		if proxies[0] != nil {
+			route = proxies[0].Host
+		}
+		logFor(req, "route", route).
+			Infof("%s %s via %q", req.Method, req.URL, strings.TrimSpace(first))
+	}
+	return append(proxies, blocked...), nil
+}
+
+// nextProxy returns a copy of the request that will be sent via the next proxy in the list chosen
+// by ProxyFinder (in case the current one has failed), or false if there are none left to try.
+func nextProxy(req *http.Request) (*http.Request, bool) {
+	fallbacks, _ := req.Context().Value(contextKeyFallbacks).([]*url.URL)
+	if len(fallbacks) == 0 {
+		return nil, false
+	}
+	ctx := context.WithValue(req.Context(), contextKeyProxy, fallbacks[0])
+	ctx = context.WithValue(ctx, contextKeyFallbacks, fallbacks[1:])
+	return req.WithContext(ctx), true
+}
+
+// reportProxy records whether a request via a proxy succeeded (if err is nil) or failed. Proxies
+// which fail are temporarily blocked, for longer each time they fail in a row.
+func (pf *ProxyFinder) reportProxy(proxy string, err error) {
+	if err == nil {
+		pf.blocked.succeed(proxy)
+	} else {
+		pf.blocked.fail(proxy, err)
+	}
+}
+
+// reportHealth records the result of a proxy's health check. Unlike a failed request, a failed
+// health check keeps the proxy blocked until the next check, even if its blocklist entry would
+// otherwise have expired.
+func (pf *ProxyFinder) reportHealth(proxy string, err error) {
+	if err == nil {
+		pf.blocked.succeed(proxy)
+	} else {
+		pf.blocked.hold(proxy, err, pf.healthHold)
 	}
-	return nil, errors.New("no proxies available")
 }
 
-func (pf *ProxyFinder) blockProxy(proxy string) {
-	pf.blocked.add(proxy)
+// stop stops the ProxyFinder's background goroutines: the health checks (if there are any), and
+// watching for network changes.
+func (pf *ProxyFinder) stop() {
+	pf.stopOnce.Do(func() {
+		if pf.stopHealth != nil {
+			pf.stopHealth()
+		}
+		if pf.netlink != nil {
+			pf.netlink.Close()
+		}
+		close(pf.done)
+	})
+}
+
+// parseProxyFlag converts a list of proxies given on the command line (e.g.
+// "proxy1:8080;proxy2:8080") into the format returned by FindProxyForURL (e.g. "PROXY
+// proxy1:8080; PROXY proxy2:8080"). Proxies may also be given as URLs with an http, https or
+// socks5 scheme, and "DIRECT" can be used to fall back to connecting directly.
+func parseProxyFlag(value string) (string, error) {
+	var elems []string
+	for _, s := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	}) {
+		if s == "DIRECT" {
+			elems = append(elems, s)
+			continue
+		}
+		if !strings.Contains(s, "://") {
+			s = "http://" + s
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", err
+		} else if u.Host == "" {
+			return "", fmt.Errorf("missing host in proxy %q", s)
+		}
+		switch u.Scheme {
+		case "http":
+			elems = append(elems, "PROXY "+u.Host)
+		case "https":
+			elems = append(elems, "HTTPS "+u.Host)
+		case "socks", "socks5":
+			elems = append(elems, "SOCKS5 "+u.Host)
+		default:
+			return "", fmt.Errorf("unsupported scheme in proxy %q", s)
+		}
+	}
+	return strings.Join(elems, "; "), nil
 }
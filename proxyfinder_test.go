@@ -1,4 +1,4 @@
-// Copyright 2019, 2021, 2022 The Alpaca Authors
+// Copyright 2019, 2021, 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -19,7 +19,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -37,7 +40,8 @@ func TestFindProxyForRequest(t *testing.T) {
 		{"Direct", "return 'DIRECT'", false, ""},
 		{"Proxy", "return 'PROXY proxy.test:2'", false, "proxy.test:2"},
 		{"ProxyWithoutPort", "return 'PROXY proxy.test'", false, "proxy.test:80"},
-		{"Socks", "return 'SOCKS socksproxy.test:3'", true, "socksproxy.test:3"},
+		{"Socks", "return 'SOCKS socksproxy.test:3'", false, "socksproxy.test:3"},
+		{"SocksWithoutPort", "return 'SOCKS5 socksproxy.test'", false, "socksproxy.test:1080"},
 		{"Http", "return 'HTTP http.test:4'", false, "http.test:4"},
 		{"HttpWithoutPort", "return 'HTTP http.test'", false, "http.test:80"},
 		{"Https", "return 'HTTPS https.test:5'", false, "https.test:5"},
@@ -50,44 +54,58 @@ func TestFindProxyForRequest(t *testing.T) {
 			server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
 			defer server.Close()
 			pw := NewPACWrapper(PACData{Port: 1})
-			pf := NewProxyFinder(server.URL, pw)
+			pf := NewProxyFinder(ProxyFinderConfig{PACURLs: []string{server.URL}}, pw)
 			req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
 			ctx := context.WithValue(req.Context(), contextKeyID, i)
 			req = req.WithContext(ctx)
-			proxy, err := pf.findProxyForRequest(req)
+			proxies, err := pf.findProxyForRequest(req)
 			if test.expectError {
 				assert.NotNil(t, err)
 				return
 			}
 			require.NoError(t, err)
 			if test.expected == "" {
-				assert.Nil(t, proxy)
+				assert.Equal(t, direct, proxies)
 				return
 			}
-			require.NotNil(t, proxy)
-			assert.Equal(t, test.expected, proxy.Host)
+			require.NotEmpty(t, proxies)
+			assert.Equal(t, test.expected, proxies[0].Host)
 		})
 	}
 }
 
 func TestFallbackToDirectWhenNotConnected(t *testing.T) {
-	url := "http://pacserver.invalid/nonexistent.pac"
+	pacurls := []string{"http://pacserver.invalid/nonexistent.pac"}
 	pw := NewPACWrapper(PACData{Port: 1})
-	pf := NewProxyFinder(url, pw)
+	pf := NewProxyFinder(ProxyFinderConfig{PACURLs: pacurls}, pw)
 	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
-	proxy, err := pf.findProxyForRequest(req)
+	proxies, err := pf.findProxyForRequest(req)
 	require.NoError(t, err)
-	assert.Nil(t, proxy)
+	assert.Equal(t, direct, proxies)
+}
+
+func TestFallbackToDirectWhenPACFileIsInvalid(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler("function FindProxyForURL(")))
+	defer server.Close()
+	pf := NewProxyFinder(ProxyFinderConfig{PACURLs: []string{server.URL}},
+		NewPACWrapper(PACData{Port: 1}))
+	// The PAC file was downloaded, but since it couldn't be loaded, there's no script to run.
+	assert.True(t, pf.fetcher.isConnected())
+	assert.False(t, pf.status().Connected)
+	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
+	proxies, err := pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, direct, proxies)
 }
 
 func TestFallbackToDirectWhenNoPACURL(t *testing.T) {
-	url := ""
+	var pacurls []string
 	pw := NewPACWrapper(PACData{Port: 1})
-	pf := NewProxyFinder(url, pw)
+	pf := NewProxyFinder(ProxyFinderConfig{PACURLs: pacurls}, pw)
 	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
-	proxy, err := pf.findProxyForRequest(req)
+	proxies, err := pf.findProxyForRequest(req)
 	require.NoError(t, err)
-	assert.Nil(t, proxy)
+	assert.Equal(t, direct, proxies)
 }
 
 func TestSkipBadProxies(t *testing.T) {
@@ -95,19 +113,309 @@ func TestSkipBadProxies(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
 	defer server.Close()
 	pw := NewPACWrapper(PACData{Port: 1})
-	pf := NewProxyFinder(server.URL, pw)
+	pf := NewProxyFinder(ProxyFinderConfig{PACURLs: []string{server.URL}}, pw)
 	req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
 	ctx := context.WithValue(req.Context(), contextKeyID, 0)
 	req = req.WithContext(ctx)
-	proxy, err := pf.findProxyForRequest(req)
+	proxies, err := pf.findProxyForRequest(req)
 	require.NoError(t, err)
-	assert.Equal(t, "primary:80", proxy.Host)
+	assert.Equal(t, "primary:80", proxies[0].Host)
 	pf.blocked.add("primary:80")
-	proxy, err = pf.findProxyForRequest(req)
+	proxies, err = pf.findProxyForRequest(req)
 	require.NoError(t, err)
-	assert.Equal(t, "backup:80", proxy.Host)
+	assert.Equal(t, "backup:80", proxies[0].Host)
 	pf.blocked.add("backup:80")
-	proxy, err = pf.findProxyForRequest(req)
+	proxies, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "primary:80", proxies[0].Host)
+	assert.Equal(t, "backup:80", proxies[1].Host)
+}
+
+func TestProxyListOrder(t *testing.T) {
+	pf := NewProxyFinder(ProxyFinderConfig{NoPAC: true}, NewPACWrapper(PACData{Port: 1}))
+	req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
+	pf.blocked.add("b:80")
+	proxies, err := pf.parseProxyList(req, "PROXY a:80; PROXY b:80; PROXY c:80; DIRECT; PROXY d")
+	require.NoError(t, err)
+	// Blocked proxies go last, and nothing after DIRECT is used.
+	require.Len(t, proxies, 4)
+	assert.Equal(t, "a:80", proxies[0].Host)
+	assert.Equal(t, "c:80", proxies[1].Host)
+	assert.Nil(t, proxies[2])
+	assert.Equal(t, "b:80", proxies[3].Host)
+}
+
+func TestRulesOverridePAC(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "PROXY pac.test:80" }`
+	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
+	defer server.Close()
+	rules, err := parseRules(strings.NewReader(`
+		host=direct.test                 DIRECT
+		host=*.partner.test              PROXY partner.test:3128
+		host=blocked.test                BLOCK
+	`))
+	require.NoError(t, err)
+	config := ProxyFinderConfig{PACURLs: []string{server.URL}, Rules: rules}
+	pf := NewProxyFinder(config, NewPACWrapper(PACData{Port: 1}))
+	tests := []struct {
+		url      string
+		expected string
+		err      error
+	}{
+		{"http://direct.test", "", nil},
+		{"http://www.partner.test", "partner.test:3128", nil},
+		{"http://blocked.test", "", errBlocked},
+		{"http://other.test", "pac.test:80", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			proxies, err := pf.findProxyForRequest(req)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			if test.expected == "" {
+				assert.Equal(t, direct, proxies)
+			} else {
+				require.NotEmpty(t, proxies)
+				assert.Equal(t, test.expected, proxies[0].Host)
+			}
+		})
+	}
+}
+
+func TestRulesWithoutPAC(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+		host=*.partner.test              SOCKS partner.test
+		host=blocked.test                BLOCK
+	`))
+	require.NoError(t, err)
+	pw := NewPACWrapper(PACData{Port: 1})
+	pf := NewProxyFinder(ProxyFinderConfig{NoPAC: true, Rules: rules}, pw)
+	assert.Nil(t, pf.fetcher)
+	// Since alpaca is making all of the decisions, the wrapped PAC should send everything to us.
+	assert.Contains(t, pw.alpacaPAC, `"PROXY localhost:1"`)
+	handler := pf.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxy, err := getProxyFromContext(req)
+		require.NoError(t, err)
+		if proxy == nil {
+			fmt.Fprint(w, "DIRECT")
+		} else {
+			fmt.Fprint(w, proxy.String())
+		}
+	}))
+	tests := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"http://www.partner.test", http.StatusOK, "socks5://partner.test:1080"},
+		{"http://blocked.test", http.StatusForbidden, ""},
+		{"http://other.test", http.StatusOK, "DIRECT"},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+			assert.Equal(t, test.status, w.Code)
+			assert.Equal(t, test.body, w.Body.String())
+		})
+	}
+}
+
+func TestParseProxyFlag(t *testing.T) {
+	tests := []struct {
+		input, expected string
+	}{
+		{"proxy1:8080;proxy2:8080", "PROXY proxy1:8080; PROXY proxy2:8080"},
+		{"proxy1:8080, DIRECT", "PROXY proxy1:8080; DIRECT"},
+		{"https://proxy:443;socks5://socks:1080", "HTTPS proxy:443; SOCKS5 socks:1080"},
+		{"http://proxy", "PROXY proxy"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			actual, err := parseProxyFlag(test.input)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+	_, err := parseProxyFlag("ftp://proxy:21")
+	assert.Error(t, err)
+}
+
+func TestStaticProxies(t *testing.T) {
+	list, err := parseProxyFlag("primary:8080;backup:8080")
+	require.NoError(t, err)
+	config := ProxyFinderConfig{Proxies: list, NoProxy: parseNoProxy(".internal.test")}
+	pf := NewProxyFinder(config, NewPACWrapper(PACData{Port: 1}))
+	assert.Nil(t, pf.fetcher)
+	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
+	proxies, err := pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "primary:8080", proxies[0].Host)
+	pf.blocked.add("primary:8080")
+	proxies, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "backup:8080", proxies[0].Host)
+	req = httptest.NewRequest(http.MethodGet, "http://host.internal.test", nil)
+	proxies, err = pf.findProxyForRequest(req)
 	require.NoError(t, err)
-	assert.Equal(t, "primary:80", proxy.Host)
+	assert.Equal(t, direct, proxies)
+}
+
+func TestCheckForUpdatesOnNetworkChange(t *testing.T) {
+	var mux sync.Mutex
+	result := "PROXY first:80"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		fmt.Fprintf(w, "function FindProxyForURL(url, host) { return %q }", result)
+	}))
+	defer server.Close()
+	pf := NewProxyFinder(ProxyFinderConfig{PACURLs: []string{server.URL}},
+		NewPACWrapper(PACData{Port: 1}))
+	nm := &fakeNetMonitor{}
+	pf.Lock()
+	pf.fetcher.monitor = nm
+	pf.setWatching(true)
+	pf.Unlock()
+	var proxy string
+	handler := pf.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, err := getProxyFromContext(req)
+		require.NoError(t, err)
+		proxy = u.Host
+	}))
+	get := func() string {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet,
+			"http://www.test", nil))
+		return proxy
+	}
+	assert.Equal(t, "first:80", get())
+	mux.Lock()
+	result = "PROXY second:80"
+	mux.Unlock()
+	pf.Lock()
+	nm.changed = true
+	pf.Unlock()
+	// Requests don't check for updates, since the ProxyFinder is watching for network changes.
+	assert.Equal(t, "first:80", get())
+	changes := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		pf.watchForUpdates(changes)
+		close(done)
+	}()
+	changes <- struct{}{}
+	close(changes)
+	<-done
+	assert.Equal(t, "second:80", get())
+}
+
+func TestStopWatchingForUpdates(t *testing.T) {
+	pf := NewProxyFinder(ProxyFinderConfig{NoPAC: true}, NewPACWrapper(PACData{Port: 1}))
+	done := make(chan struct{})
+	go func() {
+		pf.watchForUpdates(make(chan struct{}))
+		close(done)
+	}()
+	pf.stop()
+	pf.stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "stop didn't stop watching for updates")
+	}
+}
+
+func TestRefreshDoesntBlockRequests(t *testing.T) {
+	var mux sync.Mutex
+	result, blocking := "PROXY first:80", false
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		r, b := result, blocking
+		mux.Unlock()
+		if b {
+			<-release
+		}
+		fmt.Fprintf(w, "function FindProxyForURL(url, host) { return %q }", r)
+	}))
+	defer server.Close()
+	pf := NewProxyFinder(ProxyFinderConfig{PACURLs: []string{server.URL}},
+		NewPACWrapper(PACData{Port: 1}))
+	pf.Lock()
+	pf.fetcher.monitor = &fakeNetMonitor{changed: true}
+	pf.setWatching(true)
+	pf.Unlock()
+	var proxy string
+	handler := pf.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, err := getProxyFromContext(req)
+		require.NoError(t, err)
+		proxy = u.Host
+	}))
+	get := func() string {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet,
+			"http://www.test", nil))
+		return proxy
+	}
+	mux.Lock()
+	result, blocking = "PROXY second:80", true
+	mux.Unlock()
+	go pf.checkForUpdates()
+	for {
+		pf.refreshMux.Lock()
+		refreshing := pf.refreshing != nil
+		pf.refreshMux.Unlock()
+		if refreshing {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// While the PAC file is being downloaded, requests use the current one.
+	assert.Equal(t, "first:80", get())
+	// If requests are allowed to wait, they use the new PAC file once it's been downloaded.
+	pf.wait = 5 * time.Second
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	assert.Equal(t, "second:80", get())
+}
+
+func TestRequestWaitsForCheckWhenNotWatching(t *testing.T) {
+	var mux sync.Mutex
+	result := "PROXY first:80"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		fmt.Fprintf(w, "function FindProxyForURL(url, host) { return %q }", result)
+	}))
+	defer server.Close()
+	config := ProxyFinderConfig{PACURLs: []string{server.URL}, PACWait: 5 * time.Second}
+	pf := NewProxyFinder(config, NewPACWrapper(PACData{Port: 1}))
+	nm := &fakeNetMonitor{}
+	pf.Lock()
+	pf.fetcher.monitor = nm
+	pf.setWatching(false)
+	pf.Unlock()
+	var proxy string
+	handler := pf.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, err := getProxyFromContext(req)
+		require.NoError(t, err)
+		proxy = u.Host
+	}))
+	get := func() string {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet,
+			"http://www.test", nil))
+		return proxy
+	}
+	assert.Equal(t, "first:80", get())
+	mux.Lock()
+	result = "PROXY second:80"
+	mux.Unlock()
+	pf.Lock()
+	nm.changed = true
+	pf.Unlock()
+	// The request that notices the network change waits for the new PAC file.
+	assert.Equal(t, "second:80", get())
+	assert.Equal(t, "second:80", get())
 }
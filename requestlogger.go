@@ -1,4 +1,4 @@
-// Copyright 2019 The Alpaca Authors
+// Copyright 2019, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -15,13 +15,17 @@
 package main
 
 import (
-	"log"
+	"bufio"
+	"errors"
+	"net"
 	"net/http"
+	"time"
 )
 
 type statusWriter struct {
 	http.ResponseWriter
 	status int
+	bytes  int64
 }
 
 func (w *statusWriter) WriteHeader(status int) {
@@ -29,16 +33,35 @@ func (w *statusWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack lets ProxyHandler take over the connection for CONNECT requests, if the wrapped
+// ResponseWriter supports it.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+	return h.Hijack()
+}
+
 func RequestLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
 		next.ServeHTTP(sw, req)
-		log.Printf(
-			"[%v] %d %s %s",
-			req.Context().Value(contextKeyID),
-			sw.status,
-			req.Method,
-			req.URL,
-		)
+		entry := logFor(req, "status", sw.status, "bytes", sw.bytes, "duration",
+			time.Since(start))
+		// If access control is being used, the client's address and username are logged too.
+		if ci, ok := req.Context().Value(contextKeyClient).(*clientInfo); ok {
+			entry.with("client", ci.client, "user", ci.user).Infof("%s %s %d %s %s",
+				ci.client, ci.user, sw.status, req.Method, req.URL)
+			return
+		}
+		entry.Infof("%d %s %s", sw.status, req.Method, req.URL)
 	})
 }
@@ -0,0 +1,117 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that is rotated once it reaches a maximum size: the file is renamed
+// to path.1 (and any older files to path.2, path.3, and so on, up to the number of backups that
+// are kept), and a new file is started.
+type rotatingFile struct {
+	path    string
+	maxSize int64 // the size at which the file is rotated (or 0 to never rotate it)
+	backups int   // the number of rotated files to keep
+	f       *os.File
+	size    int64
+	// shifted is set if the files have been renamed, but the new file couldn't be opened, so
+	// that the next rotation doesn't rename them again (and push out the oldest backups).
+	shifted bool
+	mux     sync.Mutex
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f, size, err := openSized(path)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, backups: backups, f: f, size: size}, nil
+}
+
+// openLogFile opens a log file for appending (and can be replaced by tests).
+var openLogFile = openAppend
+
+// openSized opens a file for appending, and returns its current size.
+func openSized(path string) (*os.File, int64, error) {
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past the maximum size.
+// Each call to Write should be a whole line, since lines aren't split across files.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			// Carry on writing to the current file, rather than losing the line.
+			warnf("Error rotating %s: %v", rf.path, err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file (and any older ones), and opens a new file in its place. The current
+// file is only closed once the new one is open, so if rotating fails, lines are still written to
+// it (even if it's already been renamed).
+func (rf *rotatingFile) rotate() error {
+	if !rf.shifted {
+		if err := rf.shift(); err != nil {
+			return err
+		}
+		rf.shifted = true
+	}
+	f, size, err := openSized(rf.path)
+	if err != nil {
+		return err
+	}
+	rf.f.Close()
+	rf.f, rf.size, rf.shifted = f, size, false
+	if rf.backups == 0 {
+		// Without any backups, the file is only renamed so that it can be removed once it's
+		// been closed.
+		return os.Remove(rf.path + ".1")
+	}
+	return nil
+}
+
+func (rf *rotatingFile) shift() error {
+	for i := rf.backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(rf.path, rf.path+".1")
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+	return rf.f.Close()
+}
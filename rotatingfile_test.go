@@ -0,0 +1,98 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, path string) string {
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, os.WriteFile(path, []byte("old\n"), 0644))
+	rf, err := openRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer rf.Close()
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n",
+		"seven\n"} {
+		_, err := rf.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	// Each file holds as many lines as fit in 10 bytes, and only two old files are kept.
+	assert.Equal(t, "six\nseven\n", readFile(t, path))
+	assert.Equal(t, "four\nfive\n", readFile(t, path+".1"))
+	assert.Equal(t, "two\nthree\n", readFile(t, path+".2"))
+	assert.NoFileExists(t, path+".3")
+}
+
+func TestRotatingFileWithoutBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := openRotatingFile(path, 8, 0)
+	require.NoError(t, err)
+	defer rf.Close()
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		_, err := rf.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "three\n", readFile(t, path))
+	assert.NoFileExists(t, path+".1")
+}
+
+func TestRotatingFileMaxSizeZero(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := openRotatingFile(path, 0, 2)
+	require.NoError(t, err)
+	defer rf.Close()
+	for i := 0; i < 100; i++ {
+		_, err := rf.Write([]byte("line\n"))
+		require.NoError(t, err)
+	}
+	assert.Len(t, readFile(t, path), 500)
+	assert.NoFileExists(t, path+".1")
+}
+
+func TestRotatingFileOpenFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, os.WriteFile(path+".1", []byte("older\n"), 0644))
+	rf, err := openRotatingFile(path, 8, 2)
+	require.NoError(t, err)
+	defer rf.Close()
+	defer func() { openLogFile = openAppend }()
+	openLogFile = func(string) (*os.File, error) { return nil, errors.New("no space left") }
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		_, err := rf.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	// The files are only shifted once, and lines are still written to the old file.
+	assert.NoFileExists(t, path)
+	assert.Equal(t, "one\ntwo\nthree\nfour\n", readFile(t, path+".1"))
+	assert.Equal(t, "older\n", readFile(t, path+".2"))
+	openLogFile = openAppend
+	_, err = rf.Write([]byte("five\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "five\n", readFile(t, path))
+	assert.Equal(t, "older\n", readFile(t, path+".2"))
+}
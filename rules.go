@@ -0,0 +1,204 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+// A rule is a static routing rule, which is evaluated before the PAC script. Rules are read from
+// a file with one rule per line. Each rule consists of zero or more conditions (all of which
+// must match), followed by a result in the same format as the return value of FindProxyForURL,
+// or "BLOCK" to refuse the request. For example:
+//
+//	# Send a partner's domain through their proxy
+//	host=*.partner.example                  PROXY proxy.partner.example:8080; DIRECT
+//	# Always go direct to internal networks
+//	cidr=10.0.0.0/8                         DIRECT
+//	scheme=http host=*.ads.example          BLOCK
+//	port=25                                 BLOCK
+//
+// The conditions are:
+//   - host: a shell expression (as for shExpMatch) which must match the URL's hostname
+//   - cidr: a network which must contain the (resolved) IP address of the URL's hostname
+//   - scheme: the URL's scheme (CONNECT requests are treated as "https")
+//   - port: the URL's port (or the default port for the scheme)
+type rule struct {
+	line   int
+	host   glob.Glob
+	cidr   *net.IPNet
+	scheme string
+	port   string
+	result string
+}
+
+// resultBlock is the result of a rule that refuses to send the request anywhere.
+const resultBlock = "BLOCK"
+
+func loadRules(path string) ([]rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRules(f)
+}
+
+func parseRules(r io.Reader) ([]rule, error) {
+	var rules []rule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		r.line = n
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+func parseRule(line string) (rule, error) {
+	var r rule
+	fields := strings.Fields(line)
+	i := 0
+	for ; i < len(fields); i++ {
+		kv := strings.SplitN(fields[i], "=", 2)
+		if len(kv) != 2 {
+			break
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "host":
+			g, err := glob.Compile(value)
+			if err != nil {
+				return r, fmt.Errorf("invalid host pattern %q: %w", value, err)
+			}
+			r.host = g
+		case "cidr":
+			_, ipnet, err := net.ParseCIDR(value)
+			if err != nil {
+				return r, err
+			}
+			r.cidr = ipnet
+		case "scheme":
+			r.scheme = strings.ToLower(value)
+		case "port":
+			r.port = value
+		default:
+			return r, fmt.Errorf("unknown condition %q", key)
+		}
+	}
+	r.result = strings.Join(fields[i:], " ")
+	if r.result == "" {
+		return r, errors.New("missing result")
+	}
+	keyword := strings.Fields(r.result)[0]
+	switch keyword {
+	case "DIRECT", "PROXY", "HTTP", "HTTPS", "SOCKS", "SOCKS5", resultBlock:
+	default:
+		return r, fmt.Errorf("invalid result %q", r.result)
+	}
+	return r, nil
+}
+
+// match reports whether the rule matches the given URL. The lookupIP function is only called
+// if the rule has a cidr condition and the hostname isn't an IP address.
+func (r rule) match(u *url.URL, lookupIP func(string) []net.IP) bool {
+	scheme := u.Scheme
+	if scheme == "" {
+		// As in PACRunner, assume that a URL without a scheme came from a CONNECT request.
+		scheme = "https"
+	}
+	hostname := u.Hostname()
+	if r.scheme != "" && r.scheme != scheme {
+		return false
+	}
+	if r.port != "" {
+		port := u.Port()
+		if port == "" {
+			port = defaultPorts[scheme]
+		}
+		if r.port != port {
+			return false
+		}
+	}
+	if r.host != nil && !r.host.Match(hostname) {
+		return false
+	}
+	if r.cidr != nil {
+		ips := []net.IP{net.ParseIP(hostname)}
+		if ips[0] == nil {
+			ips = lookupIP(hostname)
+		}
+		for _, ip := range ips {
+			if r.cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443", "ws": "80", "wss": "443"}
+
+// ruleLookupTimeout is how long to wait for a hostname to be resolved, when matching it against a
+// cidr rule. If it takes longer than this, the cidr rule doesn't match.
+var ruleLookupTimeout = 5 * time.Second
+
+// lookupIPAddr resolves hostnames for cidr rules (and can be replaced in tests).
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// matchRules returns the first rule that matches the given URL (if there is one). The hostname is
+// resolved (at most once) if there's a cidr rule to match it against, until the context is done
+// or ruleLookupTimeout has passed.
+func matchRules(ctx context.Context, rules []rule, u *url.URL) (rule, bool) {
+	var ips []net.IP
+	var resolved bool
+	lookupIP := func(host string) []net.IP {
+		if !resolved {
+			ctx, cancel := context.WithTimeout(ctx, ruleLookupTimeout)
+			addrs, _ := lookupIPAddr(ctx, host)
+			cancel()
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+			resolved = true
+		}
+		return ips
+	}
+	for _, r := range rules {
+		if r.match(u, lookupIP) {
+			return r, true
+		}
+	}
+	return rule{}, false
+}
@@ -0,0 +1,143 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+		# comment
+		host=*.partner.test                  PROXY proxy.partner.test:8080; DIRECT
+
+		cidr=10.0.0.0/8 port=443             DIRECT
+		scheme=http                          BLOCK
+	`))
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+	assert.Equal(t, 3, rules[0].line)
+	assert.Equal(t, "PROXY proxy.partner.test:8080; DIRECT", rules[0].result)
+	assert.Equal(t, "10.0.0.0/8", rules[1].cidr.String())
+	assert.Equal(t, "443", rules[1].port)
+	assert.Equal(t, "http", rules[2].scheme)
+	assert.Equal(t, resultBlock, rules[2].result)
+}
+
+func TestParseInvalidRules(t *testing.T) {
+	tests := []struct {
+		name, line string
+	}{
+		{"MissingResult", "host=*.test"},
+		{"InvalidResult", "host=*.test NOWHERE"},
+		{"UnknownCondition", "path=/foo DIRECT"},
+		{"InvalidCIDR", "cidr=10.0.0.0 DIRECT"},
+		{"InvalidGlob", "host=[ DIRECT"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseRules(strings.NewReader(test.line))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+		host=*.partner.test                  PROXY proxy.partner.test:8080
+		cidr=10.0.0.0/8 port=443             DIRECT
+		scheme=http port=8080                BLOCK
+	`))
+	require.NoError(t, err)
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"http://www.partner.test/", "PROXY proxy.partner.test:8080"},
+		{"https://10.1.2.3/", "DIRECT"},
+		{"//10.1.2.3:443", "DIRECT"},
+		{"https://10.1.2.3:8443/", ""},
+		{"https://internal.test/", "DIRECT"},
+		{"http://www.test:8080/", "BLOCK"},
+		{"https://www.test:8080/", ""},
+		{"http://www.test/", ""},
+	}
+	lookupIP := func(host string) []net.IP {
+		if host == "internal.test" {
+			return []net.IP{net.ParseIP("10.9.8.7")}
+		}
+		return nil
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			u, err := url.Parse(test.input)
+			require.NoError(t, err)
+			var result string
+			for _, r := range rules {
+				if r.match(u, lookupIP) {
+					result = r.result
+					break
+				}
+			}
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
+
+func TestMatchRulesLookup(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+		cidr=10.0.0.0/8      DIRECT
+		cidr=192.168.0.0/16  PROXY proxy.test:8080
+	`))
+	require.NoError(t, err)
+	defer func(f func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = f }(
+		lookupIPAddr)
+	lookups := 0
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if host == "slow.test" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []net.IPAddr{{IP: net.ParseIP("192.168.1.1")}}, nil
+	}
+	match := func(ctx context.Context, rawurl string) string {
+		u, err := url.Parse(rawurl)
+		require.NoError(t, err)
+		r, _ := matchRules(ctx, rules, u)
+		return r.result
+	}
+	// IP addresses aren't looked up, and hostnames are only looked up once.
+	assert.Equal(t, "DIRECT", match(context.Background(), "https://10.1.2.3/"))
+	assert.Equal(t, 0, lookups)
+	assert.Equal(t, "PROXY proxy.test:8080", match(context.Background(), "https://internal.test/"))
+	assert.Equal(t, 1, lookups)
+	// Slow lookups give up after a while, or when the request is cancelled.
+	defer func(d time.Duration) { ruleLookupTimeout = d }(ruleLookupTimeout)
+	ruleLookupTimeout = 10 * time.Millisecond
+	assert.Equal(t, "", match(context.Background(), "https://slow.test/"))
+	ruleLookupTimeout = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, "", match(ctx, "https://slow.test/"))
+}
@@ -0,0 +1,118 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfSignedCert(t *testing.T) {
+	config, err := serverTLSConfig("", "", "proxy.example")
+	require.NoError(t, err)
+	require.Len(t, config.Certificates, 1)
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	for _, host := range []string{"localhost", "proxy.example", "127.0.0.1", "::1"} {
+		assert.NoError(t, cert.VerifyHostname(host), host)
+	}
+	assert.Error(t, cert.VerifyHostname("other.example"))
+	config, err = serverTLSConfig("", "", "192.0.2.1")
+	require.NoError(t, err)
+	cert, err = x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	assert.NoError(t, cert.VerifyHostname("192.0.2.1"))
+}
+
+func TestFingerprint(t *testing.T) {
+	fp := fingerprint([]byte("alpaca"))
+	assert.Len(t, fp, 32*3-1)
+	assert.Regexp(t, `^([0-9A-F]{2}:){31}[0-9A-F]{2}$`, fp)
+}
+
+func TestServerTLSFromFiles(t *testing.T) {
+	cert, err := selfSignedCert("localhost")
+	require.NoError(t, err)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "alpaca.crt")
+	keyFile := filepath.Join(dir, "alpaca.key")
+	bothFile := filepath.Join(dir, "alpaca.pem")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0644))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	require.NoError(t, os.WriteFile(bothFile, append(certPEM, keyPEM...), 0600))
+	config, err := serverTLSConfig(certFile, keyFile, "localhost")
+	require.NoError(t, err)
+	assert.Equal(t, cert.Certificate, config.Certificates[0].Certificate)
+	config, err = serverTLSConfig(bothFile, "", "localhost")
+	require.NoError(t, err)
+	assert.Equal(t, cert.Certificate, config.Certificates[0].Certificate)
+	_, err = serverTLSConfig(certFile, "", "localhost")
+	assert.Error(t, err)
+}
+
+func TestHTTPSListener(t *testing.T) {
+	server := httptest.NewServer(testServer{make(chan string, 1)})
+	defer server.Close()
+	config, err := serverTLSConfig("", "", "localhost")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	_, portStr, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	s := createServer(listenerConfig{host: "localhost", port: port, finder: ProxyFinderConfig{NoPAC: true}},
+		serverOptions{tls: config})
+	go s.ServeTLS(l, "", "") //nolint:errcheck
+	defer s.Close()
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	proxyURL := &url.URL{Scheme: "https", Host: net.JoinHostPort("localhost", portStr)}
+	client := http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// The PAC file served by alpaca should tell clients to use HTTPS.
+	client = http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err = client.Get(proxyURL.String() + "/alpaca.pac")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"HTTPS localhost:`+portStr+`"`)
+}
@@ -0,0 +1,138 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connTracker keeps track of the client connections that are in use, so that alpaca can wait
+// for them to finish when it shuts down. http.Server.Shutdown waits for requests to finish, but
+// not for CONNECT tunnels (since their connections have been hijacked).
+type connTracker struct {
+	active  map[net.Conn]bool // connections with a request in progress
+	tunnels map[*tunnel]bool
+	mux     sync.Mutex
+}
+
+type tunnel struct {
+	id             interface{}
+	host           string
+	start          time.Time
+	client, server net.Conn
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{active: map[net.Conn]bool{}, tunnels: map[*tunnel]bool{}}
+}
+
+// connState can be used as the ConnState hook of an http.Server.
+func (ct *connTracker) connState(conn net.Conn, state http.ConnState) {
+	ct.mux.Lock()
+	defer ct.mux.Unlock()
+	if state == http.StateActive {
+		ct.active[conn] = true
+	} else {
+		delete(ct.active, conn)
+	}
+}
+
+// addTunnel starts tracking a tunnel. It is safe to call on a nil connTracker (which does
+// nothing).
+func (ct *connTracker) addTunnel(t *tunnel) {
+	if ct == nil {
+		return
+	}
+	ct.mux.Lock()
+	defer ct.mux.Unlock()
+	ct.tunnels[t] = true
+}
+
+func (ct *connTracker) removeTunnel(t *tunnel) {
+	if ct == nil {
+		return
+	}
+	ct.mux.Lock()
+	defer ct.mux.Unlock()
+	delete(ct.tunnels, t)
+}
+
+// drain waits for all requests and tunnels to finish. If they haven't finished by the time the
+// context is done, the remaining tunnels are closed, and the number of requests and tunnels that
+// were interrupted is returned.
+func (ct *connTracker) drain(ctx context.Context) (int, int) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		ct.mux.Lock()
+		requests, tunnels := len(ct.active), len(ct.tunnels)
+		ct.mux.Unlock()
+		if requests == 0 && tunnels == 0 {
+			return 0, 0
+		}
+		select {
+		case <-ctx.Done():
+			return requests, ct.closeTunnels()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ct *connTracker) closeTunnels() int {
+	ct.mux.Lock()
+	defer ct.mux.Unlock()
+	n := len(ct.tunnels)
+	for t := range ct.tunnels {
+		d := time.Since(t.start).Round(time.Second)
+		logWith("id", t.id, "url", t.host, "duration", d).
+			Infof("Closing tunnel to %s (open for %v)", t.host, d)
+		t.client.Close()
+		t.server.Close()
+		delete(ct.tunnels, t)
+	}
+	return n
+}
+
+// shutdown stops the servers from accepting new connections, and waits (until the timeout
+// passes) for any requests and tunnels that are in progress to finish.
+func shutdown(servers []*http.Server, ct *connTracker, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil && err != context.DeadlineExceeded {
+				logWith("error", err).Errorf("Error shutting down server on %s: %v", s.Addr, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	requests, tunnels := ct.drain(ctx)
+	for _, s := range servers {
+		s.Close()
+	}
+	if requests == 0 && tunnels == 0 {
+		infof("Shutdown complete")
+	} else {
+		warnf("Shutdown complete after %v; interrupted %d requests and %d tunnels",
+			timeout, requests, tunnels)
+	}
+}
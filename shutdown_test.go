@@ -0,0 +1,160 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startAlpaca runs alpaca (without a PAC file) on a random port, and returns the server and its
+// address.
+func startAlpaca(t *testing.T, tracker *connTracker) (*http.Server, string) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	s := createServer(listenerConfig{host: "localhost", port: 3128, finder: ProxyFinderConfig{NoPAC: true}},
+		serverOptions{tracker: tracker})
+	go serve(s, l) //nolint:errcheck
+	t.Cleanup(func() { s.Close() })
+	return s, l.Addr().String()
+}
+
+// openTunnel opens a CONNECT tunnel to an echo server via alpaca.
+func openTunnel(t *testing.T, proxy string) (net.Conn, *bufio.Reader) {
+	server, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+	client, err := net.Dial("tcp", proxy)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	req, err := http.NewRequest(http.MethodConnect, "//"+server.Addr().String(), nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(client))
+	rd := bufio.NewReader(client)
+	resp, err := http.ReadResponse(rd, req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return client, rd
+}
+
+func echo(t *testing.T, conn net.Conn, rd *bufio.Reader) {
+	_, err := conn.Write([]byte("x"))
+	require.NoError(t, err)
+	b, err := rd.ReadByte()
+	require.NoError(t, err)
+	assert.Equal(t, byte('x'), b)
+}
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &b
+}
+
+func TestShutdownWaitsForTunnels(t *testing.T) {
+	tracker := newConnTracker()
+	s, addr := startAlpaca(t, tracker)
+	client, rd := openTunnel(t, addr)
+	echo(t, client, rd)
+	logs := captureLog(t)
+	done := make(chan struct{})
+	go func() {
+		shutdown([]*http.Server{s}, tracker, 10*time.Second)
+		close(done)
+	}()
+	// The tunnel keeps working while alpaca is shutting down, but new connections are refused.
+	time.Sleep(200 * time.Millisecond)
+	echo(t, client, rd)
+	_, err := net.Dial("tcp", addr)
+	assert.Error(t, err)
+	select {
+	case <-done:
+		t.Fatal("shutdown finished before the tunnel was closed")
+	default:
+	}
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't finish after the tunnel was closed")
+	}
+	assert.Contains(t, logs.String(), "Shutdown complete\n")
+}
+
+func TestShutdownClosesTunnelsAfterTimeout(t *testing.T) {
+	tracker := newConnTracker()
+	s, addr := startAlpaca(t, tracker)
+	client, rd := openTunnel(t, addr)
+	echo(t, client, rd)
+	logs := captureLog(t)
+	shutdown([]*http.Server{s}, tracker, 200*time.Millisecond)
+	_, err := rd.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.Contains(t, logs.String(), "Closing tunnel to ")
+	assert.Contains(t, logs.String(), "interrupted 0 requests and 1 tunnels")
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	tracker := newConnTracker()
+	s, addr := startAlpaca(t, tracker)
+	client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Host: addr})}}
+	result := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	// Wait for the request to reach alpaca before shutting down.
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		tracker.mux.Lock()
+		active := len(tracker.active)
+		tracker.mux.Unlock()
+		if active > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	captureLog(t)
+	shutdown([]*http.Server{s}, tracker, 10*time.Second)
+	assert.NoError(t, <-result)
+}
@@ -0,0 +1,126 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialSOCKS5 connects to addr via a SOCKS5 proxy (see https://tools.ietf.org/html/rfc1928).
+// Only the "no authentication required" method is supported. Net/http's Transport has its own
+// SOCKS5 support, but it isn't exposed, so we need this for tunnelling CONNECT requests.
+func dialSOCKS5(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	conn, err := newDialer().DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	// The handshake is limited by responseHeaderTimeout, or the context's deadline if that's
+	// sooner.
+	var deadline time.Time
+	if responseHeaderTimeout > 0 {
+		deadline = time.Now().Add(responseHeaderTimeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	if !deadline.IsZero() {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := socks5Connect(conn, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	// Version 5, one authentication method: 0 (no authentication required).
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	} else if buf[0] != 5 || buf[1] != 0 {
+		return errors.New("SOCKS5 proxy requires an unsupported authentication method")
+	}
+	// Version 5, command 1 (CONNECT), reserved, followed by the address type and address.
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("hostname too long: %q", host)
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	// The reply has the same layout as the request, with a reply code in place of the command.
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	} else if buf[0] != 5 {
+		return fmt.Errorf("unexpected SOCKS version %d", buf[0])
+	} else if buf[1] != 0 {
+		return fmt.Errorf("SOCKS5 proxy refused connection to %s (reply code %d)", addr, buf[1])
+	}
+	var skip int
+	switch buf[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", buf[3])
+	}
+	// Discard the bound address and port, which we have no use for.
+	_, err = io.CopyN(io.Discard, conn, int64(skip+binary.Size(uint16(0))))
+	return err
+}
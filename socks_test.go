@@ -0,0 +1,138 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// socks5Server is a minimal SOCKS5 server, which supports just enough of the protocol for
+// dialSOCKS5 to work. It supports IPv4 addresses and hostnames.
+func socks5Server(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn)
+		}
+	}()
+	return l
+}
+
+func serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0}) //nolint:errcheck
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:net.IPv4len]); err != nil {
+			return
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return
+		}
+		host = string(buf[:n])
+	default:
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+	upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}) //nolint:errcheck
+		return
+	}
+	defer upstream.Close()
+	reply := []byte{5, 0, 0, 3, byte(len("localhost"))}
+	reply = append(reply, "localhost"...)
+	conn.Write(append(reply, 0, 0)) //nolint:errcheck
+	go io.Copy(upstream, conn)      //nolint:errcheck
+	io.Copy(conn, upstream)         //nolint:errcheck
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("It works!"))
+	}))
+	defer server.Close()
+	proxy := socks5Server(t)
+	defer proxy.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	conn, err := dialSOCKS5(context.Background(),
+		&url.URL{Scheme: "socks5", Host: proxy.Addr().String()},
+		net.JoinHostPort("localhost", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "It works!", string(body))
+}
+
+func TestDialSOCKS5Refused(t *testing.T) {
+	proxy := socks5Server(t)
+	defer proxy.Close()
+	_, err := dialSOCKS5(context.Background(),
+		&url.URL{Scheme: "socks5", Host: proxy.Addr().String()},
+		"nonexistent.invalid:80")
+	assert.Error(t, err)
+}
+
+func TestDialSOCKS5Unreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	l.Close()
+	_, err = dialSOCKS5(context.Background(), &url.URL{Scheme: "socks5", Host: l.Addr().String()},
+		"alpaca.test:80")
+	var oe *net.OpError
+	require.ErrorAs(t, err, &oe)
+	assert.Equal(t, "proxyconnect", oe.Op)
+}
@@ -0,0 +1,96 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+// Timeouts for connections to upstream proxies and servers. These are set by command-line flags,
+// and a zero value means that there is no timeout.
+var (
+	// connectTimeout is how long to wait for a TCP connection to be established.
+	connectTimeout = 30 * time.Second
+	// tlsHandshakeTimeout is how long to wait for the TLS handshake with an HTTPS proxy.
+	tlsHandshakeTimeout = 10 * time.Second
+	// responseHeaderTimeout is how long to wait for the response headers after sending a
+	// request, including a CONNECT request or SOCKS handshake with an upstream proxy.
+	responseHeaderTimeout time.Duration
+	// idleTimeout is how long a CONNECT tunnel (or an idle keep-alive connection) can go
+	// without any data being sent in either direction before it is closed.
+	idleTimeout = 10 * time.Minute
+)
+
+func newDialer() *net.Dialer {
+	return &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+}
+
+// dialTLS is like tls.Dial, but applies connectTimeout to the TCP connection and
+// tlsHandshakeTimeout to the TLS handshake.
+func dialTLS(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	conn, err := newDialer().DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return handshakeTLS(ctx, conn, addr, config)
+}
+
+// handshakeTLS starts a TLS session over conn (which is closed if the handshake fails), applying
+// tlsHandshakeTimeout to the handshake. Unless the config has a server name, the host from addr
+// is used.
+func handshakeTLS(ctx context.Context, conn net.Conn, addr string,
+	config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	if tlsHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tlsHandshakeTimeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// activityReader resets an idle timer whenever data is read.
+type activityReader struct {
+	io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (ar activityReader) Read(p []byte) (int, error) {
+	n, err := ar.Reader.Read(p)
+	if n > 0 {
+		ar.timer.Reset(ar.timeout)
+	}
+	return n, err
+}
@@ -0,0 +1,155 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blackhole returns a listener that accepts connections, but never reads from or writes to them.
+func blackhole(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return l
+}
+
+func setTimeout(t *testing.T, timeout *time.Duration, value time.Duration) {
+	old := *timeout
+	*timeout = value
+	t.Cleanup(func() { *timeout = old })
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	setTimeout(t, &tlsHandshakeTimeout, 50*time.Millisecond)
+	l := blackhole(t)
+	var tr transport
+	start := time.Now()
+	err := tr.dial(context.Background(), &url.URL{Scheme: "https", Host: l.Addr().String()})
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	// A proxy that doesn't complete the handshake counts as unreachable.
+	assert.True(t, isProxyConnectError(err))
+	assert.Equal(t, failureTimeout, classifyFailure(err))
+}
+
+func TestTLSHandshakeTimeoutViaHTTPTransport(t *testing.T) {
+	setTimeout(t, &tlsHandshakeTimeout, 50*time.Millisecond)
+	l := blackhole(t)
+	proxy := &url.URL{Scheme: "https", Host: l.Addr().String()}
+	ph := NewProxyHandler(nil, http.ProxyURL(proxy), func(string, error) {})
+	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
+	_, err := ph.transport.RoundTrip(req)
+	require.Error(t, err)
+	assert.True(t, isProxyConnectError(err))
+}
+
+func TestConnectResponseTimeout(t *testing.T) {
+	setTimeout(t, &responseHeaderTimeout, 50*time.Millisecond)
+	l := blackhole(t)
+	req := httptest.NewRequest(http.MethodConnect, "https://www.test", nil)
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyID, 0))
+	_, err := connectViaProxy(req, &url.URL{Host: l.Addr().String()}, nil)
+	require.Error(t, err)
+	assert.Equal(t, failureTimeout, classifyFailure(err))
+}
+
+func TestSOCKSHandshakeTimeout(t *testing.T) {
+	setTimeout(t, &responseHeaderTimeout, 50*time.Millisecond)
+	l := blackhole(t)
+	proxy := &url.URL{Scheme: "socks5", Host: l.Addr().String()}
+	_, err := dialSOCKS5(context.Background(), proxy, "www.test:443")
+	require.Error(t, err)
+	assert.Equal(t, failureTimeout, classifyFailure(err))
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	setTimeout(t, &responseHeaderTimeout, 50*time.Millisecond)
+	l := blackhole(t)
+	proxy := httptest.NewServer(newDirectProxy())
+	defer proxy.Close()
+	client := http.Client{Transport: &http.Transport{Proxy: proxyServer(t, proxy)}}
+	resp, err := client.Get("http://" + l.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestIdleTunnelTimeout(t *testing.T) {
+	setTimeout(t, &idleTimeout, 200*time.Millisecond)
+	server, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer server.Close()
+	proxy := httptest.NewServer(newDirectProxy())
+	defer proxy.Close()
+	client, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	req, err := http.NewRequest(http.MethodConnect, "//"+server.Addr().String(), nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(client))
+	rd := bufio.NewReader(client)
+	resp, err := http.ReadResponse(rd, req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	conn, err := server.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	// Keep the tunnel busy for longer than the idle timeout, with data going one way only.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := conn.Write([]byte("x"))
+		require.NoError(t, err)
+		b, err := rd.ReadByte()
+		require.NoError(t, err)
+		assert.Equal(t, byte('x'), b)
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Once it's idle, it should be closed at both ends.
+	_, err = rd.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.Greater(t, time.Since(start), 2*idleTimeout)
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
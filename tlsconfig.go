@@ -0,0 +1,186 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// hostTLSConfigs holds the TLS configs for HTTPS proxies that need something other than
+// tlsClientConfig (i.e. a client certificate or a different server name), keyed by "host:port"
+// or just "host".
+var hostTLSConfigs map[string]*tls.Config
+
+// tlsOptions are the command-line options that are used to configure TLS connections to HTTPS
+// proxies.
+type tlsOptions struct {
+	// caFiles are PEM files containing CA certificates to trust, in addition to the system's.
+	caFiles []string
+	// clientCerts are client certificates in the form "[host=]certfile[,keyfile]". If the
+	// host is omitted, the certificate is used for every proxy. If the key file is omitted,
+	// the key must be in the same file as the certificate.
+	clientCerts []string
+	// serverNames override the server name that is sent (using SNI) and verified, in the
+	// form "host=name".
+	serverNames []string
+	// minVersion is the minimum TLS version, e.g. "1.2".
+	minVersion string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// configureTLS sets tlsClientConfig and hostTLSConfigs from the given options. If no options
+// are set, they are left alone (and Go's defaults are used).
+func configureTLS(opts tlsOptions) error {
+	if len(opts.caFiles) == 0 && len(opts.clientCerts) == 0 && len(opts.serverNames) == 0 &&
+		opts.minVersion == "" {
+		return nil
+	}
+	base := &tls.Config{}
+	if opts.minVersion != "" {
+		version, ok := tlsVersions[opts.minVersion]
+		if !ok {
+			return fmt.Errorf("invalid TLS version %q", opts.minVersion)
+		}
+		base.MinVersion = version
+	}
+	if len(opts.caFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, path := range opts.caFiles {
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			} else if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", path)
+			}
+		}
+		base.RootCAs = pool
+	}
+	certs := map[string][]tls.Certificate{}
+	for _, value := range opts.clientCerts {
+		host, files := splitHostOption(value)
+		certFile, keyFile := files, files
+		if i := strings.Index(files, ","); i >= 0 {
+			certFile, keyFile = files[:i], files[i+1:]
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("error loading client certificate %s: %w", certFile, err)
+		}
+		certs[host] = append(certs[host], cert)
+	}
+	base.Certificates = certs[""]
+	hosts := map[string]*tls.Config{}
+	configFor := func(host string) *tls.Config {
+		if _, ok := hosts[host]; !ok {
+			hosts[host] = base.Clone()
+		}
+		return hosts[host]
+	}
+	for host, hostCerts := range certs {
+		if host != "" {
+			// A host's own certificates replace the ones for all hosts.
+			configFor(host).Certificates = hostCerts
+		}
+	}
+	for _, value := range opts.serverNames {
+		host, name := splitHostOption(value)
+		if host == "" || name == "" {
+			return fmt.Errorf("invalid server name %q (should be host=name)", value)
+		}
+		configFor(host).ServerName = name
+	}
+	tlsClientConfig = base
+	hostTLSConfigs = hosts
+	return nil
+}
+
+// splitHostOption splits an option in the form "host=value", returning an empty host if there
+// isn't one.
+func splitHostOption(option string) (string, string) {
+	if i := strings.Index(option, "="); i >= 0 {
+		return option[:i], option[i+1:]
+	}
+	return "", option
+}
+
+// tlsConfigFor returns the TLS config to use when connecting to addr (in the form "host:port").
+func tlsConfigFor(addr string) *tls.Config {
+	if config, ok := hostTLSConfigs[addr]; ok {
+		return config
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if config, ok := hostTLSConfigs[host]; ok {
+			return config
+		}
+	}
+	return tlsClientConfig
+}
+
+// A tlsDialer makes the TLS connections for an http.Transport, which uses the same function to
+// connect to HTTPS proxies and to servers that requests are sent to directly. Only connections to
+// HTTPS proxies use the configs from the command-line options; connections to servers are made
+// with the transport's own dialer and Go's default config.
+type tlsDialer struct {
+	proxies sync.Map // the addresses of the HTTPS proxies that the transport has been given
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// proxy wraps the transport's Proxy function, to keep track of which addresses are proxies.
+func (td *tlsDialer) proxy(proxy proxyFunc) proxyFunc {
+	if proxy == nil {
+		return nil
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if u != nil && u.Scheme == "https" {
+			port := u.Port()
+			if port == "" {
+				port = defaultPorts[u.Scheme]
+			}
+			td.proxies.Store(net.JoinHostPort(u.Hostname(), port), struct{}{})
+		}
+		return u, err
+	}
+}
+
+// DialTLSContext can be used as the DialTLSContext function of an http.Transport.
+func (td *tlsDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if _, ok := td.proxies.Load(addr); ok {
+		return dialTLS(ctx, addr, tlsConfigFor(addr))
+	}
+	conn, err := td.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return handshakeTLS(ctx, conn, addr, nil)
+}
@@ -0,0 +1,276 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func resetTLS(t *testing.T) {
+	config, hosts := tlsClientConfig, hostTLSConfigs
+	t.Cleanup(func() { tlsClientConfig, hostTLSConfigs = config, hosts })
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) string {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}))
+	return path
+}
+
+// newClientCert creates a CA and a client certificate signed by it. It returns the CA, and the
+// paths to the client certificate and key files.
+func newClientCert(t *testing.T, dir, name string) (*x509.Certificate, string, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey,
+		caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err = x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	certFile := writePEM(t, filepath.Join(dir, name+".crt"), "CERTIFICATE", der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	keyFile := writePEM(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+	return ca, certFile, keyFile
+}
+
+// getViaHTTPSProxy sends a request to the given HTTPS proxy, using both ProxyHandler's
+// http.Transport and the transport used for CONNECT requests.
+func getViaHTTPSProxy(proxy *httptest.Server) (error, error) {
+	proxyURL := &url.URL{Scheme: "https", Host: proxy.Listener.Addr().String()}
+	ph := NewProxyHandler(nil, http.ProxyURL(proxyURL), func(string, error) {})
+	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
+	resp, err1 := ph.transport.RoundTrip(req)
+	if err1 == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err1 = fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+	}
+	var tr transport
+	defer tr.Close()
+	err2 := tr.dial(context.Background(), proxyURL)
+	if err2 == nil {
+		req = httptest.NewRequest(http.MethodConnect, "https://www.test", nil)
+		resp, err2 = tr.RoundTrip(req)
+		if err2 == nil {
+			resp.Body.Close()
+		}
+	}
+	return err1, err2
+}
+
+func newTLSProxy(t *testing.T, config *tls.Config) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	server.TLS = config
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func serverCAFile(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	return writePEM(t, path, "CERTIFICATE", server.Certificate().Raw)
+}
+
+func TestTLSCAFile(t *testing.T) {
+	resetTLS(t)
+	proxy := newTLSProxy(t, nil)
+	err1, err2 := getViaHTTPSProxy(proxy)
+	assert.Error(t, err1)
+	assert.Error(t, err2)
+	require.NoError(t, configureTLS(tlsOptions{caFiles: []string{serverCAFile(t, proxy)}}))
+	err1, err2 = getViaHTTPSProxy(proxy)
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	resetTLS(t)
+	dir := t.TempDir()
+	ca, certFile, keyFile := newClientCert(t, dir, "client")
+	_, otherCertFile, otherKeyFile := newClientCert(t, dir, "other")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	proxy := newTLSProxy(t, &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: pool})
+	host := proxy.Listener.Addr().String()
+	// The default certificate isn't trusted by the proxy, but the one for its host is.
+	require.NoError(t, configureTLS(tlsOptions{
+		caFiles: []string{serverCAFile(t, proxy)},
+		clientCerts: []string{
+			otherCertFile + "," + otherKeyFile,
+			host + "=" + certFile + "," + keyFile,
+		},
+	}))
+	err1, err2 := getViaHTTPSProxy(proxy)
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	require.NoError(t, configureTLS(tlsOptions{
+		caFiles:     []string{serverCAFile(t, proxy)},
+		clientCerts: []string{otherCertFile + "," + otherKeyFile},
+	}))
+	err1, err2 = getViaHTTPSProxy(proxy)
+	assert.Error(t, err1)
+	assert.Error(t, err2)
+}
+
+func TestTLSServerName(t *testing.T) {
+	resetTLS(t)
+	serverNames := make(chan string, 2)
+	proxy := newTLSProxy(t, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	})
+	// The test server's certificate is valid for example.com.
+	host := proxy.Listener.Addr().String()
+	require.NoError(t, configureTLS(tlsOptions{
+		caFiles:     []string{serverCAFile(t, proxy)},
+		serverNames: []string{host + "=example.com"},
+	}))
+	err1, err2 := getViaHTTPSProxy(proxy)
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.Equal(t, "example.com", <-serverNames)
+	assert.Equal(t, "example.com", <-serverNames)
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	resetTLS(t)
+	proxy := newTLSProxy(t, &tls.Config{MaxVersion: tls.VersionTLS12})
+	caFile := serverCAFile(t, proxy)
+	require.NoError(t, configureTLS(tlsOptions{caFiles: []string{caFile}, minVersion: "1.2"}))
+	err1, err2 := getViaHTTPSProxy(proxy)
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	require.NoError(t, configureTLS(tlsOptions{caFiles: []string{caFile}, minVersion: "1.3"}))
+	err1, err2 = getViaHTTPSProxy(proxy)
+	assert.Error(t, err1)
+	assert.Error(t, err2)
+}
+
+func TestTLSOptionsOnlyApplyToProxies(t *testing.T) {
+	resetTLS(t)
+	// The proxy's CA is trusted, and it's the only server that's also an HTTPS proxy.
+	proxy := newTLSProxy(t, nil)
+	server := newTLSProxy(t, nil)
+	require.NoError(t, configureTLS(tlsOptions{
+		caFiles: []string{serverCAFile(t, proxy), serverCAFile(t, server)},
+	}))
+	err1, _ := getViaHTTPSProxy(proxy)
+	assert.NoError(t, err1)
+	// Connections to servers that requests are sent to directly use Go's defaults, so they
+	// don't trust the CAs that are only meant for proxies.
+	ph := NewProxyHandler(nil, http.ProxyURL(nil), func(string, error) {})
+	_, err := ph.transport.RoundTrip(httptest.NewRequest(http.MethodGet, server.URL, nil))
+	var uerr x509.UnknownAuthorityError
+	assert.ErrorAs(t, err, &uerr)
+}
+
+func TestTLSDialerDirectConnections(t *testing.T) {
+	resetTLS(t)
+	proxy := newTLSProxy(t, nil)
+	require.NoError(t, configureTLS(tlsOptions{caFiles: []string{serverCAFile(t, proxy)}}))
+	var dialed []string
+	errDirect := errors.New("direct")
+	td := &tlsDialer{dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, errDirect
+	}}
+	proxyURL := &url.URL{Scheme: "https", Host: proxy.Listener.Addr().String()}
+	req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
+	_, err := td.proxy(http.ProxyURL(proxyURL))(req)
+	require.NoError(t, err)
+	// Connections to the proxy use the proxy's config (and not the transport's dialer)...
+	conn, err := td.DialTLSContext(context.Background(), "tcp", proxyURL.Host)
+	require.NoError(t, err)
+	conn.Close()
+	assert.Empty(t, dialed)
+	// ...but connections to other servers are made using the transport's dialer.
+	_, err = td.DialTLSContext(context.Background(), "tcp", "www.test:443")
+	assert.Equal(t, errDirect, err)
+	assert.Equal(t, []string{"www.test:443"}, dialed)
+}
+
+func TestInvalidTLSOptions(t *testing.T) {
+	resetTLS(t)
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "empty.pem")
+	require.NoError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0644))
+	tests := []struct {
+		name string
+		opts tlsOptions
+	}{
+		{"MissingCAFile", tlsOptions{caFiles: []string{filepath.Join(dir, "missing.pem")}}},
+		{"EmptyCAFile", tlsOptions{caFiles: []string{notPEM}}},
+		{"MissingClientCert", tlsOptions{clientCerts: []string{"proxy=missing.crt"}}},
+		{"BadServerName", tlsOptions{serverNames: []string{"example.com"}}},
+		{"BadVersion", tlsOptions{minVersion: "1.4"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Error(t, configureTLS(test.opts))
+		})
+	}
+}
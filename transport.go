@@ -1,4 +1,4 @@
-// Copyright 2021 The Alpaca Authors
+// Copyright 2021, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -16,11 +16,12 @@ package main
 
 import (
 	"bufio"
-	"crypto/tls"
+	"context"
 	"errors"
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 // transport creates and manages the lifetime of a net.Conn. Between the time that a remote server
@@ -29,18 +30,22 @@ import (
 type transport struct {
 	conn   net.Conn
 	reader *bufio.Reader
+	// headerTimeout, if non-zero, limits how long RoundTrip waits for the response headers.
+	headerTimeout time.Duration
 }
 
-func (t *transport) dial(proxy *url.URL) error {
+// dial connects to a proxy. The context limits how long connecting (and the TLS handshake, for
+// an HTTPS proxy) can take, as well as connectTimeout and tlsHandshakeTimeout.
+func (t *transport) dial(ctx context.Context, proxy *url.URL) error {
 	if err := t.Close(); err != nil {
 		return err
 	}
 	var conn net.Conn
 	var err error
 	if proxy.Scheme == "https" {
-		conn, err = tls.Dial("tcp", proxy.Host, tlsClientConfig)
+		conn, err = dialTLS(ctx, proxy.Host, tlsConfigFor(proxy.Host))
 	} else {
-		conn, err = net.Dial("tcp", proxy.Host)
+		conn, err = newDialer().DialContext(ctx, "tcp", proxy.Host)
 	}
 	if err != nil {
 		return &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
@@ -57,6 +62,12 @@ func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if err := req.Write(t.conn); err != nil {
 		return nil, err
 	}
+	if t.headerTimeout > 0 {
+		if err := t.conn.SetReadDeadline(time.Now().Add(t.headerTimeout)); err != nil {
+			return nil, err
+		}
+		defer func() { _ = t.conn.SetReadDeadline(time.Time{}) }()
+	}
 	return http.ReadResponse(t.reader, req)
 }
 
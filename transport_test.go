@@ -1,4 +1,4 @@
-// Copyright 2021, 2022 The Alpaca Authors
+// Copyright 2021, 2022, 2026 The Alpaca Authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -16,6 +16,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -34,7 +35,8 @@ func TestTransport(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(handler))
 	defer server.Close()
 	var tr transport
-	require.NoError(t, tr.dial(&url.URL{Host: server.Listener.Addr().String()}))
+	proxy := &url.URL{Host: server.Listener.Addr().String()}
+	require.NoError(t, tr.dial(context.Background(), proxy))
 	defer tr.Close()
 	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
 	require.NoError(t, err)